@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
+	"github.com/sindrishtepani/go-stripe/internal/validator"
+)
+
+// customerLoginLinkTTL is how many minutes a customer login link can be used for
+const customerLoginLinkTTL = 15
+
+// customerEmailLinkTTL is how many minutes a link confirming a customer's new email can
+// be used for
+const customerEmailLinkTTL = 60
+
+// allowAccountLink counts a sign in or email confirmation link requested for email, and
+// reports whether it can be sent or too many have been sent to it lately
+func (app *application) allowAccountLink(email string) (bool, error) {
+	subject := models.AccountLinkSubject(email)
+
+	limited, err := app.DB.CheckLockout(subject)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = app.DB.RecordFailure(subject)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	return limited.IsZero(), nil
+}
+
+// SendCustomerLoginLink emails a customer a link that signs them in to their account. The
+// response is the same whether or not the email belongs to a customer, and whether or not
+// too many links have been sent to it lately.
+func (app *application) SendCustomerLoginLink(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	ip := models.IPSubject(models.RemoteIP(r.RemoteAddr))
+	if !app.checkLockout(w, r, ip) {
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "If we have orders for that email, a link to sign in is on its way"
+
+	allowed, err := app.allowAccountLink(payload.Email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if !allowed {
+		app.writeJSON(w, http.StatusCreated, resp)
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(payload.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// asking for emails with no orders counts against the address, like a failed
+			// sign in
+			_, err = app.DB.RecordFailure(ip)
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		app.writeJSON(w, http.StatusCreated, resp)
+		return
+	}
+
+	link := fmt.Sprintf("%s/account/verify?email=%s", app.config.frontend, url.QueryEscape(customer.Email))
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link = sign.GenerateTokenFromString(link)
+
+	// send the email in the background, so that how long the response takes does not
+	// tell whether there was one to send
+	go func() {
+		err := app.SendMail("info@widgets.com", customer.Email, "Sign in to your account", "customer-login", data)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}()
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// CustomerAuthenticate exchanges a login link for a customer token
+func (app *application) CustomerAuthenticate(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Link string `json:"link"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	// other signed links, such as password resets, cannot be used to sign in
+	data, ok := sign.Data(payload.Link)
+	if !ok || sign.Expired(payload.Link, customerLoginLinkTTL) ||
+		!strings.HasPrefix(data, app.config.frontend+"/account/verify?") {
+		app.invalidCredentials(w)
+		return
+	}
+
+	u, err := url.Parse(data)
+	if err != nil {
+		app.invalidCredentials(w)
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(u.Query().Get("email"))
+	if err != nil {
+		app.invalidCredentials(w)
+		return
+	}
+
+	token, err := models.GenerateToken(customer.Id, 24*time.Hour, models.ScopeCustomer)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.InsertCustomerToken(token, customer)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool          `json:"error"`
+		Message string        `json:"message"`
+		Token   *models.Token `json:"authentication_token"`
+	}
+
+	resp.Error = false
+	resp.Message = fmt.Sprintf("token for %s created", customer.Email)
+	resp.Token = token
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CustomerOrders lists the orders and subscriptions of the signed in customer
+func (app *application) CustomerOrders(w http.ResponseWriter, r *http.Request) {
+	customer := authenticatedCustomer(r)
+
+	orders, err := app.DB.GetOrdersForCustomer(customer.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Customer *models.Customer `json:"customer"`
+		Orders   []*models.Order  `json:"orders"`
+	}
+	resp.Customer = customer
+	resp.Orders = orders
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// customerOrder loads an order of the signed in customer from the id in the url; it
+// writes the error response itself and returns false when there is no such order
+func (app *application) customerOrder(w http.ResponseWriter, r *http.Request) (models.Order, bool) {
+	orderId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	order, err := app.DB.GetOrderForCustomer(orderId, authenticatedCustomer(r).Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("order not found"), http.StatusNotFound)
+		return order, false
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return order, false
+	}
+
+	return order, true
+}
+
+// CustomerOrder gets one order of the signed in customer
+func (app *application) CustomerOrder(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.customerOrder(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, order)
+}
+
+// CustomerInvoice writes out the invoice of an order of the signed in customer as a pdf
+func (app *application) CustomerInvoice(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.customerOrder(w, r)
+	if !ok {
+		return
+	}
+
+	invoice := Invoice{
+		Id:        order.Id,
+		Amount:    order.Amount,
+		Currency:  order.Transaction.Currency,
+		Product:   order.Widget.Name,
+		Quantity:  order.Quantity,
+		FirstName: order.Customer.FirstName,
+		LastName:  order.Customer.LastName,
+		Email:     order.Customer.Email,
+		CreatedAt: order.CreatedAt,
+		Taxes:     invoiceTaxes(order.Taxes),
+	}
+
+	if len(order.Items) > 1 {
+		for _, item := range order.Items {
+			invoice.Items = append(invoice.Items, InvoiceItem{
+				Product:  item.Widget.Name,
+				Quantity: item.Quantity,
+				Amount:   item.Amount,
+			})
+		}
+	}
+
+	pdf, err := app.downloadInvoice(invoice)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the invoice could not be created"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"invoice-%d.pdf\"", order.Id))
+	w.Write(pdf)
+}
+
+// downloadInvoice has the invoice microservice render an invoice without mailing it
+func (app *application) downloadInvoice(invoice Invoice) ([]byte, error) {
+	url := "http://localhost:5000/invoice/download"
+	out, err := json.MarshalIndent(invoice, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(out))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invoice microservice returned %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// UpdateCustomerEmail emails a link to the new email the signed in customer wants to sign
+// in and be billed with; the email is only changed once the link is used, by
+// CustomerConfirmEmail, so that nobody can take over an email that is not theirs
+func (app *application) UpdateCustomerEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(strings.Contains(payload.Email, "@"), "email", "must be a valid email address")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	customer, err := app.DB.GetCustomer(authenticatedCustomer(r).Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(payload.Email))
+	if email == customer.Email {
+		app.failedValidation(w, r, map[string]string{"email": "is already your email"})
+		return
+	}
+
+	// whether the email is taken is only told to whoever can read it, once they use the
+	// link, so the response is the same for every email
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "A link to confirm your new email is on its way to it"
+
+	allowed, err := app.allowAccountLink(email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if !allowed {
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	// the link is only good while the customer still has the email they asked from
+	link := fmt.Sprintf("%s/account/confirm-email?customer=%d&from=%s&email=%s", app.config.frontend,
+		customer.Id, url.QueryEscape(customer.Email), url.QueryEscape(email))
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link = sign.GenerateTokenFromString(link)
+
+	go func() {
+		err := app.SendMail("info@widgets.com", email, "Confirm your new email", "customer-confirm-email", data)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}()
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CustomerConfirmEmail changes a customer's email to the one a link emailed by
+// UpdateCustomerEmail was sent to, here and at Stripe
+func (app *application) CustomerConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Link string `json:"link"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	invalid := errors.New("this link is not valid, please ask for a new one")
+
+	// other signed links, such as login links, cannot change an email
+	data, ok := sign.Data(payload.Link)
+	if !ok || !strings.HasPrefix(data, app.config.frontend+"/account/confirm-email?") {
+		app.errorJSON(w, invalid, http.StatusBadRequest)
+		return
+	}
+	if sign.Expired(payload.Link, customerEmailLinkTTL) {
+		app.errorJSON(w, errors.New("this link has expired, please ask for a new one"), http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(data)
+	if err != nil {
+		app.errorJSON(w, invalid, http.StatusBadRequest)
+		return
+	}
+	query := u.Query()
+
+	customerId, _ := strconv.Atoi(query.Get("customer"))
+	customer, err := app.DB.GetCustomer(customerId)
+	if err != nil || customer.Email != query.Get("from") {
+		app.errorJSON(w, invalid, http.StatusBadRequest)
+		return
+	}
+
+	email := query.Get("email")
+
+	err = app.DB.UpdateCustomerEmail(customer.Id, email)
+	if errors.Is(err, models.ErrEmailTaken) {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// Stripe mails receipts for subscription invoices to the email it holds
+	if customer.StripeCustomerId != "" {
+		_, err = app.Gateway.UpdateCustomerEmail(customer.StripeCustomerId, email)
+		if err != nil {
+			app.errorLog.Printf("could not update the email of stripe customer %s: %s", customer.StripeCustomerId, err)
+		}
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("Your email is now %s", email)
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CustomerCancelSubscription cancels a subscription of the signed in customer at the end
+// of the period already paid for
+func (app *application) CustomerCancelSubscription(w http.ResponseWriter, r *http.Request) {
+	_, order, ok := app.readSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Gateway.CancelSubscription(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.subscriptionUpdated(w, r, order, models.StatusCancelling, "Your subscription will cancel at the end of the period")
+}
+
+// UpdateSubscriptionCard pays the future invoices of a subscription of the signed in
+// customer with another card
+func (app *application) UpdateSubscriptionCard(w http.ResponseWriter, r *http.Request) {
+	req, order, ok := app.readSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if req.PaymentMethod == "" {
+		app.badRequest(w, r, errors.New("no card was given"))
+		return
+	}
+
+	_, err := app.Gateway.UpdateSubscriptionCard(order.Transaction.PaymentIntent, req.PaymentMethod)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	pm, err := app.Gateway.GetPaymentMethod(req.PaymentMethod)
+	if err != nil {
+		app.errorLog.Println(err)
+	} else {
+		err = app.DB.UpdateSubscriptionCard(order.TransactionId, pm.ID, pm.Card.Last4, int(pm.Card.ExpMonth), int(pm.Card.ExpYear))
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	app.subscriptionUpdated(w, r, order, order.StatusId, "Your card has been updated")
+}
@@ -6,10 +6,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/sindrishtepani/go-stripe/internal/cards"
 	"github.com/sindrishtepani/go-stripe/internal/driver"
 	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/tax"
 )
 
 const version = "1.0.0"
@@ -21,8 +24,12 @@ type config struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret    string
+		key       string
+		gateway   string
+		backend   string
+		fakeState string
+		webhook   string
 	}
 	smpt struct {
 		host     string
@@ -30,8 +37,19 @@ type config struct {
 		username string
 		password string
 	}
+	dunning struct {
+		schedule []time.Duration
+		interval time.Duration
+	}
+	tokens struct {
+		ttl           time.Duration
+		refreshTTL    time.Duration
+		sweepInterval time.Duration
+	}
 	secretkey string
 	frontend  string
+	images    string
+	tax       string
 }
 
 type application struct {
@@ -40,6 +58,14 @@ type application struct {
 	errorLog *log.Logger
 	version  string
 	DB       models.DBModel
+	Gateway  cards.Gateway
+	Tax      tax.Calculator
+	// Idempotency keeps the responses replayed for repeated Idempotency-Key headers
+	Idempotency models.IdempotencyStore
+	// Webhooks records the events Stripe sends
+	Webhooks webhookStore
+	// TwoFactors checks the codes users sign in with
+	TwoFactors twoFactorStore
 }
 
 func (app *application) serve() error {
@@ -62,6 +88,9 @@ func main() {
 
 	flag.IntVar(&cfg.port, "port", 4001, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {developement, production, maintainace}")
+	flag.StringVar(&cfg.stripe.gateway, "gateway", "stripe", "Payment gateway {stripe, fake}")
+	flag.StringVar(&cfg.stripe.backend, "stripe-backend", "", "Stripe API base URL (defaults to api.stripe.com)")
+	flag.StringVar(&cfg.stripe.fakeState, "fake-state", filepath.Join(os.TempDir(), "go-stripe-fake.json"), "file the fake gateway keeps its state in, shared by the front and back end")
 	flag.StringVar(&cfg.db.dsn, "dsn", "sshtepan:1234@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "DSN")
 	flag.StringVar(&cfg.smpt.host, "smpthost", "sandbox.smtp.mailtrap.io", "smpt host")
 	flag.StringVar(&cfg.smpt.username, "smptuser", "9e2f25062a07f9", "smpt user")
@@ -70,29 +99,74 @@ func main() {
 
 	flag.StringVar(&cfg.secretkey, "secret", "MRKLO5E2I7DMN0DQJADXGMPVL4N3O5FQ", "secret key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "front end path")
+	flag.StringVar(&cfg.images, "images", "./static/widgets", "directory widget images are uploaded to, served by the front end")
+	flag.StringVar(&cfg.tax, "tax", "rules", "Tax calculator {rules, none}")
+
+	var dunningSchedule string
+	flag.StringVar(&dunningSchedule, "dunning-schedule", "72h,120h,168h", "waits before each retry of a failed renewal; the subscription is cancelled after the last")
+	flag.DurationVar(&cfg.dunning.interval, "dunning-interval", time.Minute, "how often due renewal retries are made")
+
+	flag.DurationVar(&cfg.tokens.ttl, "token-ttl", 15*time.Minute, "how long an admin authentication token lasts")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 7*24*time.Hour, "how long an admin can go without using the api before signing in again")
+	flag.DurationVar(&cfg.tokens.sweepInterval, "token-sweep-interval", time.Hour, "how often expired tokens are deleted")
 
 	flag.Parse()
 
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.webhook = os.Getenv("STRIPE_WEBHOOK_SECRET")
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	if cfg.stripe.webhook == "" {
+		if cfg.env == "production" {
+			errorLog.Fatal("STRIPE_WEBHOOK_SECRET must be set in production")
+		}
+		infoLog.Println("STRIPE_WEBHOOK_SECRET is not set; Stripe webhooks are disabled")
+	}
+
+	schedule, err := parseDunningSchedule(dunningSchedule)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	cfg.dunning.schedule = schedule
+
+	gateway, err := cards.NewGateway(cfg.stripe.gateway, cfg.stripe.secret, cfg.stripe.key, cfg.stripe.backend, cfg.stripe.fakeState)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
 		errorLog.Fatal(err)
 	}
 	defer conn.Close()
 
+	db := models.DBModel{DB: conn}
+
+	calculator, err := db.NewTaxCalculator(cfg.tax)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	app := &application{
 		config:   cfg,
 		infoLog:  infoLog,
 		errorLog: errorLog,
 		version:  version,
-		DB:       models.DBModel{DB: conn},
+		DB:       db,
+		Gateway:  gateway,
+		Tax:      calculator,
+
+		Idempotency: &db,
+		Webhooks:    &db,
+		TwoFactors:  &db,
 	}
 
+	go app.runDunning()
+	go app.sweepTokens()
+
 	err = app.serve()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/validator"
+)
+
+// authenticateAPIKey gets the user requests made with an api key are authenticated as,
+// as long as the key can be used from where the request came from
+func (app *application) authenticateAPIKey(r *http.Request, key string) (*models.User, error) {
+	apiKey, err := app.DB.GetAPIKeyByKey(key)
+	if err != nil {
+		return nil, errors.New("no matching api key found")
+	}
+
+	ip := models.RemoteIP(r.RemoteAddr)
+	if !apiKey.AllowsIP(ip) {
+		return nil, errors.New("api key cannot be used from this address")
+	}
+
+	err = app.DB.TouchAPIKey(apiKey.Id, ip.String())
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	return apiKey.User(), nil
+}
+
+// AllAPIKeys lists every api key, revoked and expired ones included
+func (app *application) AllAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.DB.GetAPIKeys()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, keys)
+}
+
+// AllAPIKeyScopes lists the scopes an api key can be given
+func (app *application) AllAPIKeyScopes(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, models.APIKeyScopes)
+}
+
+// CreateAPIKey generates an api key. The key is only ever sent in this response; only
+// its hash is stored.
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name       string   `json:"name"`
+		Scopes     []string `json:"scopes"`
+		AllowedIPs []string `json:"allowed_ips"`
+		// Expiry is a date, yyyy-mm-dd, the key stops working at the start of
+		Expiry string `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user := authenticatedUser(r)
+	payload.Name = strings.TrimSpace(payload.Name)
+
+	v := validator.New()
+	v.Check(len(payload.Name) > 1, "name", "must be at least 2 characters")
+	v.Check(len(payload.Scopes) > 0, "scopes", "at least one must be chosen")
+	for _, scope := range payload.Scopes {
+		if !models.ValidAPIKeyScope(scope) {
+			v.AddError("scopes", fmt.Sprintf("%s is not a scope", scope))
+		}
+	}
+	// nobody can make a key that does more than they can
+	for _, p := range (&models.APIKey{Scopes: payload.Scopes}).User().Permissions {
+		v.Check(user.Can(p), "scopes", "cannot include scopes your role does not allow")
+	}
+
+	var allowedIPs []string
+	for _, ip := range payload.AllowedIPs {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+		v.Check(models.ValidAllowedIP(ip), "allowed_ips", fmt.Sprintf("%s is not an ip address or network", ip))
+		allowedIPs = append(allowedIPs, ip)
+	}
+
+	var expiry time.Time
+	if payload.Expiry != "" {
+		expiry, err = time.ParseInLocation("2006-01-02", payload.Expiry, time.Local)
+		v.Check(err == nil, "expiry", "must be a date")
+		v.Check(err != nil || expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	apiKey, err := models.GenerateAPIKey(payload.Name, payload.Scopes, allowedIPs, expiry, user.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	apiKey.Id, err = app.DB.InsertAPIKey(apiKey)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool           `json:"error"`
+		Message string         `json:"message"`
+		APIKey  *models.APIKey `json:"api_key"`
+	}
+	resp.Error = false
+	resp.Message = "api key created"
+	resp.APIKey = apiKey
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// RevokeAPIKey stops an api key from being used
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.DB.RevokeAPIKey(keyId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "API key revoked",
+		Id:      keyId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
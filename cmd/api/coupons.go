@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/money"
+)
+
+// errBelowMinimumCharge is returned when a discount leaves too little to charge a card
+var errBelowMinimumCharge = errors.New("the discounted total is too small to charge")
+
+// applyCoupon checks the posted coupon code for a widget and returns the coupon and the
+// discount it gives on amount; no code gives no discount
+func (app *application) applyCoupon(payload stripePayload, widget models.Widget, amount int) (models.Coupon, int, error) {
+	if payload.Coupon == "" {
+		return models.Coupon{}, 0, nil
+	}
+
+	return app.DB.ApplyCoupon(payload.Coupon, widget, amount)
+}
+
+// stripePromotionCode returns the Stripe promotion code for a coupon, creating it the
+// first time the coupon is used on a subscription
+func (app *application) stripePromotionCode(coupon models.Coupon) (string, error) {
+	if coupon.StripePromotionCodeId != "" {
+		return coupon.StripePromotionCodeId, nil
+	}
+
+	promotionCode, err := app.Gateway.CreatePromotionCode(coupon.Code, coupon.PercentOff, coupon.AmountOff,
+		coupon.Currency, coupon.MaxRedemptions, coupon.ExpiresAt)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.DB.LinkCouponToStripe(coupon.Id, promotionCode.Coupon.ID, promotionCode.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return promotionCode.ID, nil
+}
+
+// ValidateCoupon checks a coupon code against a product and returns what it would cost
+func (app *application) ValidateCoupon(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// the posted amount is not checked here, only priced
+	payload.Amount = ""
+	widget, amount, err := app.resolveAmount(payload)
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	if payload.Coupon == "" {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: models.ErrCouponInvalid.Error()})
+		return
+	}
+
+	_, discount, err := app.applyCoupon(payload, widget, amount)
+	if err != nil {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	if !widget.IsRecurring && amount-discount < money.Minimum(widget.Currency) {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: errBelowMinimumCharge.Error()})
+		return
+	}
+
+	var resp struct {
+		OK                bool   `json:"ok"`
+		Message           string `json:"message"`
+		Amount            int    `json:"amount"`
+		Discount          int    `json:"discount"`
+		Total             int    `json:"total"`
+		Currency          string `json:"currency"`
+		FormattedDiscount string `json:"formatted_discount"`
+		FormattedTotal    string `json:"formatted_total"`
+	}
+
+	resp.OK = true
+	resp.Message = "Coupon applied"
+	resp.Amount = amount
+	resp.Discount = discount
+	resp.Total = amount - discount
+	resp.Currency = widget.Currency
+	resp.FormattedDiscount = money.Format(discount, widget.Currency)
+	resp.FormattedTotal = money.Format(amount-discount, widget.Currency)
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
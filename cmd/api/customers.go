@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
+	"github.com/sindrishtepani/go-stripe/internal/validator"
+	stripe "github.com/stripe/stripe-go/v72"
+)
+
+// errInvalidSavedCard is returned for a saved card token that is forged, or for a card
+// that is no longer saved on the customer it was saved on
+var errInvalidSavedCard = errors.New("this saved card can no longer be used, please enter your card")
+
+// savedCardToken returns the token a browser keeps to pay with a card saved on a Stripe
+// customer. Only the browser that saved the card is given it, so knowing an email is not
+// enough to pay with someone's card.
+func (app *application) savedCardToken(customerId, pm string) string {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	data := url.Values{}
+	data.Set("customer", customerId)
+	data.Set("pm", pm)
+
+	return signer.GenerateTokenFromString("saved-card?" + data.Encode())
+}
+
+// savedCard checks a saved card token and returns the Stripe customer and the card
+func (app *application) savedCard(token string) (string, *stripe.PaymentMethod, error) {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	data, ok := signer.Data(token)
+	if !ok {
+		return "", nil, errInvalidSavedCard
+	}
+
+	u, err := url.Parse(data)
+	if err != nil || u.Path != "saved-card" {
+		return "", nil, errInvalidSavedCard
+	}
+	customerId := u.Query().Get("customer")
+
+	// a card removed from the customer in Stripe cannot be charged any more
+	pm, err := app.Gateway.GetPaymentMethod(u.Query().Get("pm"))
+	if err != nil {
+		app.errorLog.Println(err)
+		return "", nil, errInvalidSavedCard
+	}
+	if pm.Customer == nil || pm.Customer.ID != customerId {
+		return "", nil, errInvalidSavedCard
+	}
+
+	return customerId, pm, nil
+}
+
+// stripeCustomerFor returns the customer with an email, creating them and their Stripe
+// customer the first time they are seen
+func (app *application) stripeCustomerFor(r *http.Request, customer models.Customer) (models.Customer, error) {
+	id, err := app.DB.InsertCustomer(customer)
+	if err != nil {
+		return customer, err
+	}
+
+	customer, err = app.DB.GetCustomer(id)
+	if err != nil {
+		return customer, err
+	}
+
+	if customer.StripeCustomerId != "" {
+		return customer, nil
+	}
+
+	stripeCustomer, _, err := app.Gateway.CreateCustomer("", customer.Email, idempotencyKeyFor(r, "customer"))
+	if err != nil {
+		return customer, err
+	}
+
+	err = app.DB.SetStripeCustomerId(customer.Id, stripeCustomer.ID)
+	if err != nil {
+		return customer, err
+	}
+
+	// a customer saved at the same time may have been linked first
+	return app.DB.GetCustomer(customer.Id)
+}
+
+// CreateSetupIntent starts saving a card for the customer with the posted email
+func (app *application) CreateSetupIntent(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(strings.Contains(payload.Email, "@"), "cardholder-email", "must be a valid email address")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	customer, err := app.stripeCustomerFor(r, models.Customer{
+		FirstName: payload.FirstName,
+		LastName:  payload.LastName,
+		Email:     payload.Email,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not save your card"})
+		return
+	}
+
+	si, err := app.Gateway.CreateSetupIntent(customer.StripeCustomerId, idempotencyKeyFor(r, "setup-intent"))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not save your card"})
+		return
+	}
+
+	var resp struct {
+		OK           bool   `json:"ok"`
+		ClientSecret string `json:"client_secret"`
+	}
+	resp.OK = true
+	resp.ClientSecret = si.ClientSecret
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// SaveCard hands out the saved card token for a confirmed setup intent. Only the browser
+// that confirmed the setup intent knows its client secret.
+func (app *application) SaveCard(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	id, _, _ := strings.Cut(payload.ClientSecret, "_secret")
+	si, err := app.Gateway.RetrieveSetupIntent(id)
+	if err != nil || si.ClientSecret != payload.ClientSecret {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: "invalid setup intent"})
+		return
+	}
+
+	if si.Status != stripe.SetupIntentStatusSucceeded || si.Customer == nil || si.PaymentMethod == nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: "your card has not been saved"})
+		return
+	}
+
+	var resp struct {
+		OK            bool   `json:"ok"`
+		SavedCard     string `json:"saved_card"`
+		PaymentMethod string `json:"payment_method"`
+	}
+	resp.OK = true
+	resp.SavedCard = app.savedCardToken(si.Customer.ID, si.PaymentMethod.ID)
+	resp.PaymentMethod = si.PaymentMethod.ID
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
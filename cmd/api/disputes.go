@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/cards"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	stripe "github.com/stripe/stripe-go/v72"
+)
+
+// maxEvidenceSize is the most evidence, files and text together, that can be uploaded
+// for one dispute; Stripe takes no more than this per file
+const maxEvidenceSize = 5 << 20
+
+// evidenceTypes are the kinds of file Stripe accepts as dispute evidence
+var evidenceTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+}
+
+// AllDisputes lists the disputes that are still open, the most urgent first
+func (app *application) AllDisputes(w http.ResponseWriter, r *http.Request) {
+	disputes, err := app.DB.GetOpenDisputes()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, disputes)
+}
+
+// OneDispute gets one dispute
+func (app *application) OneDispute(w http.ResponseWriter, r *http.Request) {
+	dispute, ok := app.readDispute(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, dispute)
+}
+
+// readDispute loads the dispute with the id in the url; it writes the error response
+// itself and returns false when there is no such dispute
+func (app *application) readDispute(w http.ResponseWriter, r *http.Request) (models.Dispute, bool) {
+	disputeId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	dispute, err := app.DB.GetDispute(disputeId)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("dispute not found"), http.StatusNotFound)
+		return dispute, false
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return dispute, false
+	}
+
+	return dispute, true
+}
+
+// SubmitDisputeEvidence uploads the evidence for a dispute, an explanation and optionally
+// a receipt, customer communication and one other file, and submits it to the bank
+func (app *application) SubmitDisputeEvidence(w http.ResponseWriter, r *http.Request) {
+	dispute, ok := app.readDispute(w, r)
+	if !ok {
+		return
+	}
+
+	if !dispute.EvidenceSubmittedAt.IsZero() {
+		app.badRequest(w, r, errors.New("evidence has already been submitted for this dispute"))
+		return
+	}
+
+	if dispute.Status != string(stripe.DisputeStatusNeedsResponse) &&
+		dispute.Status != string(stripe.DisputeStatusWarningNeedsResponse) {
+		app.badRequest(w, r, fmt.Errorf("a dispute that is %s does not take evidence", strings.ReplaceAll(dispute.Status, "_", " ")))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxEvidenceSize+1024)
+	err := r.ParseMultipartForm(maxEvidenceSize)
+	if err != nil {
+		app.badRequest(w, r, errors.New("evidence is too large"))
+		return
+	}
+
+	evidence := cards.DisputeEvidence{
+		Text: strings.TrimSpace(r.FormValue("evidence")),
+	}
+	if evidence.Text == "" {
+		app.failedValidation(w, r, map[string]string{"evidence": "must be provided"})
+		return
+	}
+
+	files := []struct {
+		field  string
+		fileId *string
+	}{
+		{"receipt", &evidence.Receipt},
+		{"customer_communication", &evidence.CustomerCommunication},
+		{"uncategorized", &evidence.Uncategorized},
+	}
+	for _, f := range files {
+		*f.fileId, err = app.uploadEvidenceFile(r, f.field)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	submitted, err := app.Gateway.SubmitDisputeEvidence(dispute.StripeDisputeId, evidence)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.SaveDisputeEvidence(dispute.Id, evidence.Text, string(submitted.Status))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Evidence submitted",
+		Id:      dispute.Id,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// uploadEvidenceFile uploads the file sent as field to Stripe and returns its id; it
+// returns an empty id when no file was sent
+func (app *application) uploadEvidenceFile(r *http.Request, field string) (string, error) {
+	file, header, err := r.FormFile(field)
+	if errors.Is(err, http.ErrMissingFile) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// trust the contents of the file, not the name or content type sent with it
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+
+	if !evidenceTypes[http.DetectContentType(head[:n])] {
+		return "", fmt.Errorf("%s must be a pdf, jpeg or png file", header.Filename)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	uploaded, err := app.Gateway.UploadDisputeFile(header.Filename, file)
+	if err != nil {
+		return "", err
+	}
+
+	return uploaded.ID, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/money"
+	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
+	stripe "github.com/stripe/stripe-go/v72"
+)
+
+// dunningLinkTTL is how many minutes a link to update the card of a subscription whose
+// renewal failed can be used for
+const dunningLinkTTL = 30 * 24 * 60
+
+// dunningLease is how long a retry is held by the worker making it
+const dunningLease = 5 * time.Minute
+
+// parseDunningSchedule reads the comma separated waits between a failed renewal and each
+// retry of it, e.g. "72h,120h,168h"; the subscription is cancelled when the last retry fails
+func parseDunningSchedule(s string) ([]time.Duration, error) {
+	var schedule []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		wait, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if wait <= 0 {
+			return nil, fmt.Errorf("dunning wait %s must be positive", wait)
+		}
+		schedule = append(schedule, wait)
+	}
+
+	if len(schedule) == 0 {
+		return nil, errors.New("the dunning schedule needs at least one retry")
+	}
+
+	return schedule, nil
+}
+
+// startDunning puts a subscription whose renewal failed at risk, schedules its first retry
+// and asks the customer to update their card; failures Stripe retries itself are ignored
+func (app *application) startDunning(inv stripe.Invoice) error {
+	nextAttempt := time.Now().Add(app.config.dunning.schedule[0])
+
+	started, err := app.Webhooks.StartDunning(inv.Subscription.ID, inv.ID, nextAttempt)
+	if err != nil || !started {
+		return err
+	}
+
+	orderId, err := app.Webhooks.GetOrderIdByPaymentIntent(inv.Subscription.ID)
+	if err != nil {
+		return err
+	}
+
+	order, err := app.Webhooks.GetOrderById(orderId)
+	if err != nil {
+		return err
+	}
+
+	err = app.sendDunningEmail(order, nextAttempt)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	return nil
+}
+
+// sendDunningEmail tells a customer that a renewal payment failed, when it is tried again
+// and gives them a link to pay with another card
+func (app *application) sendDunningEmail(order models.Order, nextAttempt time.Time) error {
+	link := fmt.Sprintf("%s/subscriptions/update-card?subscription=%s",
+		app.config.frontend, url.QueryEscape(order.Transaction.PaymentIntent))
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	var data struct {
+		Link        string
+		Product     string
+		Amount      string
+		NextAttempt string
+		Final       bool
+	}
+	data.Link = sign.GenerateTokenFromString(link)
+	data.Product = order.Widget.Name
+	data.Amount = money.Format(order.Amount, order.Transaction.Currency)
+	data.NextAttempt = nextAttempt.Format("January 2, 2006")
+	if order.Dunning != nil {
+		data.Final = order.Dunning.Attempt == len(app.config.dunning.schedule)-1
+	}
+
+	return app.SendMail("info@widgets.com", order.Customer.Email, "Your subscription payment failed", "payment-failed", data)
+}
+
+// runDunning retries the due renewals every interval, for as long as the server runs
+func (app *application) runDunning() {
+	ticker := time.NewTicker(app.config.dunning.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		due, err := app.DB.GetDueDunning()
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+
+		for _, d := range due {
+			claimed, err := app.DB.ClaimDunning(d, dunningLease)
+			if err != nil {
+				app.errorLog.Println(err)
+				continue
+			}
+			if !claimed {
+				continue
+			}
+
+			err = app.retryDunning(d)
+			if err != nil {
+				app.errorLog.Printf("dunning of subscription %s: %s", d.SubscriptionId, err)
+			}
+		}
+	}
+}
+
+// payDunning pays the unpaid invoice of a subscription at risk, and puts the subscription
+// back in good standing when it is paid
+func (app *application) payDunning(d models.Dunning) (bool, error) {
+	inv, err := app.Gateway.RetrieveInvoice(d.InvoiceId)
+	if err != nil {
+		return false, err
+	}
+
+	if !inv.Paid {
+		inv, err = app.Gateway.PayInvoice(d.InvoiceId)
+		if err != nil {
+			if _, ok := err.(*stripe.Error); ok {
+				app.infoLog.Printf("retry of subscription %s failed: %s", d.SubscriptionId, err)
+				return false, nil
+			}
+			return false, err
+		}
+	}
+
+	if !inv.Paid {
+		return false, nil
+	}
+
+	err = app.DB.EndDunning(d.SubscriptionId)
+	if err != nil {
+		return true, err
+	}
+
+	return true, app.DB.UpdateOrderStatus(d.OrderId, models.StatusCleared)
+}
+
+// retryDunning makes a scheduled retry, scheduling the next one or cancelling the
+// subscription when it was the last
+func (app *application) retryDunning(d models.Dunning) error {
+	paid, err := app.payDunning(d)
+	if err != nil || paid {
+		return err
+	}
+
+	order, err := app.DB.GetOrderById(d.OrderId)
+	if err != nil {
+		return err
+	}
+	if order.Dunning == nil {
+		// paid or cancelled while the retry was being made
+		return nil
+	}
+
+	attempt := d.Attempt + 1
+	if attempt >= len(app.config.dunning.schedule) {
+		return app.cancelDunnedSubscription(order)
+	}
+
+	nextAttempt := time.Now().Add(app.config.dunning.schedule[attempt])
+	err = app.DB.ScheduleDunningRetry(d.Id, attempt, nextAttempt)
+	if err != nil {
+		return err
+	}
+
+	order.Dunning.Attempt = attempt
+	err = app.sendDunningEmail(order, nextAttempt)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	return nil
+}
+
+// cancelDunnedSubscription cancels a subscription whose last retry failed
+func (app *application) cancelDunnedSubscription(order models.Order) error {
+	_, err := app.Gateway.CancelSubscriptionNow(order.Transaction.PaymentIntent)
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.EndDunning(order.Transaction.PaymentIntent)
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.UpdateOrderStatus(order.Id, models.StatusCancelled)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Product string
+	}
+	data.Product = order.Widget.Name
+
+	err = app.SendMail("info@widgets.com", order.Customer.Email, "Your subscription has been cancelled", "subscription-cancelled", data)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	return nil
+}
+
+// DunningUpdateCard pays a subscription at risk with another card, from the link emailed
+// to the customer, and retries its unpaid invoice straight away
+func (app *application) DunningUpdateCard(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Link          string `json:"link"`
+		PaymentMethod string `json:"payment_method"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	data, ok := sign.Data(payload.Link)
+	if !ok || sign.Expired(payload.Link, dunningLinkTTL) ||
+		!strings.HasPrefix(data, app.config.frontend+"/subscriptions/update-card?") {
+		app.badRequest(w, r, errors.New("this link is not valid"))
+		return
+	}
+
+	u, err := url.Parse(data)
+	if err != nil {
+		app.badRequest(w, r, errors.New("this link is not valid"))
+		return
+	}
+	subId := u.Query().Get("subscription")
+
+	orderId, err := app.DB.GetOrderIdByPaymentIntent(subId)
+	if err != nil {
+		app.badRequest(w, r, errors.New("this subscription could not be found"))
+		return
+	}
+
+	order, err := app.DB.GetOrderById(orderId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if order.StatusId == models.StatusCancelled {
+		app.badRequest(w, r, errors.New("this subscription has been cancelled"))
+		return
+	}
+
+	_, err = app.Gateway.UpdateSubscriptionCard(subId, payload.PaymentMethod)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	pm, err := app.Gateway.GetPaymentMethod(payload.PaymentMethod)
+	if err != nil {
+		app.errorLog.Println(err)
+	} else {
+		err = app.DB.UpdateSubscriptionCard(order.TransactionId, pm.ID, pm.Card.Last4, int(pm.Card.ExpMonth), int(pm.Card.ExpYear))
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Your card has been updated"
+
+	if order.Dunning != nil {
+		paid, err := app.payDunning(*order.Dunning)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+
+		if paid {
+			resp.Message = "Your card has been updated and your payment has been made"
+		} else {
+			resp.Error = true
+			resp.Message = "Your card has been updated, but the payment failed. Please try another card."
+		}
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,9 +12,9 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/sindrishtepani/go-stripe/internal/cards"
 	"github.com/sindrishtepani/go-stripe/internal/encryption"
 	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/money"
 	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
 	"github.com/sindrishtepani/go-stripe/internal/validator"
 	stripe "github.com/stripe/stripe-go/v72"
@@ -31,8 +32,30 @@ type stripePayload struct {
 	LastFour      string `json:"last_4"`
 	Plan          string `json:"plan"`
 	ProductId     string `json:"product_id"`
+	Quantity      int    `json:"quantity"`
 	FirstName     string `json:"first_name"`
 	LastName      string `json:"last_name"`
+	Coupon        string `json:"coupon"`
+	// Country and Region are where the customer is taxed
+	Country string `json:"country"`
+	Region  string `json:"region"`
+	// Items is set instead of ProductId and Quantity when paying for a cart
+	Items []models.CartItem `json:"items"`
+	// SavedCard is set instead of PaymentMethod to pay with a card saved earlier
+	SavedCard string `json:"saved_card"`
+	// ClientSecret is the secret of the setup intent that saved a card
+	ClientSecret string `json:"client_secret"`
+}
+
+// reservationTTL is how long stock is held for a payment that has not completed
+const reservationTTL = 15 * time.Minute
+
+// quantity returns the posted quantity, defaulting to one
+func (p stripePayload) quantity() int {
+	if p.Quantity == 0 {
+		return 1
+	}
+	return p.Quantity
 }
 
 type jsonResponse struct {
@@ -51,24 +74,220 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	amount, err := strconv.Atoi(payload.Amount)
+	widget, amount, err := app.resolveAmount(payload)
+	if err != nil {
+		app.errorLog.Println(err)
+		j := jsonResponse{
+			OK:      false,
+			Message: err.Error(),
+		}
+		app.writeJSON(w, http.StatusBadRequest, j)
+		return
+	}
+
+	coupon, discount, err := app.applyCoupon(payload, widget, amount)
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	result, err := app.applyTax(payload, amount-discount)
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	amount = result.Total
+	if amount < money.Minimum(widget.Currency) {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: errBelowMinimumCharge.Error()})
+		return
+	}
+
+	// hold the stock while the customer confirms the payment
+	reservationId, err := app.DB.ReserveInventory(widget.Id, payload.quantity(), reservationTTL)
+	if errors.Is(err, models.ErrOutOfStock) {
+		app.writeJSON(w, http.StatusConflict, jsonResponse{OK: false, Message: err.Error()})
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not reserve stock"})
+		return
+	}
+
+	// the coupon is redeemed now, so the payment made at its discount cannot be refused later
+	var couponReservationId int
+	if coupon.Id > 0 {
+		couponReservationId, err = app.DB.ReserveCoupon(coupon.Id, discount, reservationTTL)
+		if err != nil {
+			if err := app.DB.ReleaseReservation(reservationId); err != nil {
+				app.errorLog.Println(err)
+			}
+			if errors.Is(err, models.ErrCouponExhausted) {
+				app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+				return
+			}
+			app.errorLog.Println(err)
+			app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not redeem coupon"})
+			return
+		}
+	}
+
+	app.createPaymentIntent(w, r, widget.Currency, amount, payload.SavedCard, couponReservationId, reservationId)
+}
+
+// VirtualTerminalPaymentIntent creates a payment intent for an amount typed in by an admin
+func (app *application) VirtualTerminalPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// the amount is typed in whole units of the currency, e.g. 10.50 or 1050 yen
+	currency := money.Normalize(payload.Currency)
+	amount, err := money.Parse(payload.Amount, currency)
+	if err != nil || amount < money.Minimum(currency) {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: "invalid amount"})
+		return
+	}
+
+	app.createPaymentIntent(w, r, currency, amount, "", 0)
+}
+
+// CartTotal prices the items of a cart
+func (app *application) CartTotal(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	currency := money.Normalize(payload.Currency)
+	items, total, err := app.DB.PriceCart(payload.Items, currency)
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	var resp struct {
+		Items          []models.OrderItem `json:"items"`
+		Total          int                `json:"total"`
+		Currency       string             `json:"currency"`
+		FormattedTotal string             `json:"formatted_total"`
+	}
+	resp.Items = items
+	resp.Total = total
+	resp.Currency = currency
+	resp.FormattedTotal = money.Format(total, currency)
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CartPaymentIntent creates a single payment intent covering every item of a cart,
+// priced from the widgets table, and holds stock for each item
+func (app *application) CartPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// every item of a cart is charged in the one currency chosen at checkout
+	currency := money.Normalize(payload.Currency)
+	items, total, err := app.DB.PriceCart(payload.Items, currency)
 	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	for _, item := range items {
+		if !item.Widget.Active {
+			app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: models.ErrWidgetUnavailable.Error()})
+			return
+		}
+	}
+
+	if payload.Amount != "" {
+		posted, err := strconv.Atoi(payload.Amount)
+		if err != nil || posted != total {
+			app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: models.ErrPriceMismatch.Error()})
+			return
+		}
+	}
+
+	result, err := app.applyTax(payload, total)
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	reservationIds, err := app.DB.ReserveItems(items, reservationTTL)
+	if errors.Is(err, models.ErrOutOfStock) {
+		app.writeJSON(w, http.StatusConflict, jsonResponse{OK: false, Message: err.Error()})
+		return
+	} else if err != nil {
 		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not reserve stock"})
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+	app.createPaymentIntent(w, r, currency, result.Total, payload.SavedCard, 0, reservationIds...)
+}
+
+// createPaymentIntent charges amount, to the saved card savedCard when it is set, and
+// writes out the payment intent; the coupon reservation, if any, and the stock
+// reservations are tied to the payment intent, or released if the charge fails
+func (app *application) createPaymentIntent(w http.ResponseWriter, r *http.Request, currency string, amount int, savedCard string, couponReservationId int, reservationIds ...int) {
+	var pi *stripe.PaymentIntent
+	var msg string
+	var err error
+
+	if savedCard == "" {
+		pi, msg, err = app.Gateway.Charge(currency, amount, idempotencyKeyFor(r, "payment-intent"))
+	} else {
+		var customerId string
+		var pm *stripe.PaymentMethod
+		customerId, pm, err = app.savedCard(savedCard)
+		if err != nil {
+			msg = err.Error()
+		} else {
+			pi, msg, err = app.Gateway.ChargeSavedCard(currency, amount, customerId, pm.ID, idempotencyKeyFor(r, "payment-intent"))
+		}
 	}
 
 	ok := true
-	pi, msg, err := card.Charge(payload.Currency, amount)
 	if err != nil {
 		ok = false
 	}
 
+	for _, reservationId := range reservationIds {
+		if ok {
+			err = app.DB.AttachReservation(reservationId, pi.ID)
+		} else {
+			err = app.DB.ReleaseReservation(reservationId)
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	if couponReservationId > 0 {
+		if ok {
+			err = app.DB.AttachCouponReservation(couponReservationId, pi.ID)
+		} else {
+			err = app.DB.ReleaseCouponReservation(couponReservationId)
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
 	if ok {
 		out, err := json.MarshalIndent(pi, "", "  ")
 		if err != nil {
@@ -120,11 +339,45 @@ type Invoice struct {
 	Id        int       `json:"id"`
 	Quantity  int       `json:"quantity"`
 	Amount    int       `json:"amount"`
+	Currency  string    `json:"currency"`
 	Product   string    `json:"product"`
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
+	// Items lists the lines of an order for more than one widget
+	Items []InvoiceItem `json:"items,omitempty"`
+	// Taxes lists the taxes charged; Amount includes any that are not inclusive
+	Taxes []InvoiceTax `json:"taxes,omitempty"`
+}
+
+// InvoiceItem is one line of an invoice
+type InvoiceItem struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+	Amount   int    `json:"amount"`
+}
+
+// InvoiceTax is one tax line of an invoice
+type InvoiceTax struct {
+	Name      string  `json:"name"`
+	Rate      float64 `json:"rate"`
+	Inclusive bool    `json:"inclusive"`
+	Amount    int     `json:"amount"`
+}
+
+// invoiceTaxes returns the invoice lines for the taxes charged on an order
+func invoiceTaxes(taxes []models.OrderTax) []InvoiceTax {
+	var lines []InvoiceTax
+	for _, t := range taxes {
+		lines = append(lines, InvoiceTax{
+			Name:      t.Name,
+			Rate:      t.Rate,
+			Inclusive: t.Inclusive,
+			Amount:    t.Amount,
+		})
+	}
+	return lines
 }
 
 func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
@@ -145,17 +398,78 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: data.Currency,
+	// the plan and amount come from the catalog, never from the client; a
+	// subscription is always for a single plan
+	data.Quantity = 1
+	widget, amount, err := app.resolveAmount(data)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	if !widget.IsRecurring {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: "product is not a subscription plan"})
+		return
+	}
+
+	// a plan in another currency can only be sold once it has a Stripe price
+	if widget.PlanId == "" {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: models.ErrCurrencyNotOffered.Error()})
+		return
+	}
+
+	if data.Plan != "" && data.Plan != widget.PlanId {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: "plan does not match the product"})
+		return
+	}
+	data.Plan = widget.PlanId
+
+	coupon, discount, err := app.applyCoupon(data, widget, amount)
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	var promotionCode string
+	if coupon.Id > 0 {
+		promotionCode, err = app.stripePromotionCode(coupon)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not apply coupon"})
+			return
+		}
+	}
+
+	// Stripe charges the same taxes on every invoice of the subscription
+	taxResult, err := app.applyTax(data, amount-discount)
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	taxRates, err := app.stripeTaxRates(taxResult)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not apply tax"})
+		return
+	}
+
+	reservationId, err := app.DB.ReserveInventory(widget.Id, 1, reservationTTL)
+	if errors.Is(err, models.ErrOutOfStock) {
+		app.writeJSON(w, http.StatusConflict, jsonResponse{OK: false, Message: err.Error()})
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not reserve stock"})
+		return
 	}
 
 	okay := true
 	var subscription *stripe.Subscription
 	txnMsg := "Transaction Successful"
 
-	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
+	stripeCustomer, msg, err := app.subscriptionCustomer(r, &data)
 	if err != nil {
 		app.errorLog.Println(err)
 		okay = false
@@ -163,77 +477,101 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 	}
 
 	if okay {
-		subscription, err = card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
+		subscription, err = app.Gateway.SubscribeToPlan(stripeCustomer, data.PaymentMethod, data.Plan, data.Email, data.LastFour, "",
+			widget.TrialDays, promotionCode, taxRates, idempotencyKeyFor(r, "subscription"))
 		if err != nil {
 			app.errorLog.Println(err)
 			okay = false
 			txnMsg = "Error subscribing customer"
 		}
-		app.infoLog.Println(subscription.ID)
 	}
 
+	// a first payment that is declined leaves an incomplete subscription behind
+	var authentication *subscriptionAuthentication
 	if okay {
-		// create customer
-		productId, _ := strconv.Atoi(data.ProductId)
-		customerId, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
+		authentication, err = pendingAuthentication(subscription)
 		if err != nil {
 			app.errorLog.Println(err)
-			return
+			app.cancelIncompleteSubscription(subscription.ID)
+			okay = false
+			txnMsg = err.Error()
 		}
+	}
 
-		// create transaction
-		amount, _ := strconv.Atoi(data.Amount)
+	if okay {
+		err = app.DB.AttachReservation(reservationId, subscription.ID)
+	} else {
+		err = app.DB.ReleaseReservation(reservationId)
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+	}
 
-		txn := models.Transaction{
-			Amount:              amount,
-			Currency:            "cad",
-			LastFour:            data.LastFour,
-			ExpiryMonth:         data.ExpiryMonth,
-			ExpiryYear:          data.ExpiryYear,
-			TransactionStatusId: 2,
-			PaymentIntent:       subscription.ID,
-			PaymentMethod:       data.PaymentMethod,
+	if okay {
+		// nothing is charged until a free trial ends
+		charged := taxResult.Total
+		if widget.TrialDays > 0 {
+			charged = 0
 		}
 
-		txnId, err := app.SaveTransaction(txn)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
+		pending := models.PendingSubscription{
+			SubscriptionId: subscription.ID,
+			Customer: models.Customer{
+				FirstName:        data.FirstName,
+				LastName:         data.LastName,
+				Email:            data.Email,
+				StripeCustomerId: stripeCustomer.ID,
+			},
+			Transaction: models.Transaction{
+				Amount:              charged,
+				Currency:            widget.Currency,
+				LastFour:            data.LastFour,
+				ExpiryMonth:         data.ExpiryMonth,
+				ExpiryYear:          data.ExpiryYear,
+				TransactionStatusId: models.TransactionCleared,
+				PaymentIntent:       subscription.ID,
+				PaymentMethod:       data.PaymentMethod,
+			},
+			Order: models.Order{
+				WidgetId: widget.Id,
+				StatusId: models.StatusCleared,
+				Quantity: 1,
+				Amount:   taxResult.Total,
+				CouponId: coupon.Id,
+				Discount: discount,
+				Tax:      taxResult.Tax,
+				Country:  data.Country,
+				Region:   data.Region,
+				Taxes:    models.OrderTaxes(taxResult),
+			},
 		}
 
-		// create order
-		order := models.Order{
-			WidgetId:      productId,
-			TransactionId: txnId,
-			CustomerId:    customerId,
-			StatusId:      1,
-			Quantity:      1,
-			Amount:        amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
-		}
+		// the order waits until the customer has authenticated the payment
+		if authentication != nil {
+			err = app.DB.InsertPendingSubscription(pending)
+			if err != nil {
+				app.errorLog.Println(err)
+				app.cancelIncompleteSubscription(subscription.ID)
+				if err := app.DB.ReleaseReservation(reservationId); err != nil {
+					app.errorLog.Println(err)
+				}
+				app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "your subscription could not be saved and has been cancelled"})
+				return
+			}
 
-		orderId, err := app.SaveOrder(order)
-		if err != nil {
-			app.errorLog.Println(err)
+			app.writeJSON(w, http.StatusOK, authentication)
 			return
 		}
 
-		// call microservice
-		invoice := Invoice{
-			Id:        orderId,
-			Amount:    order.Amount,
-			Product:   "Widget",
-			Quantity:  order.Quantity,
-			FirstName: data.FirstName,
-			LastName:  data.LastName,
-			Email:     data.Email,
-			CreatedAt: time.Now(),
-		}
-
-		err = app.callInvoiceMircoservice(invoice)
+		_, err = app.saveSubscriptionOrder(pending)
 		if err != nil {
 			app.errorLog.Println(err)
+			app.cancelUnsavedSubscription(subscription)
+			if err := app.DB.ReleaseReservation(reservationId); err != nil {
+				app.errorLog.Println(err)
+			}
+			app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "your subscription could not be saved and has been cancelled"})
+			return
 		}
 	}
 
@@ -252,6 +590,93 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 	w.Write(out)
 }
 
+// subscriptionCustomer returns the Stripe customer a subscription is billed to and sets
+// the card it is paid with. A saved card is paid with as it was saved; a new card is
+// saved on the Stripe customer already linked to the email, or on a new one.
+func (app *application) subscriptionCustomer(r *http.Request, data *stripePayload) (*stripe.Customer, string, error) {
+	if data.SavedCard != "" {
+		customerId, pm, err := app.savedCard(data.SavedCard)
+		if err != nil {
+			return nil, err.Error(), err
+		}
+
+		data.PaymentMethod = pm.ID
+		data.LastFour = pm.Card.Last4
+		data.ExpiryMonth = int(pm.Card.ExpMonth)
+		data.ExpiryYear = int(pm.Card.ExpYear)
+
+		return &stripe.Customer{ID: customerId}, "", nil
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(data.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, "", err
+	}
+
+	if customer.StripeCustomerId == "" {
+		return app.Gateway.CreateCustomer(data.PaymentMethod, data.Email, idempotencyKeyFor(r, "customer"))
+	}
+
+	_, err = app.Gateway.AttachPaymentMethod(data.PaymentMethod, customer.StripeCustomerId)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = stripeErr.Msg
+		}
+		return nil, msg, err
+	}
+
+	return &stripe.Customer{ID: customer.StripeCustomerId}, "", nil
+}
+
+// cancelUnsavedSubscription undoes a subscription that was created with Stripe but
+// could not be saved, refunding its first payment
+func (app *application) cancelUnsavedSubscription(subscription *stripe.Subscription) {
+	err := app.Gateway.CancelSubscription(subscription.ID)
+	if err != nil {
+		app.errorLog.Printf("could not cancel unsaved subscription %s: %s", subscription.ID, err)
+	}
+
+	if subscription.LatestInvoice == nil || subscription.LatestInvoice.PaymentIntent == nil {
+		return
+	}
+
+	pi := subscription.LatestInvoice.PaymentIntent
+	_, err = app.Gateway.Refund(pi.ID, int(pi.Amount), pi.ID+"-compensation")
+	if err != nil {
+		app.errorLog.Printf("could not refund unsaved subscription %s: %s", subscription.ID, err)
+	}
+}
+
+// resolveAmount prices the posted product in the posted currency from the widgets table,
+// rejecting any posted amount that does not match; no currency uses the widget's own
+func (app *application) resolveAmount(payload stripePayload) (models.Widget, int, error) {
+	widgetId, err := strconv.Atoi(payload.ProductId)
+	if err != nil {
+		return models.Widget{}, 0, errors.New("invalid product")
+	}
+
+	widget, amount, err := app.DB.WidgetTotal(widgetId, payload.quantity(), payload.Currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return widget, 0, errors.New("invalid product")
+	} else if err != nil {
+		return widget, 0, err
+	}
+
+	if !widget.Active {
+		return widget, 0, models.ErrWidgetUnavailable
+	}
+
+	if payload.Amount != "" {
+		posted, err := strconv.Atoi(payload.Amount)
+		if err != nil || posted != amount {
+			return widget, 0, models.ErrPriceMismatch
+		}
+	}
+
+	return widget, amount, nil
+}
+
 func (app *application) callInvoiceMircoservice(invoice Invoice) error {
 	url := "http://localhost:5000/invoice/create-and-send"
 	out, err := json.MarshalIndent(invoice, "", "\t")
@@ -276,21 +701,6 @@ func (app *application) callInvoiceMircoservice(invoice Invoice) error {
 	return nil
 }
 
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
 func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	id, err := app.DB.InsertTransaction(txn)
 	if err != nil {
@@ -300,15 +710,6 @@ func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	return id, nil
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
 func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request) {
 	var userInput struct {
 		Email    string `json:"email"`
@@ -321,26 +722,57 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// failures are counted against the email whether or not it has an account, so that
+	// being locked out says nothing about which emails do
+	attempt := []models.LockoutSubject{models.IPSubject(models.RemoteIP(r.RemoteAddr)), models.AccountSubject(userInput.Email)}
+	if !app.checkLockout(w, r, attempt...) {
+		return
+	}
+
 	// get the user from the database by email; send error if invalid email
 	user, err := app.DB.GetUserByEmail(userInput.Email)
 	if err != nil {
-		app.invalidCredentials(w)
+		app.failedSignIn(w, attempt...)
 		return
 	}
 
 	// validate the password; send error if invalid password
 	validPassword, err := app.passwordMatches(user.Password, userInput.Password)
 	if err != nil {
-		app.invalidCredentials(w)
+		app.failedSignIn(w, attempt...)
 		return
 	}
 
 	if !validPassword {
-		app.invalidCredentials(w)
+		app.failedSignIn(w, attempt...)
+		return
+	}
+
+	// users with two-factor authentication get a challenge to answer with their code
+	// rather than a token
+	twoFactor, err := app.DB.GetTwoFactor(user.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
 		return
 	}
+	if twoFactor.Enabled() {
+		var resp struct {
+			Error     bool   `json:"error"`
+			Message   string `json:"message"`
+			TwoFactor bool   `json:"two_factor_required"`
+			Challenge string `json:"challenge"`
+		}
+		resp.Error = false
+		resp.Message = "two-factor code required"
+		resp.TwoFactor = true
+		resp.Challenge = app.twoFactorChallenge(user.Id)
+
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
 	// generate token
-	token, err := models.GenerateToken(user.Id, 24*time.Hour, models.ScopeAuthentication)
+	token, err := app.newAuthToken(r, user.Id)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -352,6 +784,11 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	err = app.DB.ClearFailures(attempt...)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	// send response
 
 	var payload struct {
@@ -399,28 +836,59 @@ func (app *application) passwordMatches(hash, password string) (bool, error) {
 }
 
 func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
+	// api keys are sent the same way as tokens, and told apart by their prefix
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.HasPrefix(key, models.APIKeyPrefix) {
+		return app.authenticateAPIKey(r, key)
+	}
+
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// get user from tokens table
+	user, err := app.DB.GetUserByToken(token)
+	if err != nil {
+		return nil, errors.New("no matching user found")
+	}
+
+	return user, nil
+}
+
+// authenticateCustomerToken gets the customer a request's customer token was issued to
+func (app *application) authenticateCustomerToken(r *http.Request) (*models.Customer, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	customer, err := app.DB.GetCustomerByToken(token)
+	if err != nil {
+		return nil, errors.New("no matching customer found")
+	}
+
+	return customer, nil
+}
+
+// bearerToken reads the token from the Authorization header of a request
+func bearerToken(r *http.Request) (string, error) {
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header received")
+		return "", errors.New("no authorization header received")
 	}
 
 	headerParts := strings.Split(authorizationHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("no authorization header received")
+		return "", errors.New("no authorization header received")
 	}
 
 	token := headerParts[1]
 	if len(token) != 26 {
-		return nil, errors.New("authentication token wrong size")
+		return "", errors.New("authentication token wrong size")
 	}
 
-	// get user from tokens table
-	user, err := app.DB.GetUserByToken(token)
-	if err != nil {
-		return nil, errors.New("no matching user found")
-	}
-
-	return user, nil
+	return token, nil
 }
 
 func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Request) {
@@ -463,18 +931,13 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(txnData.PaymentIntent)
+	pi, err := app.Gateway.RetrievePaymentIntent(txnData.PaymentIntent)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	pm, err := card.GetPaymentMethod(txnData.PaymentMethod)
+	pm, err := app.Gateway.GetPaymentMethod(txnData.PaymentMethod)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -496,8 +959,23 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		PaymentMethod:       txnData.PaymentMethod,
 	}
 
+	// a payment that was already saved, by an earlier or a concurrent post, is only
+	// returned again
+	_, err = app.DB.GetTransactionIdByPaymentIntent(txn.PaymentIntent)
+	if err == nil {
+		app.writeJSON(w, http.StatusOK, txn)
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		app.badRequest(w, r, err)
+		return
+	}
+
 	_, err = app.SaveTransaction(txn)
 	if err != nil {
+		if _, lookupErr := app.DB.GetTransactionIdByPaymentIntent(txn.PaymentIntent); lookupErr == nil {
+			app.writeJSON(w, http.StatusOK, txn)
+			return
+		}
 		app.badRequest(w, r, err)
 		return
 	}
@@ -516,21 +994,50 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	// verify that email exists
+	ip := models.IPSubject(models.RemoteIP(r.RemoteAddr))
+	if !app.checkLockout(w, r, ip) {
+		return
+	}
 
-	_, err = app.DB.GetUserByEmail(payload.Email)
+	// the response is the same whether or not the email has an account, and whether or
+	// not too many emails have been sent to it lately, so that it gives nothing away
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "If that email has an account, a password reset link is on its way"
+
+	reset := models.PasswordResetSubject(payload.Email)
+	limited, err := app.DB.CheckLockout(reset)
 	if err != nil {
-		var resp struct {
-			Error   bool   `json:"error"`
-			Message string `json:"message"`
+		app.badRequest(w, r, err)
+		return
+	}
+
+	_, err = app.DB.RecordFailure(reset)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	if !limited.IsZero() {
+		app.writeJSON(w, http.StatusCreated, resp)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(payload.Email)
+	if err != nil {
+		// asking for emails with no account counts against the address, like a failed
+		// sign in, but resets for real accounts do not lock anyone else out
+		_, err = app.DB.RecordFailure(ip)
+		if err != nil {
+			app.errorLog.Println(err)
 		}
-		resp.Error = true
-		resp.Message = "No matching email found on our system"
-		app.writeJSON(w, http.StatusAccepted, err)
+		app.writeJSON(w, http.StatusCreated, resp)
 		return
 	}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, payload.Email)
+	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, user.Email)
 
 	sign := urlsigner.Signer{
 		Secret: []byte(app.config.secretkey),
@@ -544,20 +1051,14 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 
 	data.Link = signedLink
 
-	// send email
-	err = app.SendMail("info@widgets.com", payload.Email, "Password Reset Request", "password-reset", data)
-	if err != nil {
-		app.errorLog.Println(err)
-		app.badRequest(w, r, err)
-		return
-	}
-
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
-	}
-
-	resp.Error = false
+	// send the email in the background, so that how long the response takes does not
+	// tell whether there was one to send
+	go func() {
+		err := app.SendMail("info@widgets.com", user.Email, "Password Reset Request", "password-reset", data)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}()
 
 	app.writeJSON(w, http.StatusCreated, resp)
 }
@@ -694,12 +1195,13 @@ func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusOK, order)
 }
 
+// RefundCharge refunds some or all of what is left to refund on an order; an amount
+// of 0 refunds the rest
 func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	var chargeToRefund struct {
-		Id            int    `json:"id"`
-		PaymentIntent string `json:"pi"`
-		Amount        int    `json:"amount"`
-		Currency      string `json:"currency"`
+		Id     int    `json:"id"`
+		Amount int    `json:"amount"`
+		Reason string `json:"reason"`
 	}
 
 	err := app.readJSON(w, r, &chargeToRefund)
@@ -708,63 +1210,50 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: chargeToRefund.Currency,
-	}
-
-	err = card.Refund(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
+	order, err := app.DB.GetOrderById(chargeToRefund.Id)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	err = app.DB.UpdateOrderStatus(chargeToRefund.Id, 2)
+	refundable, err := app.DB.RefundableAmount(order.Id)
 	if err != nil {
-		app.badRequest(w, r, errors.New("the charge was refunded but the database could not be updated"))
+		app.badRequest(w, r, err)
 		return
 	}
 
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
+	amount := chargeToRefund.Amount
+	if amount == 0 {
+		amount = refundable
 	}
 
-	resp.Error = false
-	resp.Message = "Charge refunded"
-
-	app.writeJSON(w, http.StatusOK, resp)
-}
-
-func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Request) {
-	var subToCancel struct {
-		Id            int    `json:"id"`
-		PaymentIntent string `json:"pi"`
-		Currency      string `json:"currency"`
+	if amount < 0 || refundable == 0 || amount > refundable {
+		app.badRequest(w, r, models.ErrRefundTooLarge)
+		return
 	}
 
-	err := app.readJSON(w, r, &subToCancel)
+	refund, err := app.Gateway.Refund(order.Transaction.PaymentIntent, amount, idempotencyKeyFor(r, "refund"))
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: subToCancel.Currency,
+	var userId, apiKeyId int
+	if user := authenticatedUser(r); user != nil {
+		userId, apiKeyId = user.Id, user.APIKeyId
 	}
 
-	err = card.CancelSubscription(subToCancel.PaymentIntent)
+	err = app.DB.RecordRefund(models.Refund{
+		OrderId:        order.Id,
+		Amount:         int(refund.Amount),
+		Reason:         chargeToRefund.Reason,
+		StripeRefundId: refund.ID,
+		UserId:         userId,
+		APIKeyId:       apiKeyId,
+	})
 	if err != nil {
-		app.badRequest(w, r, err)
-		return
-	}
-
-	err = app.DB.UpdateOrderStatus(subToCancel.Id, 3)
-	if err != nil {
-		app.badRequest(w, r, errors.New("the subscription was cancelled but the database could not be updated"))
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the charge was refunded but the database could not be updated"))
 		return
 	}
 
@@ -774,7 +1263,10 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 	}
 
 	resp.Error = false
-	resp.Message = "Subscription Cancelled"
+	resp.Message = "Charge refunded"
+	if int(refund.Amount) < refundable {
+		resp.Message = "Charge partially refunded"
+	}
 
 	app.writeJSON(w, http.StatusOK, resp)
 }
@@ -815,8 +1307,23 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if userId > 0 {
+		user.Id = userId
+
+		// a user sent without a role keeps the one they have
+		if user.RoleId == 0 {
+			existing, err := app.DB.GetOneUser(userId)
+			if err != nil {
+				app.badRequest(w, r, err)
+				return
+			}
+			user.RoleId = existing.RoleId
+		}
+
 		err = app.DB.EditUser(user)
-		if err != nil {
+		if errors.Is(err, models.ErrLastUserManager) {
+			app.failedValidation(w, r, map[string]string{"role_id": err.Error()})
+			return
+		} else if err != nil {
 			app.badRequest(w, r, err)
 			return
 		}
@@ -859,6 +1366,17 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// AllRoles lists the roles admin users can be given, with their permissions
+func (app *application) AllRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, roles)
+}
+
 func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	userId, _ := strconv.Atoi(id)
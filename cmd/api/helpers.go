@@ -67,6 +67,29 @@ func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err e
 	return nil
 }
 
+// errorJSON writes err out as a JSON error with the given status
+func (app *application) errorJSON(w http.ResponseWriter, err error, status int) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = err.Error()
+
+	return app.writeJSON(w, status, payload)
+}
+
+// idempotencyKeyFor derives the key sent to Stripe for one step of a request; an
+// empty request key stays empty
+func idempotencyKeyFor(r *http.Request, step string) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return ""
+	}
+	return key + "-" + step
+}
+
 func (app *application) failedValidation(w http.ResponseWriter, r *http.Request, errors map[string]string) {
 	var payload struct {
 		Error   bool              `json:"error"`
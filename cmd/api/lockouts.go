@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+)
+
+// checkLockout writes a too many requests response, and returns false, when there have
+// been so many failed attempts against any of subjects that the next has to wait
+func (app *application) checkLockout(w http.ResponseWriter, r *http.Request, subjects ...models.LockoutSubject) bool {
+	until, err := app.DB.CheckLockout(subjects...)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return false
+	}
+	if until.IsZero() {
+		return true
+	}
+
+	wait := time.Until(until).Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)))
+	app.errorJSON(w, fmt.Errorf("too many attempts, try again in %s", wait), http.StatusTooManyRequests)
+	return false
+}
+
+// failedSignIn counts a failed sign in against subjects, and responds as for any other
+// invalid credentials
+func (app *application) failedSignIn(w http.ResponseWriter, subjects ...models.LockoutSubject) {
+	_, err := app.DB.RecordFailure(subjects...)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.invalidCredentials(w)
+}
+
+// AllLockouts lists the addresses and accounts with recent failed attempts
+func (app *application) AllLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := app.DB.GetLockouts()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, lockouts)
+}
+
+// ClearLockout forgets the failed attempts of an address or account, so that it can try
+// again straight away
+func (app *application) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	lockoutId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.DB.ClearLockout(lockoutId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Lockout cleared",
+		Id:      lockoutId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -1,14 +1,224 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+)
+
+const (
+	// idempotencyTTL is how long a stored response is replayed for
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyLease is how long a request has to finish before its key is given to a
+	// retry, in case the server stopped while handling it
+	idempotencyLease = 2 * time.Minute
+)
+
+type contextKey string
+
+// userContextKey holds the user a request was authenticated as
+const userContextKey = contextKey("user")
 
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.authenticateToken(r)
+		user, err := app.authenticateToken(r)
 		if err != nil {
 			app.invalidCredentials(w)
 			return
 		}
+
+		// users who have to set up two-factor authentication can do nothing else first
+		if user.TwoFactorPending() && !twoFactorSetupPath(r.URL.Path) {
+			app.errorJSON(w, errors.New("you must set up two-factor authentication first"), http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// twoFactorSetupPath reports whether path can be used by a user who still has to set up
+// two-factor authentication
+func twoFactorSetupPath(path string) bool {
+	return path == "/api/admin/two-factor" || strings.HasPrefix(path, "/api/admin/two-factor/") ||
+		path == "/api/logout" || path == "/api/logout-everywhere"
+}
+
+// RequirePermission lets through requests from users whose role gives them permission; it
+// goes after Auth
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := authenticatedUser(r)
+			if user == nil || !user.Can(permission) {
+				app.errorJSON(w, errors.New("you do not have permission to do that"), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSignedIn lets through requests from users who signed in, turning away those
+// made with an api key, which have no account of their own; it goes after Auth
+func (app *application) RequireSignedIn(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := authenticatedUser(r)
+		if user == nil || user.APIKeyId != 0 {
+			app.errorJSON(w, errors.New("api keys cannot do that"), http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// authenticatedUser returns the user set by Auth, or nil on routes without it
+func authenticatedUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value(userContextKey).(*models.User)
+	return user
+}
+
+// customerContextKey holds the customer a request was authenticated as
+const customerContextKey = contextKey("customer")
+
+// CustomerAuth lets through requests carrying a customer token, for the customer's own data
+func (app *application) CustomerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		customer, err := app.authenticateCustomerToken(r)
+		if err != nil {
+			app.invalidCredentials(w)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), customerContextKey, customer)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticatedCustomer returns the customer set by CustomerAuth
+func authenticatedCustomer(r *http.Request) *models.Customer {
+	customer, _ := r.Context().Value(customerContextKey).(*models.Customer)
+	return customer
+}
+
+// responseRecorder copies a response so that it can be stored
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyCaller names who made a request, so that an Idempotency-Key is only ever
+// replayed to whoever first used it
+func idempotencyCaller(r *http.Request) string {
+	if user := authenticatedUser(r); user != nil {
+		if user.APIKeyId != 0 {
+			return fmt.Sprintf("api_key:%d", user.APIKeyId)
+		}
+		return fmt.Sprintf("user:%d", user.Id)
+	}
+	if customer := authenticatedCustomer(r); customer != nil {
+		return fmt.Sprintf("customer:%d", customer.Id)
+	}
+	return "ip:" + models.RemoteIP(r.RemoteAddr).String()
+}
+
+// Idempotent replays the stored response for a repeated Idempotency-Key header. A key
+// reused by someone else, on another endpoint or with a different body is refused.
+func (app *application) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+
+		request := models.IdempotencyKey{
+			Key:         key,
+			Endpoint:    r.URL.Path,
+			Caller:      idempotencyCaller(r),
+			RequestHash: hex.EncodeToString(hash[:]),
+		}
+
+		reserved, err := app.Idempotency.ReserveIdempotencyKey(request, idempotencyTTL, idempotencyLease)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.errorJSON(w, errors.New("could not check idempotency key"), http.StatusInternalServerError)
+			return
+		}
+
+		if !reserved {
+			stored, err := app.Idempotency.GetIdempotencyKey(key)
+			if err != nil {
+				app.errorLog.Println(err)
+				app.errorJSON(w, errors.New("could not check idempotency key"), http.StatusInternalServerError)
+				return
+			}
+
+			if stored.Endpoint != request.Endpoint || stored.Caller != request.Caller {
+				app.errorJSON(w, errors.New("idempotency key was already used for another request"), http.StatusUnprocessableEntity)
+				return
+			}
+
+			if stored.RequestHash != request.RequestHash {
+				app.errorJSON(w, errors.New("idempotency key was already used with a different request body"), http.StatusUnprocessableEntity)
+				return
+			}
+
+			if stored.ResponseStatus == 0 {
+				app.errorJSON(w, errors.New("a request with this idempotency key is in progress"), http.StatusConflict)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.ResponseStatus)
+			w.Write(stored.ResponseBody)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// server errors are not stored so that the client can retry
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			err = app.Idempotency.DeleteIdempotencyKey(key)
+		} else {
+			err = app.Idempotency.SaveIdempotentResponse(key, rec.status, rec.body.Bytes())
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+}
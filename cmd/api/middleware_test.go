@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+)
+
+// memoryIdempotency keeps idempotency keys in memory, the way the idempotency_keys table
+// does
+type memoryIdempotency struct {
+	mu     sync.Mutex
+	keys   map[string]models.IdempotencyKey
+	leases map[string]time.Time
+}
+
+func (m *memoryIdempotency) ReserveIdempotencyKey(k models.IdempotencyKey, ttl, lease time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.keys[k.Key]; ok && stored.Expiry.After(time.Now()) &&
+		(stored.ResponseStatus != 0 || m.leases[k.Key].After(time.Now())) {
+		return false, nil
+	}
+	k.Expiry = time.Now().Add(ttl)
+	m.keys[k.Key] = k
+	m.leases[k.Key] = time.Now().Add(lease)
+
+	return true, nil
+}
+
+func (m *memoryIdempotency) GetIdempotencyKey(key string) (models.IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[key]
+	if !ok {
+		return k, sql.ErrNoRows
+	}
+	return k, nil
+}
+
+func (m *memoryIdempotency) SaveIdempotentResponse(key string, status int, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := m.keys[key]
+	k.ResponseStatus = status
+	k.ResponseBody = append([]byte(nil), body...)
+	m.keys[key] = k
+
+	return nil
+}
+
+func (m *memoryIdempotency) DeleteIdempotencyKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, key)
+
+	return nil
+}
+
+// idempotentHandler returns the Idempotent middleware around a handler that echoes the
+// request body, and a count of the requests that reached it
+func idempotentHandler(block <-chan struct{}) (http.Handler, *int32) {
+	app := &application{
+		errorLog:    log.New(io.Discard, "", 0),
+		Idempotency: &memoryIdempotency{keys: make(map[string]models.IdempotencyKey), leases: make(map[string]time.Time)},
+	}
+
+	var calls int32
+	handler := app.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if block != nil {
+			<-block
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+
+	return handler, &calls
+}
+
+func idempotentRequest(h http.Handler, key, body string, user *models.User) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/payment-intent", strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Idempotency-Key", key)
+	if user != nil {
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	h, calls := idempotentHandler(nil)
+
+	first := idempotentRequest(h, "key-1", `{"amount":"10.00"}`, nil)
+	if first.Code != http.StatusCreated || first.Body.String() != `{"amount":"10.00"}` {
+		t.Fatalf("first request: got %d %q", first.Code, first.Body.String())
+	}
+
+	second := idempotentRequest(h, "key-1", `{"amount":"10.00"}`, nil)
+	if second.Code != http.StatusCreated || second.Body.String() != `{"amount":"10.00"}` {
+		t.Errorf("replay: got %d %q, want the first response", second.Code, second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay is not marked Idempotent-Replayed")
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+
+	other := idempotentRequest(h, "key-2", `{"amount":"10.00"}`, nil)
+	if other.Code != http.StatusCreated || other.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another key: got %d replayed %q, want a new response", other.Code, other.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotentMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		user *models.User
+	}{
+		{"different body", `{"amount":"99.00"}`, &models.User{Id: 1}},
+		{"different user", `{"amount":"10.00"}`, &models.User{Id: 2}},
+		{"api key of the same user", `{"amount":"10.00"}`, &models.User{Id: 0, APIKeyId: 1}},
+		{"unauthenticated", `{"amount":"10.00"}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, calls := idempotentHandler(nil)
+
+			first := idempotentRequest(h, "key-1", `{"amount":"10.00"}`, &models.User{Id: 1})
+			if first.Code != http.StatusCreated {
+				t.Fatalf("first request: got %d", first.Code)
+			}
+
+			w := idempotentRequest(h, "key-1", tt.body, tt.user)
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got %d %q, want %d", w.Code, w.Body.String(), http.StatusUnprocessableEntity)
+			}
+			if strings.Contains(w.Body.String(), "10.00") {
+				t.Errorf("the first response was leaked: %q", w.Body.String())
+			}
+			if n := atomic.LoadInt32(calls); n != 1 {
+				t.Errorf("handler ran %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestIdempotentInFlight(t *testing.T) {
+	block := make(chan struct{})
+	h, calls := idempotentHandler(block)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- idempotentRequest(h, "key-1", `{"amount":"10.00"}`, nil)
+	}()
+
+	// wait for the first request to reach the handler
+	for atomic.LoadInt32(calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := idempotentRequest(h, "key-1", `{"amount":"10.00"}`, nil)
+			if w.Code != http.StatusConflict {
+				t.Errorf("request while the first is in progress: got %d, want %d", w.Code, http.StatusConflict)
+			}
+		}()
+	}
+	wg.Wait()
+
+	close(block)
+	if first := <-done; first.Code != http.StatusCreated {
+		t.Fatalf("first request: got %d", first.Code)
+	}
+
+	w := idempotentRequest(h, "key-1", `{"amount":"10.00"}`, nil)
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("request after the first finished: got %d replayed %q, want the replay", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+}
+
+func TestRequireSignedIn(t *testing.T) {
+	app := &application{errorLog: log.New(io.Discard, "", 0)}
+	h := app.RequireSignedIn(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name string
+		user *models.User
+		want int
+	}{
+		{"signed in", &models.User{Id: 1}, http.StatusNoContent},
+		{"api key", &models.User{APIKeyId: 1}, http.StatusForbidden},
+		{"no user", nil, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/two-factor/setup", nil)
+		if tt.user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, tt.user))
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestTwoFactorSetupPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/admin/two-factor", true},
+		{"/api/admin/two-factor/setup", true},
+		{"/api/admin/two-factor/enable", true},
+		{"/api/logout", true},
+		{"/api/logout-everywhere", true},
+		{"/api/admin/two-factor-other", false},
+		{"/api/admin/refund", false},
+		{"/api/admin/all-users/two-factor/reset/1", false},
+		{"/api/admin/api-keys/create", false},
+	}
+
+	for _, tt := range tests {
+		if got := twoFactorSetupPath(tt.path); got != tt.want {
+			t.Errorf("twoFactorSetupPath(%q) = %t, want %t", tt.path, got, tt.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
+	"github.com/sindrishtepani/go-stripe/internal/models"
 )
 
 func (app *application) routes() http.Handler {
@@ -13,37 +14,140 @@ func (app *application) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
-	mux.Post("/api/payment-intent", app.GetPaymentIntent)
+	mux.With(app.Idempotent).Post("/api/payment-intent", app.GetPaymentIntent)
 	mux.Get("/api/widget/{id}", app.GetWidgetById)
 
-	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+	mux.Post("/api/coupons/validate", app.ValidateCoupon)
+	mux.Post("/api/tax/quote", app.TaxQuote)
+
+	mux.Post("/api/cart/total", app.CartTotal)
+	mux.With(app.Idempotent).Post("/api/cart/payment-intent", app.CartPaymentIntent)
+
+	mux.With(app.Idempotent).Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+	mux.Post("/api/confirm-subscription", app.ConfirmSubscription)
+	mux.Post("/api/renewal-authentication", app.RenewalAuthentication)
+	mux.Post("/api/dunning/update-card", app.DunningUpdateCard)
+
+	mux.With(app.Idempotent).Post("/api/saved-cards/setup-intent", app.CreateSetupIntent)
+	mux.Post("/api/saved-cards", app.SaveCard)
 
 	mux.Post("/api/authenticate", app.CreateAuthToken)
 	mux.Post("/api/is-authenticated", app.CheckAuthentication)
+	mux.Post("/api/authenticate/two-factor", app.VerifyTwoFactorLogin)
+	mux.Post("/api/authenticate/refresh", app.RefreshAuthToken)
+	mux.Post("/api/logout", app.Logout)
+	mux.With(app.Auth).Post("/api/logout-everywhere", app.LogoutEverywhere)
 	mux.Post("/api/forgot-password", app.SendPasswordResetEmail)
 	mux.Post("/api/reset-password", app.ResetPassword)
 
+	mux.Post("/api/customer-login-link", app.SendCustomerLoginLink)
+	mux.Post("/api/customer-authenticate", app.CustomerAuthenticate)
+	mux.Post("/api/customer-confirm-email", app.CustomerConfirmEmail)
+
+	// without a signing secret anyone could forge events, so there is no endpoint for them
+	if app.config.stripe.webhook != "" {
+		mux.Post("/api/webhooks/stripe", app.StripeWebhook)
+	}
+
+	mux.Route("/api/account", func(mux chi.Router) {
+		mux.Use(app.CustomerAuth)
+
+		mux.Post("/orders", app.CustomerOrders)
+		mux.Post("/orders/{id}", app.CustomerOrder)
+		mux.Post("/invoices/{id}", app.CustomerInvoice)
+		mux.Post("/email", app.UpdateCustomerEmail)
+		mux.Post("/cancel-subscription", app.CustomerCancelSubscription)
+		mux.Post("/update-subscription-card", app.UpdateSubscriptionCard)
+	})
+
 	mux.Route("/api/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
 
-		mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/all-subscriptions", app.AllSubscriptions)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequireSignedIn)
+
+			mux.Post("/two-factor", app.TwoFactorStatus)
+			mux.Post("/two-factor/setup", app.SetUpTwoFactor)
+			mux.Post("/two-factor/enable", app.EnableTwoFactor)
+			mux.Post("/two-factor/recovery-codes", app.RegenerateRecoveryCodes)
+			mux.Post("/two-factor/disable", app.DisableTwoFactor)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionVirtualTerminal))
+
+			mux.Post("/virtual-terminal-payment-intent", app.VirtualTerminalPaymentIntent)
+			mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewSales))
+
+			mux.Post("/all-sales", app.AllSales)
+			mux.Post("/all-subscriptions", app.AllSubscriptions)
+
+			mux.Post("/get-sale/{id}", app.GetSale)
+
+			mux.Post("/widgets", app.AllWidgets)
+			mux.Post("/widgets/{id}", app.OneWidget)
+
+			mux.Post("/disputes", app.AllDisputes)
+			mux.Post("/disputes/{id}", app.OneDispute)
+		})
+
+		mux.With(app.RequirePermission(models.PermissionRefund), app.Idempotent).Post("/refund", app.RefundCharge)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageSubscriptions))
+
+			mux.Post("/cancel-subscription", app.CancelSubscription)
+			mux.Post("/change-subscription-plan", app.ChangeSubscriptionPlan)
+			mux.Post("/pause-subscription", app.PauseSubscription)
+			mux.Post("/resume-subscription", app.ResumeSubscription)
+			mux.Post("/reactivate-subscription", app.ReactivateSubscription)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageUsers))
+
+			mux.Post("/all-users", app.AllUsers)
+			mux.Post("/all-users/{id}", app.OneUser)
+			mux.Post("/all-users/edit/{id}", app.EditUser)
+			mux.Post("/all-users/delete/{id}", app.DeleteUser)
+			mux.Post("/roles", app.AllRoles)
+			mux.Post("/all-users/tokens/{id}", app.UserTokens)
+			mux.Post("/all-users/tokens/revoke/{id}", app.RevokeUserToken)
+			mux.Post("/all-users/two-factor/reset/{id}", app.ResetUserTwoFactor)
+			mux.Post("/roles/two-factor/{id}", app.SetRoleTwoFactor)
+			mux.Post("/lockouts", app.AllLockouts)
+			mux.Post("/lockouts/clear/{id}", app.ClearLockout)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageWidgets))
+
+			mux.Post("/widgets/edit/{id}", app.EditWidget)
+			mux.Post("/widgets/delete/{id}", app.DeleteWidget)
+			mux.Post("/widgets/image/{id}", app.UploadWidgetImage)
+			mux.Post("/widgets/prices/{id}", app.SetWidgetPrice)
+			mux.Post("/widgets/prices/delete/{id}", app.DeleteWidgetPrice)
+		})
 
-		mux.Post("/get-sale/{id}", app.GetSale)
+		mux.With(app.RequirePermission(models.PermissionManageDisputes)).Post("/disputes/evidence/{id}", app.SubmitDisputeEvidence)
 
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageAPIKeys))
 
-		mux.Post("/all-users", app.AllUsers)
-		mux.Post("/all-users/{id}", app.OneUser)
-		mux.Post("/all-users/edit/{id}", app.EditUser)
-		mux.Post("/all-users/delete/{id}", app.DeleteUser)
+			mux.Post("/api-keys", app.AllAPIKeys)
+			mux.Post("/api-keys/scopes", app.AllAPIKeyScopes)
+			mux.Post("/api-keys/create", app.CreateAPIKey)
+			mux.Post("/api-keys/revoke/{id}", app.RevokeAPIKey)
+		})
 	})
 
 	return mux
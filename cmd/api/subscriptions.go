@@ -0,0 +1,501 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/money"
+	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// subscriptionRequest is the body posted to the subscription endpoints
+type subscriptionRequest struct {
+	Id            int    `json:"id"`
+	WidgetId      int    `json:"widget_id"`
+	Immediately   bool   `json:"immediately"`
+	PaymentMethod string `json:"payment_method"`
+}
+
+// subscriptionStatus is the order status that matches the state of a subscription
+func subscriptionStatus(subscription *stripe.Subscription) int {
+	switch {
+	case subscription.Status == stripe.SubscriptionStatusCanceled:
+		return models.StatusCancelled
+	case subscription.Status == stripe.SubscriptionStatusPastDue,
+		subscription.Status == stripe.SubscriptionStatusUnpaid:
+		return models.StatusAtRisk
+	case subscription.PauseCollection.Behavior != "":
+		return models.StatusPaused
+	case subscription.CancelAtPeriodEnd:
+		return models.StatusCancelling
+	default:
+		return models.StatusCleared
+	}
+}
+
+// readSubscriptionRequest reads the request body and loads the subscription order it names;
+// it writes the error response itself and returns false when the request cannot go on
+func (app *application) readSubscriptionRequest(w http.ResponseWriter, r *http.Request) (subscriptionRequest, models.Order, bool) {
+	var req subscriptionRequest
+
+	err := app.readJSON(w, r, &req)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return req, models.Order{}, false
+	}
+
+	order, err := app.DB.GetOrderById(req.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return req, order, false
+	}
+
+	// customers can only change their own subscriptions
+	if customer := authenticatedCustomer(r); customer != nil && order.CustomerId != customer.Id {
+		app.badRequest(w, r, errors.New("order not found"))
+		return req, models.Order{}, false
+	}
+
+	// subscription orders store the subscription id in place of a payment intent
+	if !strings.HasPrefix(order.Transaction.PaymentIntent, "sub_") {
+		app.badRequest(w, r, errors.New("order is not a subscription"))
+		return req, order, false
+	}
+
+	if order.StatusId == models.StatusCancelled {
+		app.badRequest(w, r, errors.New("subscription is already cancelled"))
+		return req, order, false
+	}
+
+	return req, order, true
+}
+
+// subscriptionUpdated sets the status of the order to match the subscription and writes the response
+func (app *application) subscriptionUpdated(w http.ResponseWriter, r *http.Request, order models.Order, statusId int, msg string) {
+	err := app.DB.UpdateOrderStatus(order.Id, statusId)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the subscription was updated but the database could not be updated"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = msg
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CancelSubscription cancels a subscription at the end of its period, or straight away
+// when immediately is set
+func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Request) {
+	req, order, ok := app.readSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !req.Immediately {
+		err := app.Gateway.CancelSubscription(order.Transaction.PaymentIntent)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		app.subscriptionUpdated(w, r, order, models.StatusCancelling, "Subscription will cancel at the end of the period")
+		return
+	}
+
+	subscription, err := app.Gateway.CancelSubscriptionNow(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.subscriptionUpdated(w, r, order, subscriptionStatus(subscription), "Subscription Cancelled")
+}
+
+// ChangeSubscriptionPlan upgrades or downgrades a subscription to the plan of another widget
+func (app *application) ChangeSubscriptionPlan(w http.ResponseWriter, r *http.Request) {
+	req, order, ok := app.readSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	widget, err := app.DB.GetWidget(req.WidgetId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// Stripe bills a subscription in one currency, so the new plan must be in the same one
+	widget, err = app.DB.InCurrency(widget, order.Transaction.Currency)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if !widget.Active || !widget.IsRecurring || widget.PlanId == "" {
+		app.badRequest(w, r, models.ErrWidgetUnavailable)
+		return
+	}
+
+	if widget.Id == order.WidgetId {
+		app.badRequest(w, r, errors.New("subscription is already on this plan"))
+		return
+	}
+
+	subscription, err := app.Gateway.ChangeSubscriptionPlan(order.Transaction.PaymentIntent, widget.PlanId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.ChangeSubscriptionWidget(order.Id, widget)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the plan was changed but the database could not be updated"))
+		return
+	}
+
+	app.subscriptionUpdated(w, r, order, subscriptionStatus(subscription), "Plan changed to "+widget.Name)
+}
+
+// PauseSubscription stops billing a subscription until it is resumed
+func (app *application) PauseSubscription(w http.ResponseWriter, r *http.Request) {
+	_, order, ok := app.readSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	subscription, err := app.Gateway.PauseSubscription(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.subscriptionUpdated(w, r, order, subscriptionStatus(subscription), "Subscription Paused")
+}
+
+// ResumeSubscription starts billing a paused subscription again
+func (app *application) ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	_, order, ok := app.readSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	subscription, err := app.Gateway.ResumeSubscription(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.subscriptionUpdated(w, r, order, subscriptionStatus(subscription), "Subscription Resumed")
+}
+
+// ReactivateSubscription keeps a subscription that was set to cancel at the end of its period
+func (app *application) ReactivateSubscription(w http.ResponseWriter, r *http.Request) {
+	_, order, ok := app.readSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	subscription, err := app.Gateway.ReactivateSubscription(order.Transaction.PaymentIntent)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.subscriptionUpdated(w, r, order, subscriptionStatus(subscription), "Subscription Reactivated")
+}
+
+// syncSubscriptionPlan moves the order for a subscription to the widget for its current plan,
+// so that plan changes made in the Stripe dashboard show up here
+func (app *application) syncSubscriptionPlan(subscription *stripe.Subscription) error {
+	if subscription.Items == nil || len(subscription.Items.Data) == 0 || subscription.Items.Data[0].Plan == nil {
+		return nil
+	}
+
+	widget, err := app.DB.GetWidgetByPlan(subscription.Items.Data[0].Plan.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.infoLog.Printf("subscription %s is on plan %s, which no widget is sold as",
+			subscription.ID, subscription.Items.Data[0].Plan.ID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	orderId, err := app.DB.GetOrderIdByPaymentIntent(subscription.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return app.DB.ChangeSubscriptionWidget(orderId, widget)
+}
+
+// renewalAuthenticationLinkTTL is how many minutes a link to authenticate a renewal
+// payment can be used for
+const renewalAuthenticationLinkTTL = 7 * 24 * 60
+
+// errFirstPaymentDeclined is returned for a new subscription whose first payment, or the
+// card saved for after its free trial, was declined
+var errFirstPaymentDeclined = errors.New("your card was declined")
+
+// subscriptionAuthentication is sent to the browser when the first payment of a new
+// subscription, or the card saved for after its free trial, needs 3-D Secure
+type subscriptionAuthentication struct {
+	OK             bool   `json:"ok"`
+	Message        string `json:"message"`
+	RequiresAction bool   `json:"requires_action"`
+	ClientSecret   string `json:"client_secret"`
+	SetupIntent    bool   `json:"setup_intent"`
+	SubscriptionId string `json:"subscription_id"`
+}
+
+// pendingAuthentication returns what the customer has to authenticate before a new
+// subscription is paid for, or nil when nothing is waiting on them
+func pendingAuthentication(subscription *stripe.Subscription) (*subscriptionAuthentication, error) {
+	authentication := &subscriptionAuthentication{
+		Message:        "Please authenticate your card",
+		RequiresAction: true,
+		SubscriptionId: subscription.ID,
+	}
+
+	if subscription.LatestInvoice != nil && subscription.LatestInvoice.PaymentIntent != nil {
+		pi := subscription.LatestInvoice.PaymentIntent
+		switch pi.Status {
+		case stripe.PaymentIntentStatusRequiresAction:
+			authentication.ClientSecret = pi.ClientSecret
+			return authentication, nil
+		case stripe.PaymentIntentStatusRequiresPaymentMethod:
+			return nil, errFirstPaymentDeclined
+		}
+	}
+
+	if si := subscription.PendingSetupIntent; si != nil {
+		switch si.Status {
+		case stripe.SetupIntentStatusRequiresAction:
+			authentication.ClientSecret = si.ClientSecret
+			authentication.SetupIntent = true
+			return authentication, nil
+		case stripe.SetupIntentStatusRequiresPaymentMethod:
+			return nil, errFirstPaymentDeclined
+		}
+	}
+
+	return nil, nil
+}
+
+// saveSubscriptionOrder saves the customer, transaction and order of a new subscription
+// and has its invoice mailed
+func (app *application) saveSubscriptionOrder(pending models.PendingSubscription) (int, error) {
+	order := pending.Order
+	order.CreatedAt = time.Now()
+	order.UpdatedAt = time.Now()
+
+	// customer, transaction and order are saved together or not at all
+	orderId, err := app.DB.CreateOrderWithTransaction(pending.Customer, pending.Transaction, order)
+	if err != nil {
+		return 0, err
+	}
+
+	// call microservice
+	invoice := Invoice{
+		Id:        orderId,
+		Amount:    order.Amount,
+		Currency:  pending.Transaction.Currency,
+		Product:   "Widget",
+		Quantity:  order.Quantity,
+		FirstName: pending.Customer.FirstName,
+		LastName:  pending.Customer.LastName,
+		Email:     pending.Customer.Email,
+		CreatedAt: time.Now(),
+		Taxes:     invoiceTaxes(order.Taxes),
+	}
+
+	err = app.callInvoiceMircoservice(invoice)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	return orderId, nil
+}
+
+// cancelIncompleteSubscription cancels a subscription whose first payment never went through
+func (app *application) cancelIncompleteSubscription(subId string) {
+	_, err := app.Gateway.CancelSubscriptionNow(subId)
+	if err != nil {
+		app.errorLog.Printf("could not cancel incomplete subscription %s: %s", subId, err)
+	}
+}
+
+// completeSubscription saves the order kept for a subscription once its customer has
+// authenticated the first payment. It returns false while the subscription is still
+// waiting on the customer, and errFirstPaymentDeclined when authentication failed.
+// Subscriptions that were not waiting, or have already been saved, are complete.
+func (app *application) completeSubscription(subId string) (bool, error) {
+	pending, err := app.DB.GetPendingSubscription(subId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	subscription, err := app.Gateway.RetrieveSubscription(subId)
+	if err != nil {
+		return false, err
+	}
+
+	authentication, err := pendingAuthentication(subscription)
+	if err != nil {
+		return false, err
+	}
+	if authentication != nil || (subscription.Status != stripe.SubscriptionStatusActive &&
+		subscription.Status != stripe.SubscriptionStatusTrialing) {
+		return false, nil
+	}
+
+	// the browser and the webhook can both get here; only one saves the order
+	claimed, err := app.DB.DeletePendingSubscription(subId)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		return true, nil
+	}
+
+	_, err = app.saveSubscriptionOrder(pending)
+	if err != nil {
+		app.cancelUnsavedSubscription(subscription)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ConfirmSubscription saves a new subscription once the customer has authenticated its
+// first payment in the browser
+func (app *application) ConfirmSubscription(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		SubscriptionId string `json:"subscription_id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	done, err := app.completeSubscription(payload.SubscriptionId)
+	if errors.Is(err, errFirstPaymentDeclined) {
+		app.cancelIncompleteSubscription(payload.SubscriptionId)
+		if _, err := app.DB.DeletePendingSubscription(payload.SubscriptionId); err != nil {
+			app.errorLog.Println(err)
+		}
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: "your card could not be authenticated"})
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "your subscription could not be saved"})
+		return
+	}
+
+	if !done {
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: "your card has not been authenticated yet"})
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "Transaction Successful"})
+}
+
+// sendRenewalAuthentication emails the customer a link to authenticate a renewal payment
+// that their bank has asked to confirm
+func (app *application) sendRenewalAuthentication(inv stripe.Invoice) error {
+	link := fmt.Sprintf("%s/subscriptions/authenticate?invoice=%s", app.config.frontend, url.QueryEscape(inv.ID))
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	var data struct {
+		Link   string
+		Amount string
+	}
+	data.Link = sign.GenerateTokenFromString(link)
+	data.Amount = money.Format(int(inv.AmountDue), string(inv.Currency))
+
+	return app.SendMail("info@widgets.com", inv.CustomerEmail, "Please confirm your subscription payment", "renewal-authentication", data)
+}
+
+// RenewalAuthentication returns the client secret the browser needs to authenticate a
+// renewal payment, from the link emailed to the customer
+func (app *application) RenewalAuthentication(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Link string `json:"link"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	data, ok := sign.Data(payload.Link)
+	if !ok || sign.Expired(payload.Link, renewalAuthenticationLinkTTL) ||
+		!strings.HasPrefix(data, app.config.frontend+"/subscriptions/authenticate?") {
+		app.badRequest(w, r, errors.New("this link is not valid"))
+		return
+	}
+
+	u, err := url.Parse(data)
+	if err != nil {
+		app.badRequest(w, r, errors.New("this link is not valid"))
+		return
+	}
+
+	inv, err := app.Gateway.RetrieveInvoice(u.Query().Get("invoice"))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("this payment could not be found"))
+		return
+	}
+
+	var resp struct {
+		Error        bool   `json:"error"`
+		Message      string `json:"message"`
+		Paid         bool   `json:"paid"`
+		ClientSecret string `json:"client_secret,omitempty"`
+		Amount       string `json:"amount"`
+	}
+	resp.Amount = money.Format(int(inv.AmountDue), string(inv.Currency))
+
+	switch {
+	case inv.Paid:
+		resp.Paid = true
+		resp.Message = "This payment has already been made"
+	case inv.PaymentIntent != nil && inv.PaymentIntent.Status == stripe.PaymentIntentStatusRequiresAction:
+		resp.ClientSecret = inv.PaymentIntent.ClientSecret
+		resp.Message = "Please authenticate this payment with your bank"
+	default:
+		resp.Error = true
+		resp.Message = "This payment can no longer be authenticated, please update your card from your account"
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/money"
+	"github.com/sindrishtepani/go-stripe/internal/tax"
+)
+
+// applyTax works out the tax on amount for the posted address and email
+func (app *application) applyTax(payload stripePayload, amount int) (tax.Result, error) {
+	return app.Tax.Calculate(tax.Request{
+		Customer: payload.Email,
+		Country:  payload.Country,
+		Region:   payload.Region,
+		Amount:   amount,
+	})
+}
+
+// stripeTaxRates returns the Stripe tax rates for the lines of a tax calculation,
+// creating any the first time they are charged on a subscription
+func (app *application) stripeTaxRates(result tax.Result) ([]string, error) {
+	var ids []string
+
+	for _, line := range result.Lines {
+		stripeId := line.StripeId
+		if stripeId == "" && line.RuleId > 0 {
+			// the rate may have been created since the calculator was loaded
+			id, err := app.DB.GetTaxRateStripeId(line.RuleId)
+			if err != nil {
+				return nil, err
+			}
+			stripeId = id
+		}
+
+		if stripeId == "" {
+			rate, err := app.Gateway.CreateTaxRate(line.Name, line.Country, line.Region, line.Rate, line.Inclusive)
+			if err != nil {
+				return nil, err
+			}
+			stripeId = rate.ID
+
+			err = app.DB.LinkTaxRateToStripe(line.RuleId, stripeId)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ids = append(ids, stripeId)
+	}
+
+	return ids, nil
+}
+
+// TaxQuote prices a product or a cart for an address, with any coupon, so that the
+// customer sees the tax before paying
+func (app *application) TaxQuote(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var amount, discount int
+	currency := money.Normalize(payload.Currency)
+
+	if len(payload.Items) > 0 {
+		_, amount, err = app.DB.PriceCart(payload.Items, currency)
+	} else {
+		payload.Amount = ""
+		var widget models.Widget
+		widget, amount, err = app.resolveAmount(payload)
+		if err == nil {
+			currency = widget.Currency
+			_, discount, err = app.applyCoupon(payload, widget, amount)
+		}
+	}
+	if err != nil {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: err.Error()})
+		return
+	}
+
+	result, err := app.applyTax(payload, amount-discount)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	type quoteLine struct {
+		Name      string  `json:"name"`
+		Rate      float64 `json:"rate"`
+		Inclusive bool    `json:"inclusive"`
+		Amount    int     `json:"amount"`
+		Formatted string  `json:"formatted"`
+	}
+
+	var resp struct {
+		OK                bool        `json:"ok"`
+		Amount            int         `json:"amount"`
+		Discount          int         `json:"discount"`
+		Subtotal          int         `json:"subtotal"`
+		Tax               int         `json:"tax"`
+		Total             int         `json:"total"`
+		Exempt            bool        `json:"exempt"`
+		Lines             []quoteLine `json:"lines"`
+		Currency          string      `json:"currency"`
+		FormattedSubtotal string      `json:"formatted_subtotal"`
+		FormattedTotal    string      `json:"formatted_total"`
+	}
+
+	resp.OK = true
+	resp.Amount = amount
+	resp.Discount = discount
+	resp.Subtotal = result.Subtotal
+	resp.Tax = result.Tax
+	resp.Total = result.Total
+	resp.Exempt = result.Exempt
+	resp.Currency = currency
+	resp.FormattedSubtotal = money.Format(result.Subtotal, currency)
+	resp.FormattedTotal = money.Format(result.Total, currency)
+	for _, line := range result.Lines {
+		resp.Lines = append(resp.Lines, quoteLine{
+			Name:      line.Name,
+			Rate:      line.Rate,
+			Inclusive: line.Inclusive,
+			Amount:    line.Amount,
+			Formatted: money.Format(line.Amount, currency),
+		})
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+)
+
+// newAuthToken generates an authentication token for an admin user, with the refresh
+// token that renews it
+func (app *application) newAuthToken(r *http.Request, userId int) (*models.Token, error) {
+	token, err := models.GenerateToken(userId, app.config.tokens.ttl, models.ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Refresh, err = models.GenerateToken(userId, app.config.tokens.refreshTTL, models.ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = r.UserAgent()
+
+	return token, nil
+}
+
+// RefreshAuthToken trades a refresh token for a new authentication token and refresh
+// token; the refresh token cannot be used again
+func (app *application) RefreshAuthToken(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByRefreshToken(payload.RefreshToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.invalidCredentials(w)
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	token, err := app.newAuthToken(r, user.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// a refresh token used twice at once only renews the session once
+	rotated, err := app.DB.RotateToken(payload.RefreshToken, token)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if !rotated {
+		app.invalidCredentials(w)
+		return
+	}
+
+	var resp struct {
+		Error   bool          `json:"error"`
+		Message string        `json:"message"`
+		Token   *models.Token `json:"authentication_token"`
+	}
+	resp.Error = false
+	resp.Message = "token refreshed"
+	resp.Token = token
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// Logout signs out the session of the token the request was made with
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	token, err := bearerToken(r)
+	if err != nil {
+		app.invalidCredentials(w)
+		return
+	}
+
+	err = app.DB.DeleteToken(token)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "signed out"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// LogoutEverywhere signs the user the request was made by out of every session
+func (app *application) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	user := authenticatedUser(r)
+	if user.APIKeyId != 0 {
+		app.badRequest(w, r, errors.New("api keys are not signed in"))
+		return
+	}
+
+	err := app.DB.DeleteTokensForUser(user.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "signed out everywhere"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// UserTokens lists the sessions an admin user is signed in with
+func (app *application) UserTokens(w http.ResponseWriter, r *http.Request) {
+	userId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	tokens, err := app.DB.GetActiveTokens(userId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, tokens)
+}
+
+// RevokeUserToken signs an admin user out of one session, or of every session when no
+// token id is sent
+func (app *application) RevokeUserToken(w http.ResponseWriter, r *http.Request) {
+	userId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	var payload struct {
+		TokenId int `json:"token_id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if payload.TokenId > 0 {
+		err = app.DB.RevokeToken(userId, payload.TokenId)
+	} else {
+		err = app.DB.DeleteTokensForUser(userId)
+	}
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Signed out",
+		Id:      userId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// sweepTokens deletes expired tokens, failed sign ins old enough to be forgotten and
+// expired idempotency keys every interval, for as long as the server runs
+func (app *application) sweepTokens() {
+	ticker := time.NewTicker(app.config.tokens.sweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := app.DB.DeleteExpiredTokens()
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		if deleted > 0 {
+			app.infoLog.Printf("deleted %d expired tokens", deleted)
+		}
+
+		deleted, err = app.DB.DeleteStaleLockouts()
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		if deleted > 0 {
+			app.infoLog.Printf("deleted %d stale lockouts", deleted)
+		}
+
+		deleted, err = app.DB.DeleteExpiredIdempotencyKeys()
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		if deleted > 0 {
+			app.infoLog.Printf("deleted %d expired idempotency keys", deleted)
+		}
+	}
+}
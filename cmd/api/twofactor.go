@@ -0,0 +1,473 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/encryption"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/totp"
+	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
+)
+
+// twoFactorStore is the part of the database the codes users sign in with are checked against
+type twoFactorStore interface {
+	GetTwoFactor(userId int) (models.TwoFactor, error)
+	UseTwoFactorStep(userId int, step int64) (bool, error)
+	UseRecoveryCode(userId int, code string) (bool, error)
+}
+
+// twoFactorChallengeTTL is how many minutes a user has to enter their code after their
+// password has been checked
+const twoFactorChallengeTTL = 5
+
+// twoFactorIssuer names us in authenticator apps
+const twoFactorIssuer = "Widgets"
+
+// twoFactorChallenge returns the challenge a user who has passed the password check
+// answers with their code
+func (app *application) twoFactorChallenge(userId int) string {
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	return sign.GenerateTokenFromString(fmt.Sprintf("two-factor?user=%d", userId))
+}
+
+// readTwoFactorChallenge returns the user a challenge was issued to, and false if it is
+// not valid or has expired
+func (app *application) readTwoFactorChallenge(challenge string) (int, bool) {
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	// other signed links, such as password resets, are not challenges
+	data, ok := sign.Data(challenge)
+	if !ok || sign.Expired(challenge, twoFactorChallengeTTL) || !strings.HasPrefix(data, "two-factor?") {
+		return 0, false
+	}
+
+	query, err := url.ParseQuery(strings.TrimPrefix(data, "two-factor?"))
+	if err != nil {
+		return 0, false
+	}
+
+	userId, err := strconv.Atoi(query.Get("user"))
+	if err != nil {
+		return 0, false
+	}
+
+	return userId, true
+}
+
+// verifyTwoFactor checks a code from a user's authenticator app, or one of their recovery
+// codes. Each code can only be used once.
+func (app *application) verifyTwoFactor(userId int, code string) (bool, error) {
+	twoFactor, err := app.TwoFactors.GetTwoFactor(userId)
+	if err != nil {
+		return false, err
+	}
+	if !twoFactor.Enabled() {
+		return false, nil
+	}
+
+	code = strings.TrimSpace(code)
+	if len(strings.ReplaceAll(code, " ", "")) != totp.Digits {
+		return app.TwoFactors.UseRecoveryCode(userId, code)
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+
+	secret, err := encryptor.Decrypt(twoFactor.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), twoFactor.LastStep)
+	if !ok {
+		return false, nil
+	}
+
+	// two requests racing with the same code only get one sign in between them
+	return app.TwoFactors.UseTwoFactorStep(userId, step)
+}
+
+// VerifyTwoFactorLogin is the second step of signing in for users with two-factor
+// authentication: it trades the challenge from CreateAuthToken and a code for a token
+func (app *application) VerifyTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	userId, ok := app.readTwoFactorChallenge(payload.Challenge)
+	if !ok {
+		app.invalidCredentials(w)
+		return
+	}
+
+	user, err := app.DB.GetOneUser(userId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// wrong codes count against the account as wrong passwords do, so that codes cannot
+	// be guessed
+	attempt := []models.LockoutSubject{models.IPSubject(models.RemoteIP(r.RemoteAddr)), models.AccountSubject(user.Email)}
+	if !app.checkLockout(w, r, attempt...) {
+		return
+	}
+
+	valid, err := app.verifyTwoFactor(userId, payload.Code)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if !valid {
+		app.failedSignIn(w, attempt...)
+		return
+	}
+
+	token, err := app.newAuthToken(r, user.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.InsertToken(token, user)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.ClearFailures(attempt...)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	var resp struct {
+		Error   bool          `json:"error"`
+		Message string        `json:"message"`
+		Token   *models.Token `json:"authentication_token"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("token for %s created", user.Email)
+	resp.Token = token
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// signedInUser returns the user a request was made by; it writes the error response
+// itself and returns false for requests made with an api key, which have no account to
+// set up two-factor authentication for
+func (app *application) signedInUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	if authenticatedUser(r).APIKeyId != 0 {
+		app.badRequest(w, r, errors.New("api keys are not signed in"))
+		return models.User{}, false
+	}
+
+	user, err := app.DB.GetOneUser(authenticatedUser(r).Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return user, false
+	}
+
+	return user, true
+}
+
+// TwoFactorStatus reports whether the signed in user has two-factor authentication, has
+// to have it, and how many recovery codes they have left
+func (app *application) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.signedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	remaining, err := app.DB.CountRecoveryCodes(user.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Enabled       bool `json:"enabled"`
+		Required      bool `json:"required"`
+		RecoveryCodes int  `json:"recovery_codes"`
+	}
+	resp.Enabled = user.TwoFactorEnabled
+	resp.Required = user.RequireTwoFactor || user.RoleRequiresTwoFactor
+	resp.RecoveryCodes = remaining
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// SetUpTwoFactor starts setting up two-factor authentication for the signed in user,
+// returning the secret to add to an authenticator app
+func (app *application) SetUpTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.signedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		app.badRequest(w, r, errors.New("two-factor authentication is already on"))
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+
+	encrypted, err := encryptor.Encrypt(secret)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.SetTwoFactorSecret(user.Id, encrypted)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Secret string `json:"secret"`
+		URL    string `json:"url"`
+	}
+	resp.Secret = secret
+	resp.URL = totp.URL(twoFactorIssuer, user.Email, secret)
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// EnableTwoFactor turns on two-factor authentication once the signed in user has entered
+// a code from the authenticator app they set up, and returns their recovery codes
+func (app *application) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.signedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	twoFactor, err := app.DB.GetTwoFactor(user.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if twoFactor.Enabled() || twoFactor.Secret == "" {
+		app.badRequest(w, r, errors.New("two-factor authentication is not being set up"))
+		return
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+
+	secret, err := encryptor.Decrypt(twoFactor.Secret)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	step, ok := totp.Validate(secret, payload.Code, time.Now(), 0)
+	if !ok {
+		app.failedValidation(w, r, map[string]string{"code": "does not match your authenticator app"})
+		return
+	}
+
+	codes, hashes, err := models.GenerateRecoveryCodes()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.EnableTwoFactor(user.Id, step, hashes)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeRecoveryCodes(w, "two-factor authentication turned on", codes)
+}
+
+// RegenerateRecoveryCodes gives the signed in user a new set of recovery codes once they
+// have entered a code; their old ones stop working
+func (app *application) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.confirmTwoFactor(w, r)
+	if !ok {
+		return
+	}
+
+	codes, hashes, err := models.GenerateRecoveryCodes()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.ReplaceRecoveryCodes(user.Id, hashes)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeRecoveryCodes(w, "recovery codes replaced", codes)
+}
+
+// DisableTwoFactor turns off two-factor authentication for the signed in user once they
+// have entered a code, unless they are required to have it
+func (app *application) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.confirmTwoFactor(w, r)
+	if !ok {
+		return
+	}
+
+	if user.RequireTwoFactor || user.RoleRequiresTwoFactor {
+		app.badRequest(w, r, errors.New("two-factor authentication is required for your account"))
+		return
+	}
+
+	err := app.DB.DisableTwoFactor(user.Id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Two-factor authentication turned off",
+		Id:      user.Id,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// confirmTwoFactor reads a code from the request body and checks it against the signed in
+// user's two-factor authentication, so that a session left open cannot change it; it
+// writes the error response itself and returns false when the code is wrong
+func (app *application) confirmTwoFactor(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	user, ok := app.signedInUser(w, r)
+	if !ok {
+		return user, false
+	}
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return user, false
+	}
+
+	valid, err := app.verifyTwoFactor(user.Id, payload.Code)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return user, false
+	}
+	if !valid {
+		app.failedValidation(w, r, map[string]string{"code": "is not a valid code"})
+		return user, false
+	}
+
+	return user, true
+}
+
+func (app *application) writeRecoveryCodes(w http.ResponseWriter, message string, codes []string) {
+	var resp struct {
+		Error         bool     `json:"error"`
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	resp.Error = false
+	resp.Message = message
+	resp.RecoveryCodes = codes
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// ResetUserTwoFactor turns off two-factor authentication for a user who has lost their
+// authenticator app and recovery codes, and signs them out; if they have to have it,
+// they set it up again when they next sign in
+func (app *application) ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.DB.DisableTwoFactor(userId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.DeleteTokensForUser(userId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Two-factor authentication reset",
+		Id:      userId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// SetRoleTwoFactor sets whether everyone with a role has to use two-factor authentication
+func (app *application) SetRoleTwoFactor(w http.ResponseWriter, r *http.Request) {
+	roleId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	var payload struct {
+		RequireTwoFactor bool `json:"require_two_factor"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.SetRoleTwoFactor(roleId, payload.RequireTwoFactor)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Two-factor policy saved",
+		Id:      roleId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
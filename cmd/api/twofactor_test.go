@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/encryption"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/totp"
+)
+
+// memoryTwoFactors keeps a user's two-factor authentication in memory, the way the users
+// table does
+type memoryTwoFactors struct {
+	mu        sync.Mutex
+	twoFactor models.TwoFactor
+}
+
+func (m *memoryTwoFactors) GetTwoFactor(userId int) (models.TwoFactor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.twoFactor, nil
+}
+
+func (m *memoryTwoFactors) UseTwoFactorStep(userId int, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.twoFactor.LastStep >= step {
+		return false, nil
+	}
+	m.twoFactor.LastStep = step
+	return true, nil
+}
+
+func (m *memoryTwoFactors) UseRecoveryCode(userId int, code string) (bool, error) {
+	return false, nil
+}
+
+// twoFactorApp returns an app whose user 1 has two-factor authentication turned on with
+// the returned secret
+func twoFactorApp(t *testing.T) (*application, string) {
+	t.Helper()
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{}
+	app.config.secretkey = "abcdefghijklmnopqrstuvwxyz012345"
+
+	encryptor := encryption.Encryption{Key: []byte(app.config.secretkey)}
+	encrypted, err := encryptor.Encrypt(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.TwoFactors = &memoryTwoFactors{twoFactor: models.TwoFactor{UserId: 1, Secret: encrypted, EnabledAt: time.Now()}}
+
+	return app, secret
+}
+
+func TestVerifyTwoFactorReplay(t *testing.T) {
+	app, secret := twoFactorApp(t)
+
+	code := func(step int64) string {
+		c, err := totp.Code(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	now := totp.Step(time.Now())
+	previous, current := code(now-1), code(now)
+
+	// a code from the step before is still accepted, once
+	if ok, err := app.verifyTwoFactor(1, previous); !ok || err != nil {
+		t.Fatalf("code from the previous step: got %t, %v, want accepted", ok, err)
+	}
+	if ok, _ := app.verifyTwoFactor(1, previous); ok {
+		t.Error("the same code was accepted twice")
+	}
+
+	if ok, err := app.verifyTwoFactor(1, current); !ok || err != nil {
+		t.Fatalf("code from the current step: got %t, %v, want accepted", ok, err)
+	}
+	if ok, _ := app.verifyTwoFactor(1, current); ok {
+		t.Error("the current code was accepted twice")
+	}
+
+	// once a code has been used, older ones are refused too
+	if ok, _ := app.verifyTwoFactor(1, previous); ok {
+		t.Error("a code older than the last one used was accepted")
+	}
+}
+
+func TestVerifyTwoFactorRace(t *testing.T) {
+	app, secret := twoFactorApp(t)
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// requests racing with the same code get one sign in between them
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := app.verifyTwoFactor(1, code); ok {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Errorf("the same code was accepted %d times, want once", accepted)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	stripe "github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// webhookStore is the part of the database Stripe events are recorded in
+type webhookStore interface {
+	RecordStripeEvent(eventId, eventType string) (bool, error)
+	ForgetStripeEvent(eventId string) error
+	UpdateTransactionStatusByPaymentIntent(pi string, statusId int) error
+	RecordRenewal(subId string, txn models.Transaction) (bool, error)
+	StartDunning(subId, invoiceId string, nextAttempt time.Time) (bool, error)
+	EndDunning(subId string) error
+	DeletePendingSubscription(subId string) (bool, error)
+	UpdateSubscriptionStatus(subId string, statusId int) error
+	GetOrderIdByPaymentIntent(pi string) (int, error)
+	GetOrderById(id int) (models.Order, error)
+	RecordRefund(refund models.Refund) error
+	RefundOrder(id int) error
+	SaveDispute(d models.Dispute) (models.Dispute, error)
+	RestoreDisputedOrder(d models.Dispute) error
+}
+
+// StripeWebhook receives events from Stripe, verifies their signature and
+// dispatches each event once
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(65536))
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Error = true
+		resp.Message = "could not read request body"
+		app.writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(body, r.Header.Get("Stripe-Signature"), app.config.stripe.webhook)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Error = true
+		resp.Message = "invalid signature"
+		app.writeJSON(w, http.StatusBadRequest, resp)
+		return
+	}
+
+	isNew, err := app.Webhooks.RecordStripeEvent(event.ID, event.Type)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Error = true
+		resp.Message = "could not record event"
+		app.writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	if !isNew {
+		resp.Message = fmt.Sprintf("event %s already processed", event.ID)
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	err = app.dispatchStripeEvent(event)
+	if err != nil {
+		app.errorLog.Printf("webhook %s (%s): %s", event.ID, event.Type, err)
+		// forget the event so that Stripe's retry gets processed
+		if err := app.Webhooks.ForgetStripeEvent(event.ID); err != nil {
+			app.errorLog.Println(err)
+		}
+		resp.Error = true
+		resp.Message = "could not process event"
+		app.writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Message = fmt.Sprintf("event %s processed", event.ID)
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) dispatchStripeEvent(event stripe.Event) error {
+	switch event.Type {
+	case "payment_intent.succeeded":
+		return app.handlePaymentIntentEvent(event, models.TransactionCleared)
+	case "payment_intent.payment_failed", "payment_intent.canceled":
+		return app.handlePaymentIntentEvent(event, models.TransactionDeclined)
+	case "invoice.paid":
+		return app.handleInvoiceEvent(event, models.TransactionCleared)
+	case "invoice.payment_failed":
+		return app.handleInvoiceEvent(event, models.TransactionDeclined)
+	case "invoice.payment_action_required":
+		return app.handleInvoiceActionRequired(event)
+	case "customer.subscription.updated", "customer.subscription.deleted":
+		return app.handleSubscriptionEvent(event)
+	case "charge.refunded":
+		return app.handleChargeRefunded(event)
+	case "charge.dispute.created", "charge.dispute.updated", "charge.dispute.closed",
+		"charge.dispute.funds_withdrawn", "charge.dispute.funds_reinstated":
+		return app.handleDisputeEvent(event)
+	default:
+		app.infoLog.Printf("ignoring webhook event %s of type %s", event.ID, event.Type)
+	}
+
+	return nil
+}
+
+func decodeEventObject(event stripe.Event, v interface{}) error {
+	if event.Data == nil {
+		return fmt.Errorf("event %s has no data", event.ID)
+	}
+	return json.Unmarshal(event.Data.Raw, v)
+}
+
+func (app *application) handlePaymentIntentEvent(event stripe.Event, statusId int) error {
+	var pi stripe.PaymentIntent
+	err := decodeEventObject(event, &pi)
+	if err != nil {
+		return err
+	}
+
+	return app.Webhooks.UpdateTransactionStatusByPaymentIntent(pi.ID, statusId)
+}
+
+// handleInvoiceEvent records renewal payments; the first invoice of a subscription
+// is recorded when the subscription is created, or once its customer has authenticated it
+func (app *application) handleInvoiceEvent(event stripe.Event, statusId int) error {
+	var inv stripe.Invoice
+	err := decodeEventObject(event, &inv)
+	if err != nil {
+		return err
+	}
+
+	// the browser may have been closed before the first payment was confirmed
+	if inv.Subscription != nil && inv.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate &&
+		statusId == models.TransactionCleared {
+		_, err = app.completeSubscription(inv.Subscription.ID)
+		return err
+	}
+
+	if inv.Subscription == nil || inv.BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle {
+		return nil
+	}
+
+	txn := models.Transaction{
+		Amount:              int(inv.AmountDue),
+		Currency:            string(inv.Currency),
+		TransactionStatusId: statusId,
+	}
+	if statusId == models.TransactionCleared {
+		txn.Amount = int(inv.AmountPaid)
+	}
+	// the renewal is recorded once per payment; an invoice with nothing to pay has no
+	// payment intent and is recorded under its own id
+	txn.PaymentIntent = inv.ID
+	if inv.PaymentIntent != nil {
+		txn.PaymentIntent = inv.PaymentIntent.ID
+	}
+	if inv.Charge != nil {
+		txn.BankReturnCode = inv.Charge.ID
+	}
+
+	recorded, err := app.Webhooks.RecordRenewal(inv.Subscription.ID, txn)
+	if err != nil || !recorded || statusId == models.TransactionCleared {
+		return err
+	}
+
+	return app.startDunning(inv)
+}
+
+// handleInvoiceActionRequired asks the customer to authenticate a renewal payment; the
+// first payment of a subscription is authenticated in the browser at checkout
+func (app *application) handleInvoiceActionRequired(event stripe.Event) error {
+	var inv stripe.Invoice
+	err := decodeEventObject(event, &inv)
+	if err != nil {
+		return err
+	}
+
+	if inv.Subscription == nil || inv.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate {
+		return nil
+	}
+
+	return app.sendRenewalAuthentication(inv)
+}
+
+func (app *application) handleSubscriptionEvent(event stripe.Event) error {
+	var subscription stripe.Subscription
+	err := decodeEventObject(event, &subscription)
+	if err != nil {
+		return err
+	}
+
+	// a first payment left unauthenticated expires the subscription before it has an order
+	if subscription.Status == stripe.SubscriptionStatusIncompleteExpired {
+		_, err = app.Webhooks.DeletePendingSubscription(subscription.ID)
+		return err
+	}
+
+	// a cancelled subscription is not retried any more
+	if subscription.Status == stripe.SubscriptionStatusCanceled {
+		err = app.Webhooks.EndDunning(subscription.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = app.Webhooks.UpdateSubscriptionStatus(subscription.ID, subscriptionStatus(&subscription))
+	if err != nil {
+		return err
+	}
+
+	return app.syncSubscriptionPlan(&subscription)
+}
+
+func (app *application) handleChargeRefunded(event stripe.Event) error {
+	var charge stripe.Charge
+	err := decodeEventObject(event, &charge)
+	if err != nil {
+		return err
+	}
+
+	if charge.PaymentIntent == nil {
+		return nil
+	}
+
+	if charge.Refunds == nil || len(charge.Refunds.Data) == 0 {
+		if charge.AmountRefunded < charge.Amount {
+			return app.Webhooks.UpdateTransactionStatusByPaymentIntent(charge.PaymentIntent.ID, models.TransactionPartiallyRefunded)
+		}
+
+		err = app.Webhooks.UpdateTransactionStatusByPaymentIntent(charge.PaymentIntent.ID, models.TransactionRefunded)
+		if err != nil {
+			return err
+		}
+
+		return app.refundOrderByPaymentIntent(charge.PaymentIntent.ID)
+	}
+
+	orderId, err := app.Webhooks.GetOrderIdByPaymentIntent(charge.PaymentIntent.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// virtual terminal charges have no order
+		return app.Webhooks.UpdateTransactionStatusByPaymentIntent(charge.PaymentIntent.ID, refundedStatus(charge))
+	} else if err != nil {
+		return err
+	}
+
+	// refunds made from the admin area are already in the ledger and are skipped
+	for _, refund := range charge.Refunds.Data {
+		if refund.Status != stripe.RefundStatusSucceeded {
+			continue
+		}
+
+		err = app.Webhooks.RecordRefund(models.Refund{
+			OrderId:        orderId,
+			Amount:         int(refund.Amount),
+			Reason:         string(refund.Reason),
+			StripeRefundId: refund.ID,
+		})
+		if errors.Is(err, models.ErrRefundTooLarge) {
+			app.errorLog.Printf("refund %s of order %d is more than is left to refund", refund.ID, orderId)
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refundedStatus is the transaction status for a charge that has had money refunded
+func refundedStatus(charge stripe.Charge) int {
+	if charge.AmountRefunded < charge.Amount {
+		return models.TransactionPartiallyRefunded
+	}
+	return models.TransactionRefunded
+}
+
+// handleDisputeEvent records disputes as they are opened and decided. A disputed order is
+// refunded when the dispute is lost and gets its old status back when it is won.
+func (app *application) handleDisputeEvent(event stripe.Event) error {
+	var dispute stripe.Dispute
+	err := decodeEventObject(event, &dispute)
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("dispute %s is %s", dispute.ID, dispute.Status)
+
+	d := models.Dispute{
+		StripeDisputeId: dispute.ID,
+		Amount:          int(dispute.Amount),
+		Currency:        string(dispute.Currency),
+		Reason:          string(dispute.Reason),
+		Status:          string(dispute.Status),
+	}
+	if dispute.PaymentIntent != nil {
+		d.PaymentIntent = dispute.PaymentIntent.ID
+	}
+	if dispute.EvidenceDetails != nil && dispute.EvidenceDetails.DueBy > 0 {
+		d.EvidenceDueBy = time.Unix(dispute.EvidenceDetails.DueBy, 0)
+	}
+
+	d, err = app.Webhooks.SaveDispute(d)
+	if err != nil {
+		return err
+	}
+
+	switch stripe.DisputeStatus(d.Status) {
+	case stripe.DisputeStatusWon, stripe.DisputeStatusWarningClosed:
+		return app.Webhooks.RestoreDisputedOrder(d)
+	case stripe.DisputeStatusLost:
+		if d.PaymentIntent == "" {
+			return nil
+		}
+
+		// a lost dispute returns the funds to the cardholder
+		err = app.Webhooks.UpdateTransactionStatusByPaymentIntent(d.PaymentIntent, models.TransactionRefunded)
+		if err != nil {
+			return err
+		}
+
+		return app.refundOrderByPaymentIntent(d.PaymentIntent)
+	}
+
+	return nil
+}
+
+// refundOrderByPaymentIntent refunds and restocks the order paid for by pi, if there is one
+func (app *application) refundOrderByPaymentIntent(pi string) error {
+	orderId, err := app.Webhooks.GetOrderIdByPaymentIntent(pi)
+	if errors.Is(err, sql.ErrNoRows) {
+		// virtual terminal charges have no order
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return app.Webhooks.RefundOrder(orderId)
+}
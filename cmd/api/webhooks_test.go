@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/cards"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// memoryWebhooks keeps what webhooks record in memory, the way the database does; an
+// error set in fail is returned once by the method it is set for
+type memoryWebhooks struct {
+	mu           sync.Mutex
+	events       map[string]bool
+	transactions map[string]models.Transaction
+	orders       map[string]int
+	refunds      map[string]models.Refund
+	dunning      map[string]bool
+	fail         map[string]error
+}
+
+func newMemoryWebhooks() *memoryWebhooks {
+	return &memoryWebhooks{
+		events:       make(map[string]bool),
+		transactions: make(map[string]models.Transaction),
+		orders:       make(map[string]int),
+		refunds:      make(map[string]models.Refund),
+		dunning:      make(map[string]bool),
+		fail:         make(map[string]error),
+	}
+}
+
+func (m *memoryWebhooks) failure(method string) error {
+	err := m.fail[method]
+	delete(m.fail, method)
+	return err
+}
+
+func (m *memoryWebhooks) RecordStripeEvent(eventId, eventType string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.events[eventId] {
+		return false, nil
+	}
+	m.events[eventId] = true
+	return true, nil
+}
+
+func (m *memoryWebhooks) ForgetStripeEvent(eventId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.events, eventId)
+	return nil
+}
+
+func (m *memoryWebhooks) UpdateTransactionStatusByPaymentIntent(pi string, statusId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("UpdateTransactionStatusByPaymentIntent"); err != nil {
+		return err
+	}
+	if txn, ok := m.transactions[pi]; ok {
+		txn.TransactionStatusId = statusId
+		m.transactions[pi] = txn
+	}
+	return nil
+}
+
+func (m *memoryWebhooks) RecordRenewal(subId string, txn models.Transaction) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("RecordRenewal"); err != nil {
+		return false, err
+	}
+	if stored, ok := m.transactions[txn.PaymentIntent]; ok &&
+		stored.TransactionStatusId == models.TransactionCleared && txn.TransactionStatusId != models.TransactionCleared {
+		return false, nil
+	}
+	m.transactions[txn.PaymentIntent] = txn
+	if txn.TransactionStatusId == models.TransactionCleared {
+		delete(m.dunning, subId)
+	}
+	return true, nil
+}
+
+// StartDunning only starts dunning for a subscription with an order, like the database
+func (m *memoryWebhooks) StartDunning(subId, invoiceId string, nextAttempt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orders[subId]; !ok || m.dunning[subId] {
+		return false, nil
+	}
+	m.dunning[subId] = true
+	return true, nil
+}
+
+func (m *memoryWebhooks) EndDunning(subId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.dunning, subId)
+	return nil
+}
+
+func (m *memoryWebhooks) DeletePendingSubscription(subId string) (bool, error) {
+	return false, nil
+}
+
+func (m *memoryWebhooks) UpdateSubscriptionStatus(subId string, statusId int) error {
+	return nil
+}
+
+func (m *memoryWebhooks) GetOrderIdByPaymentIntent(pi string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := m.orders[pi]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return id, nil
+}
+
+func (m *memoryWebhooks) GetOrderById(id int) (models.Order, error) {
+	return models.Order{Id: id}, nil
+}
+
+func (m *memoryWebhooks) RecordRefund(refund models.Refund) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.refunds[refund.StripeRefundId]; !ok {
+		m.refunds[refund.StripeRefundId] = refund
+	}
+	return nil
+}
+
+func (m *memoryWebhooks) RefundOrder(id int) error {
+	return nil
+}
+
+func (m *memoryWebhooks) SaveDispute(d models.Dispute) (models.Dispute, error) {
+	return d, nil
+}
+
+func (m *memoryWebhooks) RestoreDisputedOrder(d models.Dispute) error {
+	return nil
+}
+
+// webhookApp returns an application that records webhooks in memory and charges with
+// the Fake gateway
+func webhookApp() (*application, *memoryWebhooks, *cards.Fake) {
+	store := newMemoryWebhooks()
+	fake := cards.NewFake()
+
+	app := &application{
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		Gateway:  fake,
+		Webhooks: store,
+	}
+	app.config.stripe.webhook = testWebhookSecret
+	app.config.dunning.schedule = []time.Duration{24 * time.Hour}
+
+	return app, store, fake
+}
+
+// stripeEvent writes an event of type eventType about object, as Stripe sends it
+func stripeEvent(t *testing.T, id, eventType string, object interface{}) []byte {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":     id,
+		"object": "event",
+		"type":   eventType,
+		"data":   map[string]interface{}{"object": object},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// signature is the Stripe-Signature header for body signed with secret at time at
+func signature(body []byte, secret string, at time.Time) string {
+	return fmt.Sprintf("t=%d,v1=%s", at.Unix(), hex.EncodeToString(webhook.ComputeSignature(at, body, secret)))
+}
+
+func postWebhook(app *application, body []byte, header string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", bytes.NewReader(body))
+	if header != "" {
+		r.Header.Set("Stripe-Signature", header)
+	}
+
+	w := httptest.NewRecorder()
+	app.StripeWebhook(w, r)
+
+	return w
+}
+
+// deliver posts a correctly signed event and fails the test unless it gets status
+func deliver(t *testing.T, app *application, body []byte, status int) {
+	t.Helper()
+
+	w := postWebhook(app, body, signature(body, testWebhookSecret, time.Now()))
+	if w.Code != status {
+		t.Fatalf("got %d %s, want %d", w.Code, w.Body.String(), status)
+	}
+}
+
+func TestStripeWebhookSignature(t *testing.T) {
+	body := []byte(`{"id":"evt_1","object":"event","type":"payment_intent.succeeded","data":{"object":{"id":"pi_1"}}}`)
+
+	tests := []struct {
+		name   string
+		body   []byte
+		header string
+		want   int
+	}{
+		{"signed", body, signature(body, testWebhookSecret, time.Now()), http.StatusOK},
+		{"unsigned", body, "", http.StatusBadRequest},
+		{"wrong secret", body, signature(body, "whsec_other", time.Now()), http.StatusBadRequest},
+		{"tampered body", bytes.Replace(body, []byte("pi_1"), []byte("pi_2"), 1), signature(body, testWebhookSecret, time.Now()), http.StatusBadRequest},
+		{"too old", body, signature(body, testWebhookSecret, time.Now().Add(-time.Hour)), http.StatusBadRequest},
+		{"malformed header", body, "v1=nothex", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, store, _ := webhookApp()
+
+			w := postWebhook(app, tt.body, tt.header)
+			if w.Code != tt.want {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body.String(), tt.want)
+			}
+			if recorded := store.events["evt_1"]; recorded != (tt.want == http.StatusOK) {
+				t.Errorf("event recorded: %t", recorded)
+			}
+		})
+	}
+}
+
+func TestStripeWebhookDuplicate(t *testing.T) {
+	app, store, fake := webhookApp()
+
+	pi, _, err := fake.Charge("usd", 1000, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.transactions[pi.ID] = models.Transaction{PaymentIntent: pi.ID, TransactionStatusId: models.TransactionPending}
+
+	body := stripeEvent(t, "evt_1", "payment_intent.succeeded", map[string]interface{}{"id": pi.ID, "object": "payment_intent"})
+	deliver(t, app, body, http.StatusOK)
+
+	// a redelivery of the event is not processed again
+	store.transactions[pi.ID] = models.Transaction{PaymentIntent: pi.ID, TransactionStatusId: models.TransactionPending}
+	deliver(t, app, body, http.StatusOK)
+
+	if got := store.transactions[pi.ID].TransactionStatusId; got != models.TransactionPending {
+		t.Errorf("redelivered event was processed again: transaction status %d", got)
+	}
+}
+
+func TestStripeWebhookRetry(t *testing.T) {
+	app, store, fake := webhookApp()
+
+	pi, _, err := fake.Charge("usd", 1000, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.transactions[pi.ID] = models.Transaction{PaymentIntent: pi.ID, TransactionStatusId: models.TransactionPending}
+	store.fail["UpdateTransactionStatusByPaymentIntent"] = errors.New("database unavailable")
+
+	body := stripeEvent(t, "evt_1", "payment_intent.succeeded", map[string]interface{}{"id": pi.ID, "object": "payment_intent"})
+	deliver(t, app, body, http.StatusInternalServerError)
+
+	if store.events["evt_1"] {
+		t.Fatal("the failed event was not forgotten")
+	}
+
+	// Stripe's retry is processed
+	deliver(t, app, body, http.StatusOK)
+
+	if got := store.transactions[pi.ID].TransactionStatusId; got != models.TransactionCleared {
+		t.Errorf("got transaction status %d after the retry, want %d", got, models.TransactionCleared)
+	}
+}
+
+func TestStripeWebhookRenewal(t *testing.T) {
+	type delivery struct {
+		id        string
+		eventType string
+		status    int
+		fail      string
+	}
+
+	tests := []struct {
+		name       string
+		deliveries []delivery
+		want       int
+	}{
+		{"paid", []delivery{
+			{"evt_1", "invoice.paid", http.StatusOK, ""},
+		}, models.TransactionCleared},
+		{"paid twice", []delivery{
+			{"evt_1", "invoice.paid", http.StatusOK, ""},
+			{"evt_2", "invoice.paid", http.StatusOK, ""},
+		}, models.TransactionCleared},
+		{"paid after failing", []delivery{
+			{"evt_1", "invoice.payment_failed", http.StatusOK, ""},
+			{"evt_2", "invoice.paid", http.StatusOK, ""},
+		}, models.TransactionCleared},
+		{"failure arriving after payment", []delivery{
+			{"evt_2", "invoice.paid", http.StatusOK, ""},
+			{"evt_1", "invoice.payment_failed", http.StatusOK, ""},
+		}, models.TransactionCleared},
+		{"retried after an error", []delivery{
+			{"evt_1", "invoice.paid", http.StatusInternalServerError, "RecordRenewal"},
+			{"evt_1", "invoice.paid", http.StatusOK, ""},
+		}, models.TransactionCleared},
+		{"failed", []delivery{
+			{"evt_1", "invoice.payment_failed", http.StatusOK, ""},
+			{"evt_1", "invoice.payment_failed", http.StatusOK, ""},
+		}, models.TransactionDeclined},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, store, fake := webhookApp()
+
+			pi, _, err := fake.Charge("usd", 1000, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			invoice := map[string]interface{}{
+				"id":             "in_1",
+				"object":         "invoice",
+				"subscription":   "sub_1",
+				"billing_reason": "subscription_cycle",
+				"amount_due":     1000,
+				"amount_paid":    1000,
+				"currency":       "usd",
+				"payment_intent": pi.ID,
+			}
+
+			for _, d := range tt.deliveries {
+				if d.fail != "" {
+					store.fail[d.fail] = errors.New("database unavailable")
+				}
+				deliver(t, app, stripeEvent(t, d.id, d.eventType, invoice), d.status)
+			}
+
+			if len(store.transactions) != 1 {
+				t.Fatalf("got %d transactions, want 1", len(store.transactions))
+			}
+			if got := store.transactions[pi.ID].TransactionStatusId; got != tt.want {
+				t.Errorf("got transaction status %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripeWebhookRefund(t *testing.T) {
+	app, store, fake := webhookApp()
+
+	pi, _, err := fake.Charge("usd", 1000, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.orders[pi.ID] = 7
+
+	refund, err := fake.Refund(pi.ID, 400, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	charge := map[string]interface{}{
+		"id":              "ch_1",
+		"object":          "charge",
+		"amount":          1000,
+		"amount_refunded": 400,
+		"payment_intent":  pi.ID,
+		"refunds": map[string]interface{}{
+			"object": "list",
+			"data": []interface{}{
+				map[string]interface{}{"id": refund.ID, "object": "refund", "amount": refund.Amount, "status": string(refund.Status)},
+			},
+		},
+	}
+
+	// Stripe sends the refund again with the next refund of the same charge
+	deliver(t, app, stripeEvent(t, "evt_1", "charge.refunded", charge), http.StatusOK)
+	deliver(t, app, stripeEvent(t, "evt_2", "charge.refunded", charge), http.StatusOK)
+
+	if len(store.refunds) != 1 {
+		t.Fatalf("got %d refunds, want 1", len(store.refunds))
+	}
+	if got := store.refunds[refund.ID]; got.OrderId != 7 || got.Amount != 400 {
+		t.Errorf("got refund of %d against order %d, want 400 against order 7", got.Amount, got.OrderId)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/money"
+	"github.com/sindrishtepani/go-stripe/internal/validator"
+)
+
+// maxImageSize is the largest widget image that can be uploaded
+const maxImageSize = 5 << 20
+
+// imageTypes maps the content types accepted for widget images to their file extension
+var imageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// billingIntervals are the intervals Stripe can bill a subscription on
+var billingIntervals = map[string]bool{
+	"day":   true,
+	"week":  true,
+	"month": true,
+	"year":  true,
+}
+
+// AllWidgets returns every widget, including the ones taken out of the catalog
+func (app *application) AllWidgets(w http.ResponseWriter, r *http.Request) {
+	widgets, err := app.DB.GetAllWidgets(false)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, widgets)
+}
+
+func (app *application) OneWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetId, _ := strconv.Atoi(id)
+
+	widget, err := app.DB.GetWidget(widgetId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	widget.Prices, err = app.DB.GetWidgetPrices(widgetId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, widget)
+}
+
+// EditWidget creates a widget when id is 0, and updates it otherwise. A new widget is
+// stocked with inventory_level; an existing one has inventory_change added to its stock.
+func (app *application) EditWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetId, _ := strconv.Atoi(id)
+
+	var payload struct {
+		models.Widget
+		InventoryChange int `json:"inventory_change"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	widget := payload.Widget
+
+	widget.Currency = money.Normalize(widget.Currency)
+	if !widget.IsRecurring {
+		widget.Interval = ""
+		widget.TrialDays = 0
+	} else if widget.Interval == "" {
+		widget.Interval = "month"
+	}
+
+	v := validator.New()
+	v.Check(len(widget.Name) > 1, "name", "must be at least 2 characters")
+	v.Check(money.Supported(widget.Currency), "currency", "must be one of "+strings.Join(money.Codes(), ", "))
+	v.Check(widget.Interval == "" || billingIntervals[widget.Interval], "interval", "must be day, week, month or year")
+	v.Check(widget.Price > 0, "price", "must be greater than zero")
+	v.Check(widget.Inventorylevel >= 0, "inventory_level", "cannot be negative")
+	// Stripe allows trials of up to two years
+	v.Check(widget.TrialDays >= 0 && widget.TrialDays <= 730, "trial_days", "must be between 0 and 730")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	if widgetId > 0 {
+		widget.Id = widgetId
+		err = app.DB.UpdateWidget(widget, payload.InventoryChange)
+	} else {
+		widgetId, err = app.DB.InsertWidget(widget)
+	}
+	if errors.Is(err, models.ErrNegativeInventory) {
+		v.AddError("inventory_level", "would go below zero after recent sales; reload and try again")
+		app.failedValidation(w, r, v.Errors)
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK: true,
+		Id: widgetId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// SetWidgetPrice sells a widget in another currency, or changes its price in one.
+// The Stripe price for it is created the next time widgets are pushed to Stripe.
+func (app *application) SetWidgetPrice(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetId, _ := strconv.Atoi(id)
+
+	var price models.WidgetPrice
+
+	err := app.readJSON(w, r, &price)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	widget, err := app.DB.GetWidget(widgetId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	price.WidgetId = widgetId
+	price.Currency = money.Normalize(price.Currency)
+
+	v := validator.New()
+	v.Check(money.Supported(price.Currency), "currency", "must be one of "+strings.Join(money.Codes(), ", "))
+	v.Check(price.Currency != widget.Currency, "currency", "is the widget's own currency; change its price instead")
+	v.Check(price.Amount > 0, "amount", "must be greater than zero")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	err = app.DB.SetWidgetPrice(price)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Price saved",
+		Id:      widgetId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// DeleteWidgetPrice stops selling a widget in a currency
+func (app *application) DeleteWidgetPrice(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetId, _ := strconv.Atoi(id)
+
+	var price models.WidgetPrice
+
+	err := app.readJSON(w, r, &price)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.DeleteWidgetPrice(widgetId, price.Currency)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Price removed",
+		Id:      widgetId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// DeleteWidget takes a widget out of the catalog
+func (app *application) DeleteWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetId, _ := strconv.Atoi(id)
+
+	err := app.DB.DeactivateWidget(widgetId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// UploadWidgetImage stores the image posted in the "image" form field and sets it on the widget
+func (app *application) UploadWidgetImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetId, _ := strconv.Atoi(id)
+
+	_, err := app.DB.GetWidget(widgetId)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1024)
+	err = r.ParseMultipartForm(maxImageSize)
+	if err != nil {
+		app.badRequest(w, r, errors.New("image is too large"))
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	// trust the contents of the file, not the name or content type sent with it
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	ext, ok := imageTypes[http.DetectContentType(head[:n])]
+	if !ok {
+		app.badRequest(w, r, errors.New("image must be a png, jpeg, gif or webp file"))
+		return
+	}
+
+	suffix := make([]byte, 8)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	fileName := fmt.Sprintf("widget-%d-%s%s", widgetId, hex.EncodeToString(suffix), ext)
+
+	out, err := os.Create(filepath.Join(app.config.images, fileName))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("could not save image"))
+		return
+	}
+	defer out.Close()
+
+	_, err = out.Write(head[:n])
+	if err == nil {
+		_, err = io.Copy(out, file)
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("could not save image"))
+		return
+	}
+
+	image := "/static/widgets/" + fileName
+	err = app.DB.UpdateWidgetImage(widgetId, image)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Content: image,
+		Id:      widgetId,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
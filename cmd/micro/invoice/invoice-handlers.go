@@ -7,17 +7,36 @@ import (
 
 	"github.com/phpdave11/gofpdf"
 	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+	"github.com/sindrishtepani/go-stripe/internal/money"
 )
 
 type Order struct {
 	Id        int       `json:"id"`
 	Quantity  int       `json:"quantity"`
 	Amount    int       `json:"amount"`
+	Currency  string    `json:"currency"`
 	Product   string    `json:"product"`
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
+	Items     []Item    `json:"items"`
+	Taxes     []Tax     `json:"taxes"`
+}
+
+// Item is one line of a multi-line order
+type Item struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+	Amount   int    `json:"amount"`
+}
+
+// Tax is one tax charged on an order; inclusive taxes are already part of the item amounts
+type Tax struct {
+	Name      string  `json:"name"`
+	Rate      float64 `json:"rate"`
+	Inclusive bool    `json:"inclusive"`
+	Amount    int     `json:"amount"`
 }
 
 func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Request) {
@@ -68,7 +87,48 @@ func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Requ
 	app.writeJSON(w, http.StatusOK, resp)
 }
 
+// DownloadInvoice renders the invoice for an order and writes it out as a pdf, without
+// saving or mailing it
+func (app *application) DownloadInvoice(w http.ResponseWriter, r *http.Request) {
+	var order Order
+
+	err := app.readJSON(w, r, &order)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	pdf, err := app.invoicePDF(order)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"invoice-%d.pdf\"", order.Id))
+	err = pdf.Output(w)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) createInvoicePDF(order Order) error {
+	pdf, err := app.invoicePDF(order)
+	if err != nil {
+		return err
+	}
+
+	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.Id)
+	err = pdf.OutputFileAndClose(invoicePath)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// invoicePDF lays out the invoice for an order
+func (app *application) invoicePDF(order Order) (*gofpdf.Fpdf, error) {
 	pdf := gofpdf.New("P", "mm", "Letter", "")
 	pdf.SetMargins(10, 13, 10)
 	pdf.SetAutoPageBreak(true, 0)
@@ -77,6 +137,9 @@ func (app *application) createInvoicePDF(order Order) error {
 
 	t := importer.ImportPage(pdf, "./pdf-templates/invoice.pdf", 1, "/MediaBox")
 
+	// the core fonts are not unicode, so symbols such as € are translated to their code page
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
 	pdf.AddPage()
 	importer.UseImportedTemplate(pdf, t, 0, 0, 215.9, 0)
 
@@ -90,21 +153,49 @@ func (app *application) createInvoicePDF(order Order) error {
 	pdf.Ln(5)
 	pdf.CellFormat(97, 8, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
 
-	pdf.SetX(58)
-	pdf.SetY(93)
-	pdf.CellFormat(155, 8, order.Product, "", 0, "L", false, 0, "")
-	pdf.SetX(166)
-	pdf.CellFormat(20, 8, fmt.Sprintf("%d", order.Quantity), "", 0, "L", false, 0, "")
+	items := order.Items
+	if len(items) == 0 {
+		amount := order.Amount
+		for _, tax := range order.Taxes {
+			if !tax.Inclusive {
+				amount -= tax.Amount
+			}
+		}
+		items = []Item{{Product: order.Product, Quantity: order.Quantity, Amount: amount}}
+	}
 
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount/100.0)), "", 0, "R", false, 0, "")
+	// one row per line item
+	for i, item := range items {
+		pdf.SetX(58)
+		pdf.SetY(93 + float64(i)*8)
+		pdf.CellFormat(155, 8, item.Product, "", 0, "L", false, 0, "")
+		pdf.SetX(166)
+		pdf.CellFormat(20, 8, fmt.Sprintf("%d", item.Quantity), "", 0, "L", false, 0, "")
 
-	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.Id)
-	err := pdf.OutputFileAndClose(invoicePath)
-	if err != nil {
-		return err
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, tr(money.Format(item.Amount, order.Currency)), "", 0, "R", false, 0, "")
 	}
 
-	return nil
+	// taxes follow the items, marking those already included in the prices
+	for i, tax := range order.Taxes {
+		label := fmt.Sprintf("%s %g%%", tax.Name, tax.Rate)
+		if tax.Inclusive {
+			label += " (included)"
+		}
+		pdf.SetY(93 + float64(len(items)+i)*8)
+		pdf.SetX(58)
+		pdf.CellFormat(155, 8, label, "", 0, "L", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, tr(money.Format(tax.Amount, order.Currency)), "", 0, "R", false, 0, "")
+	}
+
+	if len(order.Items) > 1 || len(order.Taxes) > 0 {
+		pdf.SetY(93 + float64(len(items)+len(order.Taxes))*8)
+		pdf.SetX(166)
+		pdf.CellFormat(20, 8, "Total", "", 0, "L", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, tr(money.Format(order.Amount, order.Currency)), "", 0, "R", false, 0, "")
+	}
 
+	return pdf, pdf.Error()
 }
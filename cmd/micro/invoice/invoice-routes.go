@@ -19,6 +19,7 @@ func (app *application) routes() http.Handler {
 	}))
 
 	mux.Post("/invoice/create-and-send", app.CreateAndSendInvoice)
+	mux.Post("/invoice/download", app.DownloadInvoice)
 
 	return mux
 }
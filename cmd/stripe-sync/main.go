@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/sindrishtepani/go-stripe/internal/cards"
+	"github.com/sindrishtepani/go-stripe/internal/driver"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+)
+
+type config struct {
+	db struct {
+		dsn string
+	}
+	stripe struct {
+		secret    string
+		key       string
+		gateway   string
+		backend   string
+		fakeState string
+	}
+	push      bool
+	inventory int
+}
+
+type application struct {
+	config   config
+	infoLog  *log.Logger
+	errorLog *log.Logger
+	DB       store
+	Catalog  cards.Catalog
+}
+
+func main() {
+	var cfg config
+
+	flag.StringVar(&cfg.stripe.gateway, "gateway", "stripe", "Payment gateway {stripe, fake}")
+	flag.StringVar(&cfg.stripe.backend, "stripe-backend", "", "Stripe API base URL (defaults to api.stripe.com)")
+	flag.StringVar(&cfg.stripe.fakeState, "fake-state", filepath.Join(os.TempDir(), "go-stripe-fake.json"), "file the fake gateway keeps its state in, shared by the front and back end")
+	flag.StringVar(&cfg.db.dsn, "dsn", "sshtepan:1234@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "DSN")
+	flag.BoolVar(&cfg.push, "push", false, "Create Stripe products and prices for widgets that do not have one")
+	flag.IntVar(&cfg.inventory, "inventory", 0, "Inventory level for widgets created from new Stripe products")
+
+	flag.Parse()
+
+	cfg.stripe.key = os.Getenv("STRIPE_KEY")
+	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+
+	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+
+	catalog, err := cards.NewCatalog(cfg.stripe.gateway, cfg.stripe.secret, cfg.stripe.key, cfg.stripe.backend, cfg.stripe.fakeState)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	conn, err := driver.OpenDB(cfg.db.dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer conn.Close()
+
+	app := &application{
+		config:   cfg,
+		infoLog:  infoLog,
+		errorLog: errorLog,
+		DB:       &models.DBModel{DB: conn},
+		Catalog:  catalog,
+	}
+
+	err = app.pull()
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	if cfg.push {
+		err = app.push()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// store is the part of the database widgets are synced with
+type store interface {
+	GetAllWidgets(activeOnly bool) ([]*models.Widget, error)
+	InsertWidget(w models.Widget) (int, error)
+	UpdateWidget(w models.Widget, inventoryChange int) error
+	LinkWidgetToStripe(id int, productId, priceId string) error
+	GetWidgetPrices(widgetId int) ([]models.WidgetPrice, error)
+	SetWidgetPrice(p models.WidgetPrice) error
+	LinkWidgetPriceToStripe(widgetId int, currency, priceId string) error
+}
+
+// pull creates or updates a widget for every Stripe product, priced from the
+// product's default price. A widget whose price was changed here since it was last synced
+// keeps it, for push to send to Stripe.
+func (app *application) pull() error {
+	products, err := app.Catalog.ListProducts()
+	if err != nil {
+		return err
+	}
+
+	prices, err := app.Catalog.ListPrices()
+	if err != nil {
+		return err
+	}
+
+	widgets, err := app.DB.GetAllWidgets(false)
+	if err != nil {
+		return err
+	}
+
+	byProduct := make(map[string]*models.Widget)
+	byPlan := make(map[string]*models.Widget)
+	for _, w := range widgets {
+		if w.StripeProduct != "" {
+			byProduct[w.StripeProduct] = w
+		}
+		if w.PlanId != "" {
+			byPlan[w.PlanId] = w
+		}
+	}
+
+	pricesById := make(map[string]*stripe.Price)
+	pricesByProduct := make(map[string][]*stripe.Price)
+	for _, p := range prices {
+		pricesById[p.ID] = p
+		if p.Product != nil {
+			pricesByProduct[p.Product.ID] = append(pricesByProduct[p.Product.ID], p)
+		}
+	}
+
+	for _, product := range products {
+		price := defaultPrice(product, pricesByProduct[product.ID])
+		if price == nil || price.UnitAmount == 0 {
+			app.infoLog.Printf("skipping product %s (%s): it has no fixed price", product.ID, product.Name)
+			continue
+		}
+
+		// widgets that predate the sync are only linked to Stripe by their plan id
+		widget, ok := byProduct[product.ID]
+		if !ok {
+			widget, ok = byPlan[price.ID]
+		}
+		if !ok {
+			widget = &models.Widget{Inventorylevel: app.config.inventory}
+		}
+
+		widget.Name = product.Name
+		widget.Description = product.Description
+
+		// a price changed here is kept, unless Stripe's is the same anyway
+		planId := price.ID
+		interval := widgetInterval(widget)
+		if widget.Id != 0 && priceChanged(widget.PlanId, widget.Currency, widget.Price, interval, pricesById) &&
+			priceChanged(price.ID, widget.Currency, widget.Price, interval, pricesById) {
+			app.infoLog.Printf("keeping the price of widget %d (%s): it was changed since the last sync", widget.Id, widget.Name)
+			planId = widget.PlanId
+			widget.Active = product.Active
+		} else {
+			widget.Price = int(price.UnitAmount)
+			widget.Currency = strings.ToLower(string(price.Currency))
+			widget.Active = product.Active && price.Active
+			widget.IsRecurring = price.Type == stripe.PriceTypeRecurring
+			widget.Interval = ""
+			if price.Recurring != nil {
+				widget.Interval = string(price.Recurring.Interval)
+			}
+			widget.PlanId = price.ID
+		}
+
+		if widget.Id == 0 {
+			widget.Id, err = app.DB.InsertWidget(*widget)
+			if err == nil {
+				app.infoLog.Printf("created widget %d for product %s (%s)", widget.Id, product.ID, product.Name)
+			}
+		} else {
+			err = app.DB.UpdateWidget(*widget, 0)
+			if err == nil {
+				app.infoLog.Printf("updated widget %d from product %s (%s)", widget.Id, product.ID, product.Name)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		err = app.DB.LinkWidgetToStripe(widget.Id, product.ID, planId)
+		if err != nil {
+			return err
+		}
+
+		err = app.pullPrices(widget, price, pricesByProduct[product.ID], pricesById)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pullPrices records the product's active prices in other currencies as the widget's
+// prices in those currencies; the first price found for a currency is used. Prices
+// changed here since the last sync are kept, for push to send to Stripe.
+func (app *application) pullPrices(widget *models.Widget, base *stripe.Price, prices []*stripe.Price, pricesById map[string]*stripe.Price) error {
+	local, err := app.DB.GetWidgetPrices(widget.Id)
+	if err != nil {
+		return err
+	}
+
+	interval := widgetInterval(widget)
+
+	changed := make(map[string]models.WidgetPrice)
+	for _, p := range local {
+		if priceChanged(p.PlanId, p.Currency, p.Amount, interval, pricesById) {
+			changed[p.Currency] = p
+		}
+	}
+
+	seen := map[string]bool{widget.Currency: true}
+
+	for _, p := range prices {
+		currency := strings.ToLower(string(p.Currency))
+		if p.ID == base.ID || !p.Active || p.UnitAmount == 0 || seen[currency] {
+			continue
+		}
+
+		// a price changed here is kept, unless this one is the same anyway
+		if l, ok := changed[currency]; ok && priceChanged(p.ID, l.Currency, l.Amount, interval, pricesById) {
+			continue
+		}
+
+		// a subscription can only move to a price billed on the same interval
+		if p.Type != base.Type ||
+			(p.Recurring != nil && base.Recurring != nil && p.Recurring.Interval != base.Recurring.Interval) {
+			continue
+		}
+		seen[currency] = true
+
+		err := app.DB.SetWidgetPrice(models.WidgetPrice{WidgetId: widget.Id, Currency: currency, Amount: int(p.UnitAmount)})
+		if err != nil {
+			return err
+		}
+
+		err = app.DB.LinkWidgetPriceToStripe(widget.Id, currency, p.ID)
+		if err != nil {
+			return err
+		}
+
+		app.infoLog.Printf("priced widget %d in %s from price %s", widget.Id, currency, p.ID)
+	}
+
+	return nil
+}
+
+// push creates a Stripe product and price for every widget that has neither, and a new
+// Stripe price for every price, in the widget's currency or another, that has none or
+// that no longer matches the one it is linked to. Stripe prices cannot be changed, so a
+// widget whose price changed is moved to a new one.
+func (app *application) push() error {
+	widgets, err := app.DB.GetAllWidgets(false)
+	if err != nil {
+		return err
+	}
+
+	stripePrices, err := app.Catalog.ListPrices()
+	if err != nil {
+		return err
+	}
+
+	pricesById := make(map[string]*stripe.Price)
+	for _, p := range stripePrices {
+		pricesById[p.ID] = p
+	}
+
+	for _, w := range widgets {
+		interval := widgetInterval(w)
+
+		if w.StripeProduct == "" && w.PlanId == "" {
+			product, err := app.Catalog.CreateProduct(w.Name, w.Description)
+			if err != nil {
+				return err
+			}
+			w.StripeProduct = product.ID
+
+			// the product is linked before its price is made, so that a run that stops
+			// short adds only the price next time rather than another product
+			err = app.DB.LinkWidgetToStripe(w.Id, w.StripeProduct, w.PlanId)
+			if err != nil {
+				return err
+			}
+
+			app.infoLog.Printf("pushed widget %d (%s) as product %s", w.Id, w.Name, product.ID)
+		}
+
+		// widgets that predate the sync have a plan but no product to add prices to
+		if w.StripeProduct == "" {
+			continue
+		}
+
+		if priceChanged(w.PlanId, w.Currency, w.Price, interval, pricesById) {
+			price, err := app.Catalog.CreatePrice(w.StripeProduct, w.Currency, w.Price, interval)
+			if err != nil {
+				return err
+			}
+
+			err = app.Catalog.SetDefaultPrice(w.StripeProduct, price.ID)
+			if err != nil {
+				return err
+			}
+
+			err = app.DB.LinkWidgetToStripe(w.Id, w.StripeProduct, price.ID)
+			if err != nil {
+				return err
+			}
+
+			app.infoLog.Printf("pushed widget %d (%s) as price %s", w.Id, w.Name, price.ID)
+		}
+
+		prices, err := app.DB.GetWidgetPrices(w.Id)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range prices {
+			if !priceChanged(p.PlanId, p.Currency, p.Amount, interval, pricesById) {
+				continue
+			}
+
+			price, err := app.Catalog.CreatePrice(w.StripeProduct, p.Currency, p.Amount, interval)
+			if err != nil {
+				return err
+			}
+
+			err = app.DB.LinkWidgetPriceToStripe(w.Id, p.Currency, price.ID)
+			if err != nil {
+				return err
+			}
+
+			app.infoLog.Printf("pushed widget %d (%s) in %s as price %s", w.Id, w.Name, p.Currency, price.ID)
+		}
+	}
+
+	return nil
+}
+
+// widgetInterval is the interval Stripe bills a widget on, or "" for one sold once
+func widgetInterval(w *models.Widget) string {
+	if !w.IsRecurring {
+		return ""
+	}
+	if w.Interval == "" {
+		return string(stripe.PriceRecurringIntervalMonth)
+	}
+	return w.Interval
+}
+
+// priceChanged reports whether a price set here no longer matches the Stripe price planId
+// links it to, or is not linked to one at all. A link to a price that is not in Stripe's
+// list is trusted, since older plans may live in another account.
+func priceChanged(planId, currency string, amount int, interval string, pricesById map[string]*stripe.Price) bool {
+	if planId == "" {
+		return true
+	}
+
+	p, ok := pricesById[planId]
+	if !ok {
+		return false
+	}
+
+	stripeInterval := ""
+	if p.Recurring != nil {
+		stripeInterval = string(p.Recurring.Interval)
+	}
+
+	return p.UnitAmount != int64(amount) ||
+		!strings.EqualFold(string(p.Currency), currency) ||
+		stripeInterval != interval
+}
+
+// defaultPrice picks the price a product is sold at: its default price if it has one,
+// otherwise its first active price
+func defaultPrice(product *stripe.Product, prices []*stripe.Price) *stripe.Price {
+	if product.DefaultPrice != nil {
+		for _, p := range prices {
+			if p.ID == product.DefaultPrice.ID {
+				return p
+			}
+		}
+	}
+
+	for _, p := range prices {
+		if p.Active {
+			return p
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sindrishtepani/go-stripe/internal/cards"
+	"github.com/sindrishtepani/go-stripe/internal/models"
+)
+
+// stubStripe keeps products and prices the way the Stripe API does, for the calls the
+// sync makes
+type stubStripe struct {
+	mu       sync.Mutex
+	seq      int
+	products []map[string]interface{}
+	prices   []map[string]interface{}
+	// failPrices makes creating a price fail, as an outage part way through a sync would
+	failPrices bool
+}
+
+func (s *stubStripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	list := func(data []map[string]interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list", "data": data, "has_more": false, "url": r.URL.Path,
+		})
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/products":
+		list(s.products)
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/prices":
+		list(s.prices)
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/products":
+		product := s.addProduct(r.Form.Get("name"), r.Form.Get("description"))
+		json.NewEncoder(w).Encode(product)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v1/products/"):
+		product := s.product(strings.TrimPrefix(r.URL.Path, "/v1/products/"))
+		if product == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"type":"invalid_request_error","message":"No such product"}}`)
+			return
+		}
+		if price := r.Form.Get("default_price"); price != "" {
+			product["default_price"] = price
+		}
+		json.NewEncoder(w).Encode(product)
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/prices":
+		if s.failPrices {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error":{"type":"api_error","message":"Something went wrong"}}`)
+			return
+		}
+		amount, _ := strconv.Atoi(r.Form.Get("unit_amount"))
+		price := s.addPrice(r.Form.Get("product"), r.Form.Get("currency"), amount, r.Form.Get("recurring[interval]"))
+		json.NewEncoder(w).Encode(price)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error":{"type":"invalid_request_error","message":"Unrecognized request URL (%s: %s)"}}`, r.Method, r.URL.Path)
+	}
+}
+
+// addProduct adds a product; callers hold s.mu
+func (s *stubStripe) addProduct(name, description string) map[string]interface{} {
+	s.seq++
+	product := map[string]interface{}{
+		"id": fmt.Sprintf("prod_%d", s.seq), "object": "product", "active": true,
+		"name": name, "description": description,
+	}
+	s.products = append(s.products, product)
+
+	return product
+}
+
+// addPrice adds a price to a product; callers hold s.mu
+func (s *stubStripe) addPrice(productId, currency string, amount int, interval string) map[string]interface{} {
+	s.seq++
+	price := map[string]interface{}{
+		"id": fmt.Sprintf("price_%d", s.seq), "object": "price", "active": true,
+		"product": productId, "currency": currency, "unit_amount": amount, "type": "one_time",
+	}
+	if interval != "" {
+		price["type"] = "recurring"
+		price["recurring"] = map[string]interface{}{"interval": interval}
+	}
+	s.prices = append(s.prices, price)
+
+	return price
+}
+
+// product finds a product; callers hold s.mu
+func (s *stubStripe) product(id string) map[string]interface{} {
+	for _, p := range s.products {
+		if p["id"] == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// defaultPrice returns the default price of a product
+func (s *stubStripe) defaultPrice(productId string) (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, _ := s.product(productId)["default_price"].(string)
+	for _, p := range s.prices {
+		if p["id"] == id {
+			return id, p["unit_amount"].(int)
+		}
+	}
+	return id, 0
+}
+
+// memoryStore keeps widgets the way the widgets and widget_prices tables do
+type memoryStore struct {
+	widgets map[int]*models.Widget
+	prices  map[int][]models.WidgetPrice
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{widgets: make(map[int]*models.Widget), prices: make(map[int][]models.WidgetPrice)}
+}
+
+func (m *memoryStore) GetAllWidgets(activeOnly bool) ([]*models.Widget, error) {
+	var widgets []*models.Widget
+	for id := 1; id <= len(m.widgets); id++ {
+		w := *m.widgets[id]
+		widgets = append(widgets, &w)
+	}
+	return widgets, nil
+}
+
+func (m *memoryStore) InsertWidget(w models.Widget) (int, error) {
+	w.Id = len(m.widgets) + 1
+	m.widgets[w.Id] = &w
+	return w.Id, nil
+}
+
+func (m *memoryStore) UpdateWidget(w models.Widget, inventoryChange int) error {
+	stored := m.widgets[w.Id]
+	if w.PlanId == stored.PlanId && (w.Price != stored.Price || w.Currency != stored.Currency ||
+		w.IsRecurring != stored.IsRecurring || w.Interval != stored.Interval) {
+		w.PlanId = ""
+	}
+	w.Inventorylevel = stored.Inventorylevel + inventoryChange
+	w.StripeProduct = stored.StripeProduct
+	m.widgets[w.Id] = &w
+	return nil
+}
+
+func (m *memoryStore) LinkWidgetToStripe(id int, productId, priceId string) error {
+	m.widgets[id].StripeProduct = productId
+	m.widgets[id].PlanId = priceId
+	return nil
+}
+
+func (m *memoryStore) GetWidgetPrices(widgetId int) ([]models.WidgetPrice, error) {
+	return append([]models.WidgetPrice(nil), m.prices[widgetId]...), nil
+}
+
+func (m *memoryStore) SetWidgetPrice(p models.WidgetPrice) error {
+	for i, existing := range m.prices[p.WidgetId] {
+		if existing.Currency == p.Currency {
+			if existing.Amount == p.Amount {
+				p.PlanId = existing.PlanId
+			}
+			m.prices[p.WidgetId][i] = p
+			return nil
+		}
+	}
+	m.prices[p.WidgetId] = append(m.prices[p.WidgetId], p)
+	return nil
+}
+
+func (m *memoryStore) LinkWidgetPriceToStripe(widgetId int, currency, priceId string) error {
+	for i, p := range m.prices[widgetId] {
+		if p.Currency == currency {
+			m.prices[widgetId][i].PlanId = priceId
+		}
+	}
+	return nil
+}
+
+// price returns a widget's price in a currency other than its own
+func (m *memoryStore) price(widgetId int, currency string) models.WidgetPrice {
+	for _, p := range m.prices[widgetId] {
+		if p.Currency == currency {
+			return p
+		}
+	}
+	return models.WidgetPrice{}
+}
+
+func newSyncApp(t *testing.T) (*application, *stubStripe, *memoryStore) {
+	t.Helper()
+
+	stub := &stubStripe{}
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+
+	db := newMemoryStore()
+	app := &application{
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		DB:       db,
+		Catalog:  cards.NewCard("sk_test", "pk_test", srv.URL),
+	}
+	app.config.inventory = 5
+
+	return app, stub, db
+}
+
+// runSync runs the sync the way the command does with -push
+func runSync(t *testing.T, app *application) {
+	t.Helper()
+
+	err := app.pull()
+	if err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	err = app.push()
+	if err != nil {
+		t.Fatalf("push: %v", err)
+	}
+}
+
+func TestPull(t *testing.T) {
+	app, stub, db := newSyncApp(t)
+
+	product := stub.addProduct("Widget", "A very nice widget.")
+	usd := stub.addPrice(product["id"].(string), "usd", 1000, "")
+	eur := stub.addPrice(product["id"].(string), "eur", 900, "")
+	product["default_price"] = usd["id"]
+
+	runSync(t, app)
+
+	w := db.widgets[1]
+	if w == nil || len(db.widgets) != 1 {
+		t.Fatalf("got %d widgets, want 1", len(db.widgets))
+	}
+	if w.Name != "Widget" || w.Price != 1000 || w.Currency != "usd" || w.Inventorylevel != 5 {
+		t.Errorf("got widget %s at %d %s with %d in stock, want Widget at 1000 usd with 5", w.Name, w.Price, w.Currency, w.Inventorylevel)
+	}
+	if w.StripeProduct != product["id"] || w.PlanId != usd["id"] {
+		t.Errorf("got widget linked to %s, %s, want %s, %s", w.StripeProduct, w.PlanId, product["id"], usd["id"])
+	}
+	if p := db.price(1, "eur"); p.Amount != 900 || p.PlanId != eur["id"] {
+		t.Errorf("got eur price %d linked to %s, want 900 linked to %s", p.Amount, p.PlanId, eur["id"])
+	}
+	if len(stub.prices) != 2 {
+		t.Errorf("sync made %d prices, want none", len(stub.prices)-2)
+	}
+
+	// a new default price made in Stripe is pulled
+	usd2 := stub.addPrice(product["id"].(string), "usd", 2000, "")
+	product["default_price"] = usd2["id"]
+
+	runSync(t, app)
+
+	if w := db.widgets[1]; w.Price != 2000 || w.PlanId != usd2["id"] {
+		t.Errorf("got widget at %d linked to %s, want 2000 linked to %s", w.Price, w.PlanId, usd2["id"])
+	}
+}
+
+func TestPushChangedPrice(t *testing.T) {
+	app, stub, db := newSyncApp(t)
+
+	product := stub.addProduct("Widget", "A very nice widget.")
+	usd := stub.addPrice(product["id"].(string), "usd", 1000, "")
+	stub.addPrice(product["id"].(string), "eur", 900, "")
+	product["default_price"] = usd["id"]
+
+	runSync(t, app)
+
+	// the prices are changed here, as the admin pages do
+	w := *db.widgets[1]
+	w.Price = 1500
+	db.UpdateWidget(w, 0)
+	db.SetWidgetPrice(models.WidgetPrice{WidgetId: 1, Currency: "eur", Amount: 1400})
+
+	runSync(t, app)
+
+	w = *db.widgets[1]
+	if w.Price != 1500 {
+		t.Fatalf("pull overwrote the changed price: got %d, want 1500", w.Price)
+	}
+
+	defaultId, defaultAmount := stub.defaultPrice(product["id"].(string))
+	if defaultAmount != 1500 {
+		t.Errorf("got default price %d, want 1500", defaultAmount)
+	}
+	if w.PlanId != defaultId || w.PlanId == usd["id"] {
+		t.Errorf("got widget linked to %s, want the new price %s", w.PlanId, defaultId)
+	}
+
+	eur := db.price(1, "eur")
+	if eur.Amount != 1400 || eur.PlanId == "" {
+		t.Errorf("got eur price %d linked to %q, want 1400 linked to a new price", eur.Amount, eur.PlanId)
+	}
+	if len(stub.prices) != 4 {
+		t.Errorf("got %d prices, want 4", len(stub.prices))
+	}
+
+	// once pushed nothing changes
+	runSync(t, app)
+
+	if len(stub.prices) != 4 {
+		t.Errorf("syncing again made %d more prices", len(stub.prices)-4)
+	}
+	if got := db.widgets[1]; got.Price != 1500 || got.PlanId != w.PlanId {
+		t.Errorf("syncing again changed the widget to %d linked to %s", got.Price, got.PlanId)
+	}
+}
+
+func TestPushNewWidget(t *testing.T) {
+	app, stub, db := newSyncApp(t)
+
+	db.InsertWidget(models.Widget{Name: "Gold Plan", Price: 3000, Currency: "usd", IsRecurring: true, Active: true})
+	db.SetWidgetPrice(models.WidgetPrice{WidgetId: 1, Currency: "eur", Amount: 2800})
+
+	runSync(t, app)
+
+	if len(stub.products) != 1 || len(stub.prices) != 2 {
+		t.Fatalf("got %d products and %d prices, want 1 and 2", len(stub.products), len(stub.prices))
+	}
+
+	w := db.widgets[1]
+	defaultId, defaultAmount := stub.defaultPrice(w.StripeProduct)
+	if w.StripeProduct != stub.products[0]["id"] || w.PlanId != defaultId || defaultAmount != 3000 {
+		t.Errorf("got widget linked to %s, %s, want %s and its default price", w.StripeProduct, w.PlanId, stub.products[0]["id"])
+	}
+	for _, p := range stub.prices {
+		if recurring, _ := p["recurring"].(map[string]interface{}); recurring["interval"] != "month" {
+			t.Errorf("price %s is billed %v, want monthly", p["id"], recurring["interval"])
+		}
+	}
+	if db.price(1, "eur").PlanId == "" {
+		t.Error("eur price was not pushed")
+	}
+}
+
+func TestPushNewWidgetResumes(t *testing.T) {
+	app, stub, db := newSyncApp(t)
+
+	db.InsertWidget(models.Widget{Name: "Widget", Price: 1000, Currency: "usd", Active: true})
+
+	stub.failPrices = true
+	if err := app.push(); err == nil {
+		t.Fatal("push succeeded though no price could be made")
+	}
+
+	if w := db.widgets[1]; len(stub.products) != 1 || w.StripeProduct != stub.products[0]["id"] {
+		t.Fatalf("got %d products and widget linked to %q, want the one product linked", len(stub.products), w.StripeProduct)
+	}
+
+	stub.failPrices = false
+	runSync(t, app)
+
+	if len(stub.products) != 1 || len(stub.prices) != 1 {
+		t.Fatalf("got %d products and %d prices, want 1 and 1", len(stub.products), len(stub.prices))
+	}
+
+	w := db.widgets[1]
+	defaultId, defaultAmount := stub.defaultPrice(w.StripeProduct)
+	if w.PlanId != defaultId || defaultAmount != 1000 {
+		t.Errorf("got widget linked to %s, want its default price %s at 1000", w.PlanId, defaultId)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
+)
+
+// customerLoginLinkTTL is how many minutes a customer login link can be used for, as
+// signed by the api
+const customerLoginLinkTTL = 15
+
+// AccountLogin shows the form to have a login link emailed
+func (app *application) AccountLogin(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "account-login", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// VerifyCustomerLogin signs a customer in from the link emailed to them
+func (app *application) VerifyCustomerLogin(w http.ResponseWriter, r *http.Request) {
+	testUrl := fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	invalid := func(msg string) {
+		if err := app.renderTemplate(w, r, "account-login", &templateData{
+			Error: msg,
+		}); err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	if !signer.VerifyToken(testUrl) {
+		invalid("This login link is not valid, please ask for a new one")
+		return
+	}
+
+	if signer.Expired(testUrl, customerLoginLinkTTL) {
+		invalid("This login link has expired, please ask for a new one")
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(r.URL.Query().Get("email"))
+	if err != nil {
+		app.errorLog.Println(err)
+		invalid("This login link is not valid, please ask for a new one")
+		return
+	}
+
+	app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "customerId", customer.Id)
+
+	stringMap := make(map[string]string)
+	stringMap["link"] = testUrl
+
+	if err := app.renderTemplate(w, r, "account-verify", &templateData{
+		StringMap: stringMap,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// ConfirmCustomerEmail changes a customer's email from the link emailed to the new one;
+// the api checks the link
+func (app *application) ConfirmCustomerEmail(w http.ResponseWriter, r *http.Request) {
+	stringMap := make(map[string]string)
+	stringMap["link"] = fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	if err := app.renderTemplate(w, r, "account-confirm-email", &templateData{
+		StringMap: stringMap,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AccountLogout signs a customer out of their account
+func (app *application) AccountLogout(w http.ResponseWriter, r *http.Request) {
+	app.Session.Remove(r.Context(), "customerId")
+	app.Session.RenewToken(r.Context())
+
+	http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+}
+
+// Account lists the orders and subscriptions of the signed in customer
+func (app *application) Account(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "account", &templateData{}, "account"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AccountOrder shows one order of the signed in customer
+func (app *application) AccountOrder(w http.ResponseWriter, r *http.Request) {
+	orderId, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	intMap := make(map[string]int)
+	intMap["id"] = orderId
+
+	if err := app.renderTemplate(w, r, "account-order", &templateData{
+		IntMap: intMap,
+	}, "account"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AccountSettings shows the account details of the signed in customer
+func (app *application) AccountSettings(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "account-settings", &templateData{}, "account"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// renewalAuthenticationLinkTTL is how many minutes a link to authenticate a renewal
+// payment can be used for, as signed by the api
+const renewalAuthenticationLinkTTL = 7 * 24 * 60
+
+// AuthenticateRenewal lets a customer authenticate a renewal payment from the link
+// emailed to them
+func (app *application) AuthenticateRenewal(w http.ResponseWriter, r *http.Request) {
+	testUrl := fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["link"] = testUrl
+
+	td := &templateData{
+		StringMap: stringMap,
+	}
+
+	if !signer.VerifyToken(testUrl) {
+		td.Error = "This link is not valid"
+	} else if signer.Expired(testUrl, renewalAuthenticationLinkTTL) {
+		td.Error = "This link has expired, please update your card from your account"
+	}
+
+	if err := app.renderTemplate(w, r, "renewal-authenticate", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// dunningLinkTTL is how many minutes a link to update the card of a subscription whose
+// renewal failed can be used for, as signed by the api
+const dunningLinkTTL = 30 * 24 * 60
+
+// DunningUpdateCard lets a customer pay for a subscription whose renewal failed with
+// another card, from the link emailed to them
+func (app *application) DunningUpdateCard(w http.ResponseWriter, r *http.Request) {
+	testUrl := fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["link"] = testUrl
+
+	td := &templateData{
+		StringMap: stringMap,
+	}
+
+	if !signer.VerifyToken(testUrl) {
+		td.Error = "This link is not valid"
+	} else if signer.Expired(testUrl, dunningLinkTTL) {
+		td.Error = "This link has expired, please update your card from your account"
+	}
+
+	if err := app.renderTemplate(w, r, "dunning-update-card", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/money"
+)
+
+// cartFromSession returns the cart stored in the session, which may be empty
+func (app *application) cartFromSession(r *http.Request) []models.CartItem {
+	cart, ok := app.Session.Get(r.Context(), "cart").([]models.CartItem)
+	if !ok {
+		return nil
+	}
+
+	return cart
+}
+
+// cartCurrency returns the currency the cart is paid in, changing it when the
+// "currency" query parameter names a supported one
+func (app *application) cartCurrency(r *http.Request) string {
+	if currency := r.URL.Query().Get("currency"); currency != "" && money.Supported(currency) {
+		app.Session.Put(r.Context(), "cart_currency", money.Normalize(currency))
+	}
+
+	currency, ok := app.Session.Get(r.Context(), "cart_currency").(string)
+	if !ok {
+		return money.Default
+	}
+
+	return currency
+}
+
+// Cart displays the cart and the form to pay for it
+func (app *application) Cart(w http.ResponseWriter, r *http.Request) {
+	cart := app.cartFromSession(r)
+	currency := app.cartCurrency(r)
+
+	data := make(map[string]interface{})
+	stringMap := make(map[string]string)
+	stringMap["currency"] = currency
+	data["currencies"] = money.Codes()
+	data["saved_cards"] = app.savedCards(r)
+
+	if len(cart) > 0 {
+		items, total, err := app.DB.PriceCart(cart, currency)
+		if err != nil {
+			app.errorLog.Println(err)
+			stringMap["error"] = err.Error()
+		} else {
+			out, err := json.Marshal(cart)
+			if err != nil {
+				app.errorLog.Println(err)
+				return
+			}
+
+			data["items"] = items
+			data["total"] = total
+			stringMap["cart"] = string(out)
+		}
+	}
+
+	if err := app.renderTemplate(w, r, "cart", &templateData{
+		Data:      data,
+		StringMap: stringMap,
+	}, "stripe-js", "address", "currency", "saved-cards"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AddToCart adds a quantity of a widget to the cart
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	widgetId, _ := strconv.Atoi(r.Form.Get("widget_id"))
+	quantity, err := strconv.Atoi(r.Form.Get("quantity"))
+	if err != nil {
+		quantity = 1
+	}
+
+	cart := append(app.cartFromSession(r), models.CartItem{WidgetId: widgetId, Quantity: quantity})
+
+	// price the cart to make sure the new line can be bought, and to merge it with
+	// any line already in the cart for the same widget
+	items, _, err := app.DB.PriceCart(cart, "")
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, item := range items {
+		if !item.Widget.Active {
+			http.Error(w, models.ErrWidgetUnavailable.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	app.putCart(r, items)
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// UpdateCart changes the quantity of a line in the cart; a quantity below one removes it
+func (app *application) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	widgetId, _ := strconv.Atoi(r.Form.Get("widget_id"))
+	quantity, _ := strconv.Atoi(r.Form.Get("quantity"))
+
+	var cart []models.CartItem
+	for _, c := range app.cartFromSession(r) {
+		if c.WidgetId == widgetId {
+			c.Quantity = quantity
+		}
+		if c.Quantity > 0 {
+			cart = append(cart, c)
+		}
+	}
+
+	app.Session.Put(r.Context(), "cart", cart)
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// putCart stores priced items in the session as the cart
+func (app *application) putCart(r *http.Request, items []models.OrderItem) {
+	var cart []models.CartItem
+	for _, item := range items {
+		cart = append(cart, models.CartItem{WidgetId: item.WidgetId, Quantity: item.Quantity})
+	}
+
+	app.Session.Put(r.Context(), "cart", cart)
+}
+
+// CartPaymentSucceeded saves the order for a paid cart and empties the cart
+func (app *application) CartPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	txnData, err := app.GetTransactionData(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	// a payment that was already turned into an order is only shown again
+	if app.showSavedOrder(w, r, txnData) {
+		return
+	}
+
+	// the amount charged must match the catalog price of the cart, in the currency charged
+	items, total, err := app.DB.PriceCart(app.cartFromSession(r), txnData.PaymentCurrency)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.refundPayment(w, r, txnData, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	taxResult, err := app.taxFor(r, total)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.refundPayment(w, r, txnData, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if txnData.PaymentAmount != taxResult.Total {
+		app.errorLog.Printf("payment intent %s charged %d but the cart costs %d",
+			txnData.PaymentIntentId, txnData.PaymentAmount, taxResult.Total)
+		app.refundPayment(w, r, txnData, models.ErrPriceMismatch.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order := models.CartOrder(items, taxResult.Total)
+	setOrderTax(&order, r, taxResult)
+
+	orderId, ok := app.saveOrder(w, r, txnData, order)
+	if !ok {
+		return
+	}
+
+	app.Session.Remove(r.Context(), "cart")
+
+	if token := r.Form.Get("saved_card"); token != "" {
+		app.rememberCard(w, r, token)
+	}
+
+	// call microservice
+	invoice := Invoice{
+		Id:        orderId,
+		Amount:    order.Amount,
+		Currency:  txnData.PaymentCurrency,
+		Product:   "Widgets",
+		Quantity:  order.Quantity,
+		FirstName: txnData.FirstName,
+		LastName:  txnData.LastName,
+		Email:     txnData.Email,
+		CreatedAt: time.Now(),
+		Taxes:     invoiceTaxes(order.Taxes),
+	}
+
+	for _, item := range items {
+		invoice.Items = append(invoice.Items, InvoiceItem{
+			Product:  item.Widget.Name,
+			Quantity: item.Quantity,
+			Amount:   item.Amount,
+		})
+	}
+
+	err = app.callInvoiceMircoservice(invoice)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "receipt", txnData)
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+}
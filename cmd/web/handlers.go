@@ -2,16 +2,20 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/sindrishtepani/go-stripe/internal/cards"
 	"github.com/sindrishtepani/go-stripe/internal/encryption"
 	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/money"
+	"github.com/sindrishtepani/go-stripe/internal/tax"
 	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
 )
 
@@ -56,27 +60,23 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	email := r.Form.Get("cardholder-email")
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
-	paymentAmount := r.Form.Get("payment_amount")
-	paymentCurrency := r.Form.Get("payment_currency")
-	amount, _ := strconv.Atoi(paymentAmount)
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(paymentIntent)
+	pi, err := app.Gateway.RetrievePaymentIntent(paymentIntent)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
 	}
 
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	pm, err := app.Gateway.GetPaymentMethod(paymentMethod)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
 	}
 
+	// the amount and currency come from Stripe rather than the posted form
+	amount := int(pi.Amount)
+	paymentCurrency := pi.Currency
+
 	lastFour := pm.Card.Last4
 	expiryMonth := pm.Card.ExpMonth
 	expiryYear := pm.Card.ExpYear
@@ -103,11 +103,69 @@ type Invoice struct {
 	Id        int       `json:"id"`
 	Quantity  int       `json:"quantity"`
 	Amount    int       `json:"amount"`
+	Currency  string    `json:"currency"`
 	Product   string    `json:"product"`
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
+	// Items lists the lines of a multi-line order
+	Items []InvoiceItem `json:"items,omitempty"`
+	// Taxes lists the taxes charged; Amount includes any that are not inclusive
+	Taxes []InvoiceTax `json:"taxes,omitempty"`
+}
+
+// InvoiceItem is one line of an invoice
+type InvoiceItem struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+	Amount   int    `json:"amount"`
+}
+
+// InvoiceTax is one tax line of an invoice
+type InvoiceTax struct {
+	Name      string  `json:"name"`
+	Rate      float64 `json:"rate"`
+	Inclusive bool    `json:"inclusive"`
+	Amount    int     `json:"amount"`
+}
+
+// invoiceTaxes returns the invoice lines for the taxes charged on an order
+func invoiceTaxes(taxes []models.OrderTax) []InvoiceTax {
+	var lines []InvoiceTax
+	for _, t := range taxes {
+		lines = append(lines, InvoiceTax{
+			Name:      t.Name,
+			Rate:      t.Rate,
+			Inclusive: t.Inclusive,
+			Amount:    t.Amount,
+		})
+	}
+	return lines
+}
+
+// taxFor works out the tax on amount for the address and email posted with a payment
+func (app *application) taxFor(r *http.Request, amount int) (tax.Result, error) {
+	country, region := taxAddress(r)
+	return app.Tax.Calculate(tax.Request{
+		Customer: r.Form.Get("cardholder-email"),
+		Country:  country,
+		Region:   region,
+		Amount:   amount,
+	})
+}
+
+// taxAddress returns the country and region posted with a payment
+func taxAddress(r *http.Request) (string, string) {
+	return strings.ToUpper(strings.TrimSpace(r.Form.Get("country"))),
+		strings.ToUpper(strings.TrimSpace(r.Form.Get("region")))
+}
+
+// setOrderTax records the tax charged on an order and where the customer was taxed
+func setOrderTax(order *models.Order, r *http.Request, result tax.Result) {
+	order.Tax = result.Tax
+	order.Country, order.Region = taxAddress(r)
+	order.Taxes = models.OrderTaxes(result)
 }
 
 func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request) {
@@ -118,65 +176,85 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	}
 
 	widgetId, _ := strconv.Atoi(r.Form.Get("product_id"))
+	quantity, err := strconv.Atoi(r.Form.Get("quantity"))
+	if err != nil {
+		quantity = 1
+	}
+
 	txnData, err := app.GetTransactionData(r)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
 
-	// create new customer
-	customerId, err := app.SaveCustomer(txnData.FirstName, txnData.LastName, txnData.Email)
+	// a payment that was already turned into an order is only shown again
+	if app.showSavedOrder(w, r, txnData) {
+		return
+	}
+
+	// the amount charged must match the catalog price of what is being bought, less the
+	// coupon redeemed when the payment intent was made
+	_, expected, err := app.DB.WidgetTotal(widgetId, quantity, txnData.PaymentCurrency)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.refundPayment(w, r, txnData, "this product could not be found", http.StatusBadRequest)
 		return
 	}
 
-	app.infoLog.Println(customerId)
-
-	// create a new transaction
-
-	txn := models.Transaction{
-		Amount:              txnData.PaymentAmount,
-		Currency:            txnData.PaymentCurrency,
-		LastFour:            txnData.LastFour,
-		ExpiryMonth:         txnData.ExpiryMonth,
-		ExpiryYear:          txnData.ExpiryYear,
-		BankReturnCode:      txnData.BankReturnCode,
-		PaymentIntent:       txnData.PaymentIntentId,
-		PaymentMethod:       txnData.PaymentMethodId,
-		TransactionStatusId: 2,
+	coupon, err := app.DB.GetCouponReservation(txnData.PaymentIntentId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorLog.Println(err)
+		app.refundPayment(w, r, txnData, "your coupon could not be checked", http.StatusInternalServerError)
+		return
 	}
+	expected -= coupon.Discount
 
-	txnId, err := app.SaveTransaction(txn)
+	taxResult, err := app.taxFor(r, expected)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.refundPayment(w, r, txnData, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expected = taxResult.Total
+
+	if txnData.PaymentAmount != expected {
+		app.errorLog.Printf("payment intent %s charged %d but widget %d x %d costs %d",
+			txnData.PaymentIntentId, txnData.PaymentAmount, widgetId, quantity, expected)
+		app.refundPayment(w, r, txnData, models.ErrPriceMismatch.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// create a new order
 	order := models.Order{
-		WidgetId:      widgetId,
-		TransactionId: txnId,
-		CustomerId:    customerId,
-		StatusId:      1,
-		Quantity:      1,
-		Amount:        txnData.PaymentAmount,
-	}
-	orderId, err := app.SaveOrder(order)
-	if err != nil {
-		app.errorLog.Println(err)
+		WidgetId: widgetId,
+		StatusId: models.StatusCleared,
+		Quantity: quantity,
+		Amount:   expected,
+		CouponId: coupon.CouponId,
+		Discount: coupon.Discount,
+	}
+	setOrderTax(&order, r, taxResult)
+
+	orderId, ok := app.saveOrder(w, r, txnData, order)
+	if !ok {
+		return
+	}
+
+	if token := r.Form.Get("saved_card"); token != "" {
+		app.rememberCard(w, r, token)
 	}
 
 	// call microservice
 	invoice := Invoice{
 		Id:        orderId,
 		Amount:    order.Amount,
+		Currency:  txnData.PaymentCurrency,
 		Product:   "Widget",
 		Quantity:  order.Quantity,
 		FirstName: txnData.FirstName,
 		LastName:  txnData.LastName,
 		Email:     txnData.Email,
 		CreatedAt: time.Now(),
+		Taxes:     invoiceTaxes(order.Taxes),
 	}
 
 	err = app.callInvoiceMircoservice(invoice)
@@ -190,6 +268,82 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
 }
 
+// showSavedOrder redirects to the receipt when the payment intent in txnData already has
+// an order, and reports whether it wrote a response. If the order cannot be looked up an
+// error is written, since the payment must not be refunded or charged for twice.
+func (app *application) showSavedOrder(w http.ResponseWriter, r *http.Request, txnData TransactionData) bool {
+	_, err := app.DB.GetOrderIdByPaymentIntent(txnData.PaymentIntentId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, "your order could not be checked", http.StatusInternalServerError)
+		return true
+	}
+
+	app.Session.Put(r.Context(), "receipt", txnData)
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+	return true
+}
+
+// refundPayment gives back a payment that will not be turned into an order and releases
+// the stock and coupon held for it, then writes msg to w with status, or that the refund
+// failed. A payment that already has an order, such as one saved by a concurrent post of
+// the same payment intent, is never refunded; its receipt is shown instead.
+func (app *application) refundPayment(w http.ResponseWriter, r *http.Request, txnData TransactionData, msg string, status int) {
+	if app.showSavedOrder(w, r, txnData) {
+		return
+	}
+
+	err := app.DB.ReleasePayment(txnData.PaymentIntentId)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	_, err = app.Gateway.Refund(txnData.PaymentIntentId, txnData.PaymentAmount, txnData.PaymentIntentId+"-compensation")
+	if err != nil {
+		app.errorLog.Printf("could not refund unsaved payment %s: %s", txnData.PaymentIntentId, err)
+		http.Error(w, "your payment was taken but the order could not be saved", http.StatusInternalServerError)
+		return
+	}
+
+	http.Error(w, msg+"; your payment has been refunded", status)
+}
+
+// saveOrder saves a paid order together with its customer and transaction. If that
+// fails the payment is refunded, an error is written to w and ok is false.
+func (app *application) saveOrder(w http.ResponseWriter, r *http.Request, txnData TransactionData, order models.Order) (int, bool) {
+	customer := models.Customer{
+		FirstName: txnData.FirstName,
+		LastName:  txnData.LastName,
+		Email:     txnData.Email,
+	}
+
+	txn := models.Transaction{
+		Amount:              txnData.PaymentAmount,
+		Currency:            txnData.PaymentCurrency,
+		LastFour:            txnData.LastFour,
+		ExpiryMonth:         txnData.ExpiryMonth,
+		ExpiryYear:          txnData.ExpiryYear,
+		BankReturnCode:      txnData.BankReturnCode,
+		PaymentIntent:       txnData.PaymentIntentId,
+		PaymentMethod:       txnData.PaymentMethodId,
+		TransactionStatusId: models.TransactionCleared,
+	}
+
+	// customer, transaction and order are saved together or not at all
+	orderId, err := app.DB.CreateOrderWithTransaction(customer, txn, order)
+	if err != nil {
+		app.errorLog.Println(err)
+		// the card was charged but we have nothing to show for it, so give the money back
+		app.refundPayment(w, r, txnData, "your order could not be saved", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	return orderId, true
+}
+
 func (app *application) callInvoiceMircoservice(invoice Invoice) error {
 	url := "http://localhost:5000/invoice/create-and-send"
 	out, err := json.MarshalIndent(invoice, "", "\t")
@@ -222,6 +376,11 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
+	// a payment that was already saved is only shown again
+	if app.showSavedTransaction(w, r, txnData) {
+		return
+	}
+
 	// create a new transaction
 
 	txn := models.Transaction{
@@ -239,6 +398,10 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 	_, err = app.SaveTransaction(txn)
 	if err != nil {
 		app.errorLog.Println(err)
+		// a concurrent post of the same payment intent may have saved it first
+		if !app.showSavedTransaction(w, r, txnData) {
+			http.Error(w, "your payment could not be saved", http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -247,6 +410,24 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 	http.Redirect(w, r, "/virtual-terminal-receipt", http.StatusSeeOther)
 }
 
+// showSavedTransaction redirects to the virtual terminal receipt when the payment intent
+// in txnData has already been saved, and reports whether it wrote a response
+func (app *application) showSavedTransaction(w http.ResponseWriter, r *http.Request, txnData TransactionData) bool {
+	_, err := app.DB.GetTransactionIdByPaymentIntent(txnData.PaymentIntentId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, "your payment could not be checked", http.StatusInternalServerError)
+		return true
+	}
+
+	app.Session.Put(r.Context(), "receipt", txnData)
+	http.Redirect(w, r, "/virtual-terminal-receipt", http.StatusSeeOther)
+	return true
+}
+
 func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	txn := app.Session.Get(r.Context(), "receipt").(TransactionData)
 
@@ -277,21 +458,6 @@ func (app *application) VirtualTerminalReceipt(w http.ResponseWriter, r *http.Re
 	}
 }
 
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
 func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	id, err := app.DB.InsertTransaction(txn)
 	if err != nil {
@@ -301,21 +467,24 @@ func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	return id, nil
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
 func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 
 	widgetId, _ := strconv.Atoi(id)
 
 	widget, err := app.DB.GetWidget(widgetId)
+	if err != nil || !widget.Active || widget.IsRecurring {
+		http.NotFound(w, r)
+		return
+	}
+
+	available, err := app.DB.AvailableInventory(widgetId)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	widget, err = app.widgetInCurrency(r, widget)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
@@ -323,16 +492,31 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 
 	data := make(map[string]interface{})
 	data["widget"] = widget
+	data["in_stock"] = available > 0
+	data["currencies"] = widget.Currencies()
+	data["saved_cards"] = app.savedCards(r)
 
 	if err := app.renderTemplate(w, r, "buy-once", &templateData{
-		Data: data,
-	}, "stripe-js"); err != nil {
+		Data:      data,
+		StringMap: map[string]string{"currency": widget.Currency},
+	}, "stripe-js", "coupon", "address", "currency", "saved-cards"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
-	widget, err := app.DB.GetWidget(2)
+// Plan displays the subscription form for a recurring widget
+func (app *application) Plan(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetId, _ := strconv.Atoi(id)
+
+	widget, err := app.DB.GetWidget(widgetId)
+	// a subscription without a Stripe price cannot be sold until it has been synced
+	if err != nil || !widget.Active || !widget.IsRecurring || widget.PlanId == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	widget, err = app.widgetInCurrency(r, widget)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
@@ -340,20 +524,66 @@ func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
 
 	data := make(map[string]interface{})
 	data["widget"] = widget
+	data["currencies"] = widget.Currencies()
+	data["saved_cards"] = app.savedCards(r)
 
-	if err := app.renderTemplate(w, r, "bronze-plan", &templateData{
-		Data: data,
-	}); err != nil {
+	if err := app.renderTemplate(w, r, "plan", &templateData{
+		Data:      data,
+		StringMap: map[string]string{"currency": widget.Currency},
+	}, "coupon", "address", "currency", "saved-cards"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-func (app *application) BronzePlanReceipt(w http.ResponseWriter, r *http.Request) {
+// widgetInCurrency loads the currencies a widget is sold in and prices it in the one named
+// by the "currency" query parameter, or in its own when that is missing or not offered.
+// Subscriptions are only offered in currencies that have a Stripe price.
+func (app *application) widgetInCurrency(r *http.Request, widget models.Widget) (models.Widget, error) {
+	prices, err := app.DB.GetWidgetPrices(widget.Id)
+	if err != nil {
+		return widget, err
+	}
+
+	for _, p := range prices {
+		if !widget.IsRecurring || p.PlanId != "" {
+			widget.Prices = append(widget.Prices, p)
+		}
+	}
+
+	currency := money.Normalize(r.URL.Query().Get("currency"))
+	for _, c := range widget.Currencies() {
+		if c == currency {
+			return app.DB.InCurrency(widget, currency)
+		}
+	}
+
+	return widget, nil
+}
+
+func (app *application) PlanReceipt(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "receipt-plan", &templateData{}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
+// Catalog lists the widgets that can be bought
+func (app *application) Catalog(w http.ResponseWriter, r *http.Request) {
+	widgets, err := app.DB.GetAllWidgets(true)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["widgets"] = widgets
+
+	if err := app.renderTemplate(w, r, "catalog", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) LoginPage(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "login", &templateData{}); err != nil {
 		app.errorLog.Println(err)
@@ -372,16 +602,55 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
+	// failed sign ins here count toward the same lockouts as those through the api
+	attempt := []models.LockoutSubject{models.IPSubject(models.RemoteIP(r.RemoteAddr)), models.AccountSubject(email)}
+	until, err := app.DB.CheckLockout(attempt...)
+	if err != nil || !until.IsZero() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
 	id, err := app.DB.Authenticate(email, password)
 	if err != nil {
+		app.failedLogin(attempt...)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// the api only issues a token to users with two-factor authentication once they
+	// have entered their code, so the token the login page was given proves they did
+	twoFactor, err := app.DB.GetTwoFactor(id)
+	if err != nil {
+		app.errorLog.Println(err)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	if twoFactor.Enabled() {
+		user, err := app.DB.GetUserByToken(r.Form.Get("token"))
+		if err != nil || user.Id != id {
+			app.failedLogin(attempt...)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+	}
+
+	err = app.DB.ClearFailures(attempt...)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
 
 	app.Session.Put(r.Context(), "userId", id)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// failedLogin counts a failed sign in against subjects
+func (app *application) failedLogin(subjects ...models.LockoutSubject) {
+	_, err := app.DB.RecordFailure(subjects...)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 	app.Session.Destroy(r.Context())
 	app.Session.RenewToken(r.Context())
@@ -459,6 +728,7 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap["refund-btn"] = "Refund Order"
 	stringMap["refunded-badge"] = "Refunded"
 	stringMap["refunded-msg"] = "Charge Refunded"
+	stringMap["partial-refunds"] = "true"
 
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
@@ -474,9 +744,10 @@ func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request)
 	stringMap["cancel"] = "/admin/all-subscriptions"
 
 	stringMap["refund-url"] = "/api/admin/cancel-subscription"
-	stringMap["refund-btn"] = "Cancel Subscription"
+	stringMap["refund-btn"] = "Cancel at Period End"
 	stringMap["refunded-badge"] = "Cancelled"
 	stringMap["refunded-msg"] = "Subscription Cancelled"
+	stringMap["subscription"] = "true"
 
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
@@ -496,3 +767,56 @@ func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 		app.errorLog.Println(err)
 	}
 }
+
+// TwoFactor shows the signed in user's two-factor authentication, where they set it up
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "two-factor", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Lockouts shows the addresses and accounts with recent failed sign ins, with a button
+// to clear each
+func (app *application) Lockouts(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "lockouts", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AllAPIKeys shows the api keys, with a button to revoke each
+func (app *application) AllAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-api-keys", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// NewAPIKey shows the form an api key is created with
+func (app *application) NewAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "api-key", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) AllWidgets(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-widgets", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) OneWidget(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "one-widget", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) AllDisputes(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-disputes", &templateData{}, "dispute"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) OneDispute(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "dispute", &templateData{}, "dispute"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -8,12 +8,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
+	"github.com/sindrishtepani/go-stripe/internal/cards"
 	"github.com/sindrishtepani/go-stripe/internal/driver"
 	"github.com/sindrishtepani/go-stripe/internal/models"
+	"github.com/sindrishtepani/go-stripe/internal/tax"
 )
 
 const version = "1.0.0"
@@ -30,11 +33,15 @@ type config struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret    string
+		key       string
+		gateway   string
+		backend   string
+		fakeState string
 	}
 	secretkey string
 	frontend  string
+	tax       string
 }
 
 type application struct {
@@ -45,6 +52,8 @@ type application struct {
 	version       string
 	DB            models.DBModel
 	Session       *scs.SessionManager
+	Gateway       cards.Gateway
+	Tax           tax.Calculator
 }
 
 func (app *application) serve() error {
@@ -66,14 +75,19 @@ func main() {
 	var cfg config
 
 	gob.Register(TransactionData{})
+	gob.Register([]models.CartItem{})
 
 	flag.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {developement, production}")
+	flag.StringVar(&cfg.stripe.gateway, "gateway", "stripe", "Payment gateway {stripe, fake}")
+	flag.StringVar(&cfg.stripe.backend, "stripe-backend", "", "Stripe API base URL (defaults to api.stripe.com)")
+	flag.StringVar(&cfg.stripe.fakeState, "fake-state", filepath.Join(os.TempDir(), "go-stripe-fake.json"), "file the fake gateway keeps its state in, shared by the front and back end")
 	flag.StringVar(&cfg.db.dsn, "dsn", "sshtepan:1234@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "DSN")
 	flag.StringVar(&cfg.api, "api", "http://localhost:4001", "URL to api")
 
 	flag.StringVar(&cfg.secretkey, "secret", "MRKLO5E2I7DMN0DQJADXGMPVL4N3O5FQ", "secret key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "front end path")
+	flag.StringVar(&cfg.tax, "tax", "rules", "Tax calculator {rules, none}")
 
 	flag.Parse()
 
@@ -83,12 +97,24 @@ func main() {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	gateway, err := cards.NewGateway(cfg.stripe.gateway, cfg.stripe.secret, cfg.stripe.key, cfg.stripe.backend, cfg.stripe.fakeState)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
 		errorLog.Fatal(err)
 	}
 	defer conn.Close()
 
+	db := models.DBModel{DB: conn}
+
+	calculator, err := db.NewTaxCalculator(cfg.tax)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
 	session.Store = mysqlstore.New(conn)
@@ -101,8 +127,10 @@ func main() {
 		errorLog:      errorLog,
 		templateCache: tc,
 		version:       version,
-		DB:            models.DBModel{DB: conn},
+		DB:            db,
 		Session:       session,
+		Gateway:       gateway,
+		Tax:           calculator,
 	}
 
 	go app.ListenToWsChannel()
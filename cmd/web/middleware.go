@@ -1,6 +1,19 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+
+	"github.com/sindrishtepani/go-stripe/internal/models"
+)
+
+type contextKey string
+
+// userContextKey holds the admin user a request was made by
+const userContextKey = contextKey("user")
+
+// twoFactorPath is the page admin users set up two-factor authentication on
+const twoFactorPath = "/admin/two-factor"
 
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
@@ -12,6 +25,55 @@ func (app *application) Auth(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 			return
 		}
+
+		// the role is read on every request, so a change to it applies straight away
+		user, err := app.DB.GetOneUser(app.Session.GetInt(r.Context(), "userId"))
+		if err != nil {
+			app.errorLog.Println(err)
+			app.Session.Remove(r.Context(), "userId")
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+
+		// users who have to set up two-factor authentication can do nothing else first
+		if user.TwoFactorPending() && r.URL.Path != twoFactorPath {
+			http.Redirect(w, r, twoFactorPath, http.StatusTemporaryRedirect)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, &user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequirePermission lets through admin users whose role gives them permission; it goes
+// after Auth
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := authenticatedUser(r)
+			if user == nil || !user.Can(permission) {
+				http.Error(w, "you do not have permission to view this page", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authenticatedUser returns the user set by Auth, or nil on routes without it
+func authenticatedUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value(userContextKey).(*models.User)
+	return user
+}
+
+// CustomerAuth sends customers who have not signed in to their account to the account login
+func (app *application) CustomerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Session.Exists(r.Context(), "customerId") {
+			http.Redirect(w, r, "/account/login", http.StatusTemporaryRedirect)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -6,33 +6,55 @@ import (
 	"html/template"
 	"net/http"
 	"strings"
+
+	"github.com/sindrishtepani/go-stripe/internal/money"
 )
 
 type templateData struct {
-	StringMap            map[string]string
-	IntMap               map[string]int
-	FloatMap             map[string]float32
-	Data                 map[string]interface{}
-	CSRFToken            string
-	Flash                string
-	Warning              string
-	Error                string
-	IsAuthenticated      int
-	UserId               int
+	StringMap       map[string]string
+	IntMap          map[string]int
+	FloatMap        map[string]float32
+	Data            map[string]interface{}
+	CSRFToken       string
+	Flash           string
+	Warning         string
+	Error           string
+	IsAuthenticated int
+	UserId          int
+	// Permissions are the names of the permissions the signed in admin user's role gives them
+	Permissions          []string
 	API                  string
 	CSSVersion           string
 	StripeSecretKey      string
 	StripePublishableKey string
 }
 
-var functions = template.FuncMap{
-	"formatCurrency": formatCurrency,
+// Can reports whether the signed in admin user may do what permission allows, so that
+// pages leave out what they cannot
+func (td *templateData) Can(permission string) bool {
+	for _, p := range td.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
 }
 
-func formatCurrency(n int) string {
-	f := float32(n) / float32(100)
+var functions = template.FuncMap{
+	"formatCurrency":   money.Format,
+	"currencyDecimals": currencyDecimals,
+	"currencyCodes":    money.Codes,
+	"upper":            strings.ToUpper,
+}
 
-	return fmt.Sprintf("$%.2f", f)
+// currencyDecimals maps each supported currency to its number of decimals, so that
+// scripts format amounts the same way templates do
+func currencyDecimals() map[string]int {
+	decimals := make(map[string]int)
+	for _, code := range money.Codes() {
+		decimals[code] = money.Decimals(code)
+	}
+	return decimals
 }
 
 //go:embed templates
@@ -47,6 +69,16 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 		userId := app.Session.Get(r.Context(), "userId").(int)
 		td.IsAuthenticated = 1
 		td.UserId = userId
+
+		if user := authenticatedUser(r); user != nil {
+			td.Permissions = user.Permissions
+		} else {
+			permissions, err := app.DB.GetUserPermissions(userId)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+			td.Permissions = permissions
+		}
 	} else {
 		td.IsAuthenticated = 0
 		td.UserId = 0
@@ -99,11 +131,10 @@ func (app *application) parseTemplate(partials []string, page, templateToRender
 	}
 
 	if len(partials) > 0 {
+		files := append([]string{"templates/base.layout.gohtml"}, partials...)
 		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).
 			Funcs(functions).
-			ParseFS(templateFS,
-				"templates/base.layout.gohtml",
-				strings.Join(partials, ","), templateToRender)
+			ParseFS(templateFS, append(files, templateToRender)...)
 	} else {
 		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).
 			Funcs(functions).
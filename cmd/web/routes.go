@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/sindrishtepani/go-stripe/internal/models"
 )
 
 func (app *application) routes() http.Handler {
@@ -16,23 +17,60 @@ func (app *application) routes() http.Handler {
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
 
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
+		mux.Get("/two-factor", app.TwoFactor)
 
-		mux.Get("/sales/{id}", app.ShowSale)
-		mux.Get("/subscriptions/{id}", app.ShowSubscription)
+		mux.With(app.RequirePermission(models.PermissionVirtualTerminal)).Get("/virtual-terminal", app.VirtualTerminal)
 
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewSales))
+
+			mux.Get("/all-sales", app.AllSales)
+			mux.Get("/all-subscriptions", app.AllSubscriptions)
+
+			mux.Get("/sales/{id}", app.ShowSale)
+			mux.Get("/subscriptions/{id}", app.ShowSubscription)
+
+			mux.Get("/disputes", app.AllDisputes)
+			mux.Get("/disputes/{id}", app.OneDispute)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageUsers))
+
+			mux.Get("/all-users", app.AllUsers)
+			mux.Get("/all-users/{id}", app.OneUser)
+			mux.Get("/lockouts", app.Lockouts)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageAPIKeys))
+
+			mux.Get("/api-keys", app.AllAPIKeys)
+			mux.Get("/api-keys/new", app.NewAPIKey)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageWidgets))
+
+			mux.Get("/all-widgets", app.AllWidgets)
+			mux.Get("/all-widgets/{id}", app.OneWidget)
+		})
 	})
 
 	mux.Get("/widget/{id}", app.ChargeOnce)
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/receipt", app.Receipt)
 
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
+	mux.Get("/cart", app.Cart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/update", app.UpdateCart)
+	mux.Post("/cart/payment-succeeded", app.CartPaymentSucceeded)
+
+	mux.Get("/catalog", app.Catalog)
+	mux.Get("/plans/{id}", app.Plan)
+	mux.Get("/receipt/plan", app.PlanReceipt)
+	mux.Get("/subscriptions/authenticate", app.AuthenticateRenewal)
+	mux.Get("/subscriptions/update-card", app.DunningUpdateCard)
 
 	// auth routes
 	mux.Get("/login", app.LoginPage)
@@ -41,6 +79,22 @@ func (app *application) routes() http.Handler {
 	mux.Get("/forgot-password", app.ForgotPassword)
 	mux.Get("/reset-password", app.ShowResetPassword)
 
+	// customer account routes
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Get("/login", app.AccountLogin)
+		mux.Get("/verify", app.VerifyCustomerLogin)
+		mux.Get("/confirm-email", app.ConfirmCustomerEmail)
+		mux.Get("/logout", app.AccountLogout)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.CustomerAuth)
+
+			mux.Get("/", app.Account)
+			mux.Get("/orders/{id}", app.AccountOrder)
+			mux.Get("/settings", app.AccountSettings)
+		})
+	})
+
 	fileServer := http.FileServer(http.Dir("./static"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/urlsigner"
+)
+
+// savedCardsCookie holds the saved card tokens of the cards saved in this browser; it
+// outlives the session so a returning customer can pay without entering their card
+const savedCardsCookie = "saved_cards"
+
+// maxSavedCards is how many saved cards a browser remembers, newest first
+const maxSavedCards = 5
+
+// SavedCard is a card saved in this browser that can be paid with again
+type SavedCard struct {
+	Token         string
+	PaymentMethod string
+	Brand         string
+	LastFour      string
+	ExpiryMonth   int
+	ExpiryYear    int
+}
+
+// savedCardTokens returns the saved card tokens kept in the browser
+func savedCardTokens(r *http.Request) []string {
+	cookie, err := r.Cookie(savedCardsCookie)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	return strings.Split(cookie.Value, "|")
+}
+
+// savedCard checks a saved card token issued by the api and returns the card it is for,
+// or false if the token is forged or the card has been removed from the customer
+func (app *application) savedCard(token string) (SavedCard, bool) {
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	data, ok := signer.Data(token)
+	if !ok {
+		return SavedCard{}, false
+	}
+
+	u, err := url.Parse(data)
+	if err != nil || u.Path != "saved-card" {
+		return SavedCard{}, false
+	}
+
+	pm, err := app.Gateway.GetPaymentMethod(u.Query().Get("pm"))
+	if err != nil {
+		app.errorLog.Println(err)
+		return SavedCard{}, false
+	}
+	if pm.Customer == nil || pm.Customer.ID != u.Query().Get("customer") || pm.Card == nil {
+		return SavedCard{}, false
+	}
+
+	return SavedCard{
+		Token:         token,
+		PaymentMethod: pm.ID,
+		Brand:         string(pm.Card.Brand),
+		LastFour:      pm.Card.Last4,
+		ExpiryMonth:   int(pm.Card.ExpMonth),
+		ExpiryYear:    int(pm.Card.ExpYear),
+	}, true
+}
+
+// savedCards returns the cards saved in this browser that can still be paid with
+func (app *application) savedCards(r *http.Request) []SavedCard {
+	var cards []SavedCard
+	for _, token := range savedCardTokens(r) {
+		if card, ok := app.savedCard(token); ok {
+			cards = append(cards, card)
+		}
+	}
+
+	return cards
+}
+
+// rememberCard keeps a saved card token in the browser, ahead of the cards already kept
+func (app *application) rememberCard(w http.ResponseWriter, r *http.Request, token string) {
+	if _, ok := app.savedCard(token); !ok {
+		app.errorLog.Println("not remembering an invalid saved card")
+		return
+	}
+
+	tokens := []string{token}
+	for _, t := range savedCardTokens(r) {
+		if t != token && len(tokens) < maxSavedCards {
+			tokens = append(tokens, t)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     savedCardsCookie,
+		Value:    strings.Join(tokens, "|"),
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
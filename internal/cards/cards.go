@@ -1,18 +1,81 @@
 package cards
 
 import (
+	"fmt"
+	"io"
+	"time"
+
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/paymentintent"
-	"github.com/stripe/stripe-go/v72/paymentmethod"
-	"github.com/stripe/stripe-go/v72/refund"
-	"github.com/stripe/stripe-go/v72/sub"
+	"github.com/stripe/stripe-go/v72/client"
 )
 
+// Gateway is the set of payment operations the handlers rely on
+type Gateway interface {
+	Charge(currency string, amount int, idempotencyKey string) (*stripe.PaymentIntent, string, error)
+	RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error)
+	GetPaymentMethod(s string) (*stripe.PaymentMethod, error)
+	CreateCustomer(pm, email, idempotencyKey string) (*stripe.Customer, string, error)
+	CreateSetupIntent(customerId, idempotencyKey string) (*stripe.SetupIntent, error)
+	RetrieveSetupIntent(id string) (*stripe.SetupIntent, error)
+	AttachPaymentMethod(pm, customerId string) (*stripe.PaymentMethod, error)
+	ChargeSavedCard(currency string, amount int, customerId, pm, idempotencyKey string) (*stripe.PaymentIntent, string, error)
+	UpdateCustomerEmail(customerId, email string) (*stripe.Customer, error)
+	SubscribeToPlan(cust *stripe.Customer, pm, plan, email, last4, cardType string, trialDays int, promotionCode string, taxRates []string, idempotencyKey string) (*stripe.Subscription, error)
+	Refund(pi string, amount int, idempotencyKey string) (*stripe.Refund, error)
+	CancelSubscription(subId string) error
+	ChangeSubscriptionPlan(subId, plan string) (*stripe.Subscription, error)
+	PauseSubscription(subId string) (*stripe.Subscription, error)
+	ResumeSubscription(subId string) (*stripe.Subscription, error)
+	ReactivateSubscription(subId string) (*stripe.Subscription, error)
+	CancelSubscriptionNow(subId string) (*stripe.Subscription, error)
+	UpdateSubscriptionCard(subId, pm string) (*stripe.Subscription, error)
+	RetrieveSubscription(subId string) (*stripe.Subscription, error)
+	RetrieveInvoice(id string) (*stripe.Invoice, error)
+	PayInvoice(id string) (*stripe.Invoice, error)
+	CreatePromotionCode(code string, percentOff, amountOff int, currency string, maxRedemptions int, expiresAt time.Time) (*stripe.PromotionCode, error)
+	CreateTaxRate(name, country, region string, rate float64, inclusive bool) (*stripe.TaxRate, error)
+	UploadDisputeFile(name string, r io.Reader) (*stripe.File, error)
+	SubmitDisputeEvidence(disputeId string, evidence DisputeEvidence) (*stripe.Dispute, error)
+}
+
+// NewGateway returns the gateway named by kind; "stripe" talks to the Stripe API
+// (or to backendURL when it is set) and "fake" keeps everything in the file fakeState,
+// or in memory when it is empty
+func NewGateway(kind, secret, key, backendURL, fakeState string) (Gateway, error) {
+	switch kind {
+	case "stripe":
+		return NewCard(secret, key, backendURL), nil
+	case "fake":
+		return newFake(fakeState), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", kind)
+	}
+}
+
 type Card struct {
 	Secret   string
 	Key      string
 	Currency string
+	client   *client.API
+}
+
+// NewCard returns a Card with its own Stripe client, so concurrent cards with
+// different keys never share state. An empty backendURL uses the Stripe API.
+func NewCard(secret, key, backendURL string) *Card {
+	var backends *stripe.Backends
+	if backendURL != "" {
+		backends = &stripe.Backends{
+			API:     stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{URL: stripe.String(backendURL)}),
+			Connect: stripe.GetBackendWithConfig(stripe.ConnectBackend, &stripe.BackendConfig{URL: stripe.String(backendURL)}),
+			Uploads: stripe.GetBackendWithConfig(stripe.UploadsBackend, &stripe.BackendConfig{URL: stripe.String(backendURL)}),
+		}
+	}
+
+	return &Card{
+		Secret: secret,
+		Key:    key,
+		client: client.New(secret, backends),
+	}
 }
 
 type Transaction struct {
@@ -23,21 +86,23 @@ type Transaction struct {
 	BankReturnCode      string
 }
 
-func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.createPaymentIntent(currency, amount)
+func (c *Card) Charge(currency string, amount int, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
+	return c.createPaymentIntent(currency, amount, idempotencyKey)
 }
 
-func (c *Card) createPaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	stripe.Key = c.Secret
-
+func (c *Card) createPaymentIntent(currency string, amount int, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
 	// create a payment intent
 	params := &stripe.PaymentIntentParams{
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(currency),
 	}
 
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+
 	//params.AddMetadata("key", "value")
-	pi, err := paymentintent.New(params)
+	pi, err := c.client.PaymentIntents.New(params)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -50,9 +115,7 @@ func (c *Card) createPaymentIntent(currency string, amount int) (*stripe.Payment
 }
 
 func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
-	stripe.Key = c.Secret
-
-	pm, err := paymentmethod.Get(s, nil)
+	pm, err := c.client.PaymentMethods.Get(s, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -60,31 +123,50 @@ func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
 }
 
 func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
-	stripe.Key = c.Secret
-
-	pi, err := paymentintent.Get(id, nil)
+	pi, err := c.client.PaymentIntents.Get(id, nil)
 	if err != nil {
 		return nil, err
 	}
 	return pi, nil
 }
 
-func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+// SubscribeToPlan subscribes a customer to a plan paid with the card pm, starting with a
+// free trial when trialDays is set, applying promotionCode, a Stripe promotion code id,
+// when it is set and charging the Stripe tax rates in taxRates on every invoice. A first
+// payment that needs 3-D Secure leaves the subscription incomplete, with the payment
+// intent of its latest invoice waiting for the customer.
+func (c *Card) SubscribeToPlan(cust *stripe.Customer, pm, plan, email, last4, cardType string, trialDays int, promotionCode string, taxRates []string, idempotencyKey string) (*stripe.Subscription, error) {
 	stripeCustomerId := cust.ID
 	items := []*stripe.SubscriptionItemsParams{
 		{Plan: stripe.String(plan)},
 	}
 
 	params := &stripe.SubscriptionParams{
-		Customer: stripe.String(stripeCustomerId),
-		Items:    items,
+		Customer:             stripe.String(stripeCustomerId),
+		Items:                items,
+		DefaultPaymentMethod: stripe.String(pm),
+		PaymentBehavior:      stripe.String("allow_incomplete"),
+	}
+
+	if trialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(trialDays))
+	}
+	if promotionCode != "" {
+		params.PromotionCode = stripe.String(promotionCode)
+	}
+	if len(taxRates) > 0 {
+		params.DefaultTaxRates = stripe.StringSlice(taxRates)
 	}
 
 	params.AddMetadata("last_four", last4)
 	params.AddMetadata("card_type", cardType)
 	params.AddExpand("latest_invoice.payment_intent")
+	params.AddExpand("pending_setup_intent")
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
 
-	subscription, err := sub.New(params)
+	subscription, err := c.client.Subscriptions.New(params)
 	if err != nil {
 		return nil, err
 	}
@@ -93,17 +175,22 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 
 }
 
-func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
-	stripe.Key = c.Secret
+// CreateCustomer creates a Stripe customer, with pm as their default card when it is set
+func (c *Card) CreateCustomer(pm, email, idempotencyKey string) (*stripe.Customer, string, error) {
 	customerParams := &stripe.CustomerParams{
-		PaymentMethod: stripe.String(pm),
-		Email:         stripe.String(email),
-		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+		Email: stripe.String(email),
+	}
+	if pm != "" {
+		customerParams.PaymentMethod = stripe.String(pm)
+		customerParams.InvoiceSettings = &stripe.CustomerInvoiceSettingsParams{
 			DefaultPaymentMethod: stripe.String(pm),
-		},
+		}
+	}
+	if idempotencyKey != "" {
+		customerParams.SetIdempotencyKey(idempotencyKey)
 	}
 
-	cust, err := customer.New(customerParams)
+	cust, err := c.client.Customers.New(customerParams)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -115,31 +202,32 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 	return cust, "", nil
 }
 
-func (c *Card) Refund(pi string, amount int) error {
-	stripe.Key = c.Secret
+func (c *Card) Refund(pi string, amount int, idempotencyKey string) (*stripe.Refund, error) {
 	amountToRefund := int64(amount)
 
 	refundParams := &stripe.RefundParams{
 		Amount:        &amountToRefund,
 		PaymentIntent: &pi,
 	}
+	if idempotencyKey != "" {
+		refundParams.SetIdempotencyKey(idempotencyKey)
+	}
 
-	_, err := refund.New(refundParams)
+	refund, err := c.client.Refunds.New(refundParams)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return refund, nil
 }
 
+// CancelSubscription cancels a subscription at the end of the period already paid for
 func (c *Card) CancelSubscription(subId string) error {
-	stripe.Key = c.Secret
-
 	params := &stripe.SubscriptionParams{
 		CancelAtPeriodEnd: stripe.Bool(true),
 	}
 
-	_, err := sub.Update(subId, params)
+	_, err := c.client.Subscriptions.Update(subId, params)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,123 @@
+package cards
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stripeStub answers payment intent and payment method requests the way the Stripe API
+// does, naming everything after the secret key it was made with
+func stripeStub(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			amount, _ := strconv.Atoi(r.Form.Get("amount"))
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":       "pi_" + secret,
+				"object":   "payment_intent",
+				"amount":   amount,
+				"currency": r.Form.Get("currency"),
+				"status":   "requires_payment_method",
+				"metadata": map[string]string{"idempotency_key": r.Header.Get("Idempotency-Key")},
+			})
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/payment_methods/"):
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":     strings.TrimPrefix(r.URL.Path, "/v1/payment_methods/"),
+				"object": "payment_method",
+				"type":   "card",
+				"card":   map[string]interface{}{"brand": "visa", "last4": secret[len(secret)-4:]},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error":{"type":"invalid_request_error","message":"Unrecognized request URL (%s: %s)"}}`, r.Method, r.URL.Path)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestCardUsesBackendURL(t *testing.T) {
+	srv := stripeStub(t)
+	card := NewCard("sk_test_1234", "pk_test_1234", srv.URL)
+
+	pi, msg, err := card.Charge("usd", 1000, "order-1")
+	if err != nil {
+		t.Fatalf("charge: %v (%s)", err, msg)
+	}
+	if pi.ID != "pi_sk_test_1234" || pi.Amount != 1000 || pi.Currency != "usd" {
+		t.Errorf("got payment intent %s for %d %s, want pi_sk_test_1234 for 1000 usd", pi.ID, pi.Amount, pi.Currency)
+	}
+	if pi.Metadata["idempotency_key"] != "order-1" {
+		t.Errorf("got idempotency key %q, want order-1", pi.Metadata["idempotency_key"])
+	}
+
+	pm, err := card.GetPaymentMethod("pm_1")
+	if err != nil {
+		t.Fatalf("get payment method: %v", err)
+	}
+	if pm.ID != "pm_1" || pm.Card.Last4 != "1234" {
+		t.Errorf("got payment method %s ending %s, want pm_1 ending 1234", pm.ID, pm.Card.Last4)
+	}
+
+	_, err = card.RetrievePaymentIntent("pi_missing")
+	if err == nil {
+		t.Error("retrieving a payment intent the backend does not have did not fail")
+	}
+}
+
+// TestCardsConcurrentKeys makes calls from many Cards at once, each with its own secret
+// key, and checks every call was made with the key of the Card it was made from. Run it
+// with -race.
+func TestCardsConcurrentKeys(t *testing.T) {
+	srv := stripeStub(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			secret := fmt.Sprintf("sk_test_%04d", i)
+			card := NewCard(secret, "pk_test", srv.URL)
+
+			for j := 0; j < 5; j++ {
+				pi, _, err := card.Charge("usd", 100*(i+1), "")
+				if err != nil {
+					t.Errorf("card %d: charge: %v", i, err)
+					return
+				}
+				if pi.ID != "pi_"+secret || pi.Amount != int64(100*(i+1)) {
+					t.Errorf("card %d: got payment intent %s for %d, want pi_%s for %d", i, pi.ID, pi.Amount, secret, 100*(i+1))
+				}
+
+				pm, err := card.GetPaymentMethod("pm_1")
+				if err != nil {
+					t.Errorf("card %d: get payment method: %v", i, err)
+					return
+				}
+				if want := secret[len(secret)-4:]; pm.Card.Last4 != want {
+					t.Errorf("card %d: got card ending %s, want %s", i, pm.Card.Last4, want)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,92 @@
+package cards
+
+import (
+	"fmt"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// Catalog is the set of product and price operations used to keep the widgets
+// table in step with Stripe
+type Catalog interface {
+	ListProducts() ([]*stripe.Product, error)
+	ListPrices() ([]*stripe.Price, error)
+	CreateProduct(name, description string) (*stripe.Product, error)
+	CreatePrice(productId, currency string, amount int, interval string) (*stripe.Price, error)
+	SetDefaultPrice(productId, priceId string) error
+}
+
+// NewCatalog returns the catalog named by kind, as NewGateway does for payments
+func NewCatalog(kind, secret, key, backendURL, fakeState string) (Catalog, error) {
+	switch kind {
+	case "stripe":
+		return NewCard(secret, key, backendURL), nil
+	case "fake":
+		return newFake(fakeState), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", kind)
+	}
+}
+
+// ListProducts lists every product, active or not
+func (c *Card) ListProducts() ([]*stripe.Product, error) {
+	var products []*stripe.Product
+
+	i := c.client.Products.List(&stripe.ProductListParams{})
+	for i.Next() {
+		products = append(products, i.Product())
+	}
+
+	return products, i.Err()
+}
+
+// ListPrices lists every price, active or not
+func (c *Card) ListPrices() ([]*stripe.Price, error) {
+	var prices []*stripe.Price
+
+	i := c.client.Prices.List(&stripe.PriceListParams{})
+	for i.Next() {
+		prices = append(prices, i.Price())
+	}
+
+	return prices, i.Err()
+}
+
+func (c *Card) CreateProduct(name, description string) (*stripe.Product, error) {
+	params := &stripe.ProductParams{
+		Name: stripe.String(name),
+	}
+	if description != "" {
+		params.Description = stripe.String(description)
+	}
+
+	return c.client.Products.New(params)
+}
+
+// CreatePrice creates a price for a product; an empty interval creates a one-time price
+func (c *Card) CreatePrice(productId, currency string, amount int, interval string) (*stripe.Price, error) {
+	params := &stripe.PriceParams{
+		Product:    stripe.String(productId),
+		Currency:   stripe.String(currency),
+		UnitAmount: stripe.Int64(int64(amount)),
+	}
+	if interval != "" {
+		params.Recurring = &stripe.PriceRecurringParams{
+			Interval: stripe.String(interval),
+		}
+	}
+
+	return c.client.Prices.New(params)
+}
+
+// SetDefaultPrice makes a price the one a product is sold at
+func (c *Card) SetDefaultPrice(productId, priceId string) error {
+	_, err := c.client.Products.Update(productId, &stripe.ProductParams{
+		DefaultPrice: stripe.String(priceId),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
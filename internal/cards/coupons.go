@@ -0,0 +1,41 @@
+package cards
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// CreatePromotionCode creates a Stripe coupon taking percentOff percent or amountOff
+// off the next invoice, and a promotion code for it that customers type in as code.
+// A maxRedemptions of 0 and a zero expiresAt mean no limit.
+func (c *Card) CreatePromotionCode(code string, percentOff, amountOff int, currency string, maxRedemptions int, expiresAt time.Time) (*stripe.PromotionCode, error) {
+	couponParams := &stripe.CouponParams{
+		Name:     stripe.String(code),
+		Duration: stripe.String(string(stripe.CouponDurationOnce)),
+	}
+	if percentOff > 0 {
+		couponParams.PercentOff = stripe.Float64(float64(percentOff))
+	} else {
+		couponParams.AmountOff = stripe.Int64(int64(amountOff))
+		couponParams.Currency = stripe.String(currency)
+	}
+
+	coupon, err := c.client.Coupons.New(couponParams)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.PromotionCodeParams{
+		Coupon: stripe.String(coupon.ID),
+		Code:   stripe.String(code),
+	}
+	if maxRedemptions > 0 {
+		params.MaxRedemptions = stripe.Int64(int64(maxRedemptions))
+	}
+	if !expiresAt.IsZero() {
+		params.ExpiresAt = stripe.Int64(expiresAt.Unix())
+	}
+
+	return c.client.PromotionCodes.New(params)
+}
@@ -0,0 +1,68 @@
+package cards
+
+import (
+	"github.com/stripe/stripe-go/v72"
+)
+
+// CreateSetupIntent starts saving a card on a Stripe customer, to be charged again later
+// without the card being entered; the browser confirms it with the card details
+func (c *Card) CreateSetupIntent(customerId, idempotencyKey string) (*stripe.SetupIntent, error) {
+	params := &stripe.SetupIntentParams{
+		Customer:           stripe.String(customerId),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		Usage:              stripe.String(string(stripe.SetupIntentUsageOffSession)),
+	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+
+	return c.client.SetupIntents.New(params)
+}
+
+func (c *Card) RetrieveSetupIntent(id string) (*stripe.SetupIntent, error) {
+	return c.client.SetupIntents.Get(id, nil)
+}
+
+// AttachPaymentMethod saves a card on a Stripe customer without making it the
+// customer's default, so it is only charged where it is asked for
+func (c *Card) AttachPaymentMethod(pm, customerId string) (*stripe.PaymentMethod, error) {
+	params := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerId),
+	}
+
+	return c.client.PaymentMethods.Attach(pm, params)
+}
+
+// ChargeSavedCard creates a payment intent for a card saved on a Stripe customer;
+// the browser confirms it, so the bank can still ask the customer to authenticate
+func (c *Card) ChargeSavedCard(currency string, amount int, customerId, pm, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(int64(amount)),
+		Currency:      stripe.String(currency),
+		Customer:      stripe.String(customerId),
+		PaymentMethod: stripe.String(pm),
+	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+
+	pi, err := c.client.PaymentIntents.New(params)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return nil, msg, err
+	}
+
+	return pi, "", nil
+}
+
+// UpdateCustomerEmail changes the email Stripe sends a customer's receipts to
+func (c *Card) UpdateCustomerEmail(customerId, email string) (*stripe.Customer, error) {
+	params := &stripe.CustomerParams{
+		Email: stripe.String(email),
+	}
+
+	return c.client.Customers.Update(customerId, params)
+}
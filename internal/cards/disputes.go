@@ -0,0 +1,50 @@
+package cards
+
+import (
+	"io"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// DisputeEvidence is what we send the cardholder's bank to contest a dispute. Text is an
+// explanation in our own words; the others are ids of files uploaded with UploadDisputeFile
+// and may be empty.
+type DisputeEvidence struct {
+	Text                  string
+	Receipt               string
+	CustomerCommunication string
+	Uncategorized         string
+}
+
+// UploadDisputeFile uploads a file to use as evidence for a dispute
+func (c *Card) UploadDisputeFile(name string, r io.Reader) (*stripe.File, error) {
+	params := &stripe.FileParams{
+		FileReader: r,
+		Filename:   stripe.String(name),
+		Purpose:    stripe.String(string(stripe.FilePurposeDisputeEvidence)),
+	}
+
+	return c.client.Files.New(params)
+}
+
+// SubmitDisputeEvidence sends evidence for a dispute to the bank. Evidence can only be
+// submitted once, so everything has to be sent together.
+func (c *Card) SubmitDisputeEvidence(disputeId string, evidence DisputeEvidence) (*stripe.Dispute, error) {
+	params := &stripe.DisputeParams{
+		Evidence: &stripe.DisputeEvidenceParams{
+			UncategorizedText: stripe.String(evidence.Text),
+		},
+		Submit: stripe.Bool(true),
+	}
+	if evidence.Receipt != "" {
+		params.Evidence.Receipt = stripe.String(evidence.Receipt)
+	}
+	if evidence.CustomerCommunication != "" {
+		params.Evidence.CustomerCommunication = stripe.String(evidence.CustomerCommunication)
+	}
+	if evidence.Uncategorized != "" {
+		params.Evidence.UncategorizedFile = stripe.String(evidence.Uncategorized)
+	}
+
+	return c.client.Disputes.Update(disputeId, params)
+}
@@ -0,0 +1,975 @@
+package cards
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// Fake is a deterministic Gateway for running payment flows offline. Its state is kept in
+// memory, or in a file when it is opened with OpenFake, so that the api and the front end
+// can share it.
+type Fake struct {
+	mu sync.Mutex
+
+	// the card returned for every payment method
+	cardBrand   string
+	lastFour    string
+	expiryMonth int
+	expiryYear  int
+
+	declineCode                stripe.ErrorCode
+	declineAmounts             map[int]stripe.ErrorCode
+	declinePaymentMethods      map[string]stripe.ErrorCode
+	authenticatePaymentMethods map[string]bool
+
+	// path is the file the state is shared through; it is empty for a Fake kept in memory
+	path       string
+	unlockFile func() error
+	// saveErr is a failure to save the state, returned by the next call
+	saveErr error
+
+	state fakeState
+}
+
+// fakeState is everything a Fake remembers between calls
+type fakeState struct {
+	Seq            int                              `json:"seq"`
+	PaymentIntents map[string]*stripe.PaymentIntent `json:"payment_intents"`
+	Customers      map[string]*stripe.Customer      `json:"customers"`
+	SetupIntents   map[string]*stripe.SetupIntent   `json:"setup_intents"`
+	// Attached maps payment methods to the customers they are saved on
+	Attached      map[string]string               `json:"attached"`
+	Subscriptions map[string]*stripe.Subscription `json:"subscriptions"`
+	Invoices      map[string]*stripe.Invoice      `json:"invoices"`
+	Disputes      map[string]*stripe.Dispute      `json:"disputes"`
+	Refunds       map[string]*stripe.Refund       `json:"refunds"`
+	// Refunded is the amount refunded so far on each payment intent
+	Refunded map[string]int64 `json:"refunded"`
+	// Replays maps idempotency keys to the id of what was made with them
+	Replays  map[string]string `json:"replays"`
+	Products []*stripe.Product `json:"products"`
+	Prices   []*stripe.Price   `json:"prices"`
+}
+
+// init makes the maps a state read from an empty, or older, file is missing
+func (s *fakeState) init() {
+	if s.PaymentIntents == nil {
+		s.PaymentIntents = make(map[string]*stripe.PaymentIntent)
+	}
+	if s.Customers == nil {
+		s.Customers = make(map[string]*stripe.Customer)
+	}
+	if s.SetupIntents == nil {
+		s.SetupIntents = make(map[string]*stripe.SetupIntent)
+	}
+	if s.Attached == nil {
+		s.Attached = make(map[string]string)
+	}
+	if s.Subscriptions == nil {
+		s.Subscriptions = make(map[string]*stripe.Subscription)
+	}
+	if s.Invoices == nil {
+		s.Invoices = make(map[string]*stripe.Invoice)
+	}
+	if s.Disputes == nil {
+		s.Disputes = make(map[string]*stripe.Dispute)
+	}
+	if s.Refunds == nil {
+		s.Refunds = make(map[string]*stripe.Refund)
+	}
+	if s.Refunded == nil {
+		s.Refunded = make(map[string]int64)
+	}
+	if s.Replays == nil {
+		s.Replays = make(map[string]string)
+	}
+}
+
+// NewFake returns a Fake, kept in memory, that approves everything with a visa ending in
+// 4242
+func NewFake() *Fake {
+	f := &Fake{
+		cardBrand:                  string(stripe.PaymentMethodCardBrandVisa),
+		lastFour:                   "4242",
+		expiryMonth:                12,
+		expiryYear:                 2030,
+		declineAmounts:             make(map[int]stripe.ErrorCode),
+		declinePaymentMethods:      make(map[string]stripe.ErrorCode),
+		authenticatePaymentMethods: make(map[string]bool),
+	}
+	f.state.init()
+
+	return f
+}
+
+// OpenFake returns a Fake like NewFake whose state is kept in the file at path, so that
+// every process opening the same file sees the same payment intents, customers and
+// subscriptions. The file is created on first use.
+func OpenFake(path string) *Fake {
+	f := NewFake()
+	f.path = path
+
+	return f
+}
+
+// newFake opens the Fake kept in the file at path, or a new one kept in memory when path
+// is empty
+func newFake(path string) *Fake {
+	if path == "" {
+		return NewFake()
+	}
+	return OpenFake(path)
+}
+
+// SetCard sets the card returned for every payment method
+func (f *Fake) SetCard(brand, lastFour string, expiryMonth, expiryYear int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cardBrand = brand
+	f.lastFour = lastFour
+	f.expiryMonth = expiryMonth
+	f.expiryYear = expiryYear
+}
+
+// Decline declines every charge and customer creation with code; an empty code approves
+// them again
+func (f *Fake) Decline(code stripe.ErrorCode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.declineCode = code
+}
+
+// DeclineAmount declines charges for amount with code
+func (f *Fake) DeclineAmount(amount int, code stripe.ErrorCode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.declineAmounts[amount] = code
+}
+
+// DeclinePaymentMethod declines customer creation, and saving, with the payment method pm
+func (f *Fake) DeclinePaymentMethod(pm string, code stripe.ErrorCode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.declinePaymentMethods[pm] = code
+}
+
+// RequireAuthentication leaves the first payment of subscriptions paid with the payment
+// method pm waiting for 3-D Secure
+func (f *Fake) RequireAuthentication(pm string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.authenticatePaymentMethods[pm] = true
+}
+
+// lock takes f.mu and, for a Fake kept in a file, locks the file and reads the state other
+// processes have saved
+func (f *Fake) lock() error {
+	f.mu.Lock()
+	if f.path == "" {
+		return nil
+	}
+
+	if f.saveErr != nil {
+		err := f.saveErr
+		f.saveErr = nil
+		f.mu.Unlock()
+		return err
+	}
+
+	unlockFile, err := lockFile(f.path + ".lock")
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+
+	err = f.load()
+	if err != nil {
+		unlockFile()
+		f.mu.Unlock()
+		return err
+	}
+	f.unlockFile = unlockFile
+
+	return nil
+}
+
+// unlock saves the state, for a Fake kept in a file, and releases the locks lock took
+func (f *Fake) unlock() {
+	if f.path != "" {
+		f.saveErr = f.save()
+		err := f.unlockFile()
+		if f.saveErr == nil {
+			f.saveErr = err
+		}
+		f.unlockFile = nil
+	}
+	f.mu.Unlock()
+}
+
+// load reads the state from f.path; callers hold the file lock
+func (f *Fake) load() error {
+	var state fakeState
+
+	data, err := os.ReadFile(f.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return fmt.Errorf("reading fake gateway state %s: %w", f.path, err)
+		}
+	}
+	state.init()
+	f.state = state
+
+	return nil
+}
+
+// save writes the state to f.path, replacing the file so that it is never read half
+// written; callers hold the file lock
+func (f *Fake) save() error {
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// nextId returns a sequential id with the given prefix; callers hold the lock
+func (f *Fake) nextId(prefix string) string {
+	f.state.Seq++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.state.Seq)
+}
+
+func (f *Fake) Charge(currency string, amount int, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
+	if err := f.lock(); err != nil {
+		return nil, "", err
+	}
+	defer f.unlock()
+
+	return f.charge(currency, amount, idempotencyKey)
+}
+
+// charge makes a payment intent for amount; callers hold the lock
+func (f *Fake) charge(currency string, amount int, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
+	if pi, ok := f.state.PaymentIntents[f.replay(idempotencyKey)]; ok {
+		return pi, "", nil
+	}
+
+	code := f.declineCode
+	if c, ok := f.declineAmounts[amount]; ok {
+		code = c
+	}
+	if code != "" {
+		return nil, cardErrorMessage(code), fakeError(code)
+	}
+
+	id := f.nextId("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Amount:       int64(amount),
+		Currency:     currency,
+		ClientSecret: id + "_secret",
+		Created:      time.Now().Unix(),
+		Status:       stripe.PaymentIntentStatusSucceeded,
+		Charges: &stripe.ChargeList{
+			Data: []*stripe.Charge{
+				{ID: f.nextId("ch"), Amount: int64(amount), Currency: stripe.Currency(currency), Paid: true},
+			},
+		},
+	}
+	f.state.PaymentIntents[id] = pi
+	f.remember(idempotencyKey, id)
+
+	return pi, "", nil
+}
+
+func (f *Fake) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	pi, ok := f.state.PaymentIntents[id]
+	if !ok {
+		return nil, fakeMissing("payment_intent", id)
+	}
+	return pi, nil
+}
+
+func (f *Fake) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	return f.paymentMethod(s), nil
+}
+
+// paymentMethod describes the card pm and the customer it is saved on; callers hold the lock
+func (f *Fake) paymentMethod(pm string) *stripe.PaymentMethod {
+	paymentMethod := &stripe.PaymentMethod{
+		ID:   pm,
+		Type: stripe.PaymentMethodTypeCard,
+		Card: &stripe.PaymentMethodCard{
+			Brand:    stripe.PaymentMethodCardBrand(f.cardBrand),
+			Last4:    f.lastFour,
+			ExpMonth: uint64(f.expiryMonth),
+			ExpYear:  uint64(f.expiryYear),
+		},
+	}
+	if customerId, ok := f.state.Attached[pm]; ok {
+		paymentMethod.Customer = f.state.Customers[customerId]
+	}
+	return paymentMethod
+}
+
+func (f *Fake) CreateCustomer(pm, email, idempotencyKey string) (*stripe.Customer, string, error) {
+	if err := f.lock(); err != nil {
+		return nil, "", err
+	}
+	defer f.unlock()
+
+	if cust, ok := f.state.Customers[f.replay(idempotencyKey)]; ok {
+		return cust, "", nil
+	}
+
+	code := f.declineCode
+	if c, ok := f.declinePaymentMethods[pm]; ok {
+		code = c
+	}
+	if code != "" {
+		return nil, cardErrorMessage(code), fakeError(code)
+	}
+
+	cust := &stripe.Customer{
+		ID:              f.nextId("cus"),
+		Email:           email,
+		InvoiceSettings: &stripe.CustomerInvoiceSettings{},
+	}
+	if pm != "" {
+		cust.InvoiceSettings.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm}
+		f.state.Attached[pm] = cust.ID
+	}
+	f.state.Customers[cust.ID] = cust
+	f.remember(idempotencyKey, cust.ID)
+
+	return cust, "", nil
+}
+
+// CreateSetupIntent saves a new card on the customer straight away, as if the browser had
+// confirmed it
+func (f *Fake) CreateSetupIntent(customerId, idempotencyKey string) (*stripe.SetupIntent, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	if si, ok := f.state.SetupIntents[f.replay(idempotencyKey)]; ok {
+		return si, nil
+	}
+
+	cust, ok := f.state.Customers[customerId]
+	if !ok {
+		return nil, fakeMissing("customer", customerId)
+	}
+
+	id := f.nextId("seti")
+	pm := f.nextId("pm")
+	f.state.Attached[pm] = customerId
+
+	si := &stripe.SetupIntent{
+		ID:            id,
+		ClientSecret:  id + "_secret",
+		Customer:      cust,
+		PaymentMethod: &stripe.PaymentMethod{ID: pm},
+		Status:        stripe.SetupIntentStatusSucceeded,
+		Usage:         stripe.SetupIntentUsageOffSession,
+	}
+	f.state.SetupIntents[id] = si
+	f.remember(idempotencyKey, id)
+
+	return si, nil
+}
+
+func (f *Fake) RetrieveSetupIntent(id string) (*stripe.SetupIntent, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	si, ok := f.state.SetupIntents[id]
+	if !ok {
+		return nil, fakeMissing("setup_intent", id)
+	}
+	return si, nil
+}
+
+func (f *Fake) AttachPaymentMethod(pm, customerId string) (*stripe.PaymentMethod, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	if _, ok := f.state.Customers[customerId]; !ok {
+		return nil, fakeMissing("customer", customerId)
+	}
+	if code, ok := f.declinePaymentMethods[pm]; ok {
+		return nil, fakeError(code)
+	}
+
+	f.state.Attached[pm] = customerId
+
+	return f.paymentMethod(pm), nil
+}
+
+func (f *Fake) ChargeSavedCard(currency string, amount int, customerId, pm, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
+	if err := f.lock(); err != nil {
+		return nil, "", err
+	}
+	defer f.unlock()
+
+	if owner, ok := f.state.Attached[pm]; !ok || owner != customerId {
+		return nil, "", fakeMissing("payment_method", pm)
+	}
+
+	pi, msg, err := f.charge(currency, amount, idempotencyKey)
+	if err != nil {
+		return nil, msg, err
+	}
+
+	pi.Customer = f.state.Customers[customerId]
+	pi.PaymentMethod = &stripe.PaymentMethod{ID: pm}
+
+	return pi, "", nil
+}
+
+func (f *Fake) UpdateCustomerEmail(customerId, email string) (*stripe.Customer, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	cust, ok := f.state.Customers[customerId]
+	if !ok {
+		return nil, fakeMissing("customer", customerId)
+	}
+	cust.Email = email
+
+	return cust, nil
+}
+
+func (f *Fake) SubscribeToPlan(cust *stripe.Customer, pm, plan, email, last4, cardType string, trialDays int, promotionCode string, taxRates []string, idempotencyKey string) (*stripe.Subscription, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	if subscription, ok := f.state.Subscriptions[f.replay(idempotencyKey)]; ok {
+		return subscription, nil
+	}
+
+	if _, ok := f.state.Customers[cust.ID]; !ok {
+		return nil, fakeMissing("customer", cust.ID)
+	}
+
+	subscription := &stripe.Subscription{
+		ID:                   f.nextId("sub"),
+		Customer:             cust,
+		DefaultPaymentMethod: &stripe.PaymentMethod{ID: pm},
+		Status:               stripe.SubscriptionStatusActive,
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{Plan: &stripe.Plan{ID: plan}},
+			},
+		},
+		Metadata: map[string]string{
+			"last_four": last4,
+			"card_type": cardType,
+		},
+	}
+	if trialDays > 0 {
+		subscription.Status = stripe.SubscriptionStatusTrialing
+		subscription.TrialStart = time.Now().Unix()
+		subscription.TrialEnd = time.Now().AddDate(0, 0, trialDays).Unix()
+	}
+	if promotionCode != "" {
+		subscription.Discount = &stripe.Discount{PromotionCode: &stripe.PromotionCode{ID: promotionCode}}
+	}
+	for _, id := range taxRates {
+		subscription.DefaultTaxRates = append(subscription.DefaultTaxRates, &stripe.TaxRate{ID: id})
+	}
+	if f.authenticatePaymentMethods[pm] && trialDays == 0 {
+		pi := &stripe.PaymentIntent{
+			ID:      f.nextId("pi"),
+			Created: time.Now().Unix(),
+			Status:  stripe.PaymentIntentStatusRequiresAction,
+		}
+		pi.ClientSecret = pi.ID + "_secret"
+		f.state.PaymentIntents[pi.ID] = pi
+
+		// the invoice only has the id of its subscription, as Stripe returns it, so that
+		// the state has no cycles to trip up saving it
+		invoice := &stripe.Invoice{
+			ID:            f.nextId("in"),
+			Subscription:  &stripe.Subscription{ID: subscription.ID},
+			PaymentIntent: pi,
+			BillingReason: stripe.InvoiceBillingReasonSubscriptionCreate,
+		}
+		f.state.Invoices[invoice.ID] = invoice
+
+		subscription.Status = stripe.SubscriptionStatusIncomplete
+		subscription.LatestInvoice = invoice
+	}
+	f.state.Subscriptions[subscription.ID] = subscription
+	f.remember(idempotencyKey, subscription.ID)
+
+	return subscription, nil
+}
+
+func (f *Fake) Refund(pi string, amount int, idempotencyKey string) (*stripe.Refund, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	if refund, ok := f.state.Refunds[f.replay(idempotencyKey)]; ok {
+		return refund, nil
+	}
+
+	intent, ok := f.state.PaymentIntents[pi]
+	if !ok {
+		return nil, fakeMissing("payment_intent", pi)
+	}
+
+	if f.state.Refunded[pi]+int64(amount) > intent.Amount {
+		return nil, &stripe.Error{
+			Code:           stripe.ErrorCodeAmountTooLarge,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            "Refund amount is greater than unrefunded amount on charge",
+			Type:           stripe.ErrorTypeInvalidRequest,
+		}
+	}
+	f.state.Refunded[pi] += int64(amount)
+
+	refund := &stripe.Refund{
+		ID:            f.nextId("re"),
+		Amount:        int64(amount),
+		Currency:      stripe.Currency(intent.Currency),
+		PaymentIntent: intent,
+		Status:        stripe.RefundStatusSucceeded,
+		Created:       time.Now().Unix(),
+	}
+	f.state.Refunds[refund.ID] = refund
+	f.remember(idempotencyKey, refund.ID)
+
+	return refund, nil
+}
+
+func (f *Fake) CancelSubscription(subId string) error {
+	if err := f.lock(); err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	subscription, ok := f.state.Subscriptions[subId]
+	if !ok {
+		return fakeMissing("subscription", subId)
+	}
+	subscription.CancelAtPeriodEnd = true
+
+	return nil
+}
+
+func (f *Fake) ChangeSubscriptionPlan(subId, plan string) (*stripe.Subscription, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	subscription, ok := f.state.Subscriptions[subId]
+	if !ok {
+		return nil, fakeMissing("subscription", subId)
+	}
+	subscription.Items.Data[0].Plan = &stripe.Plan{ID: plan}
+
+	return subscription, nil
+}
+
+func (f *Fake) PauseSubscription(subId string) (*stripe.Subscription, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	subscription, ok := f.state.Subscriptions[subId]
+	if !ok {
+		return nil, fakeMissing("subscription", subId)
+	}
+	subscription.PauseCollection.Behavior = stripe.SubscriptionPauseCollectionBehaviorVoid
+
+	return subscription, nil
+}
+
+func (f *Fake) ResumeSubscription(subId string) (*stripe.Subscription, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	subscription, ok := f.state.Subscriptions[subId]
+	if !ok {
+		return nil, fakeMissing("subscription", subId)
+	}
+	subscription.PauseCollection = stripe.SubscriptionPauseCollection{}
+
+	return subscription, nil
+}
+
+func (f *Fake) ReactivateSubscription(subId string) (*stripe.Subscription, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	subscription, ok := f.state.Subscriptions[subId]
+	if !ok {
+		return nil, fakeMissing("subscription", subId)
+	}
+	subscription.CancelAtPeriodEnd = false
+
+	return subscription, nil
+}
+
+func (f *Fake) CancelSubscriptionNow(subId string) (*stripe.Subscription, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	subscription, ok := f.state.Subscriptions[subId]
+	if !ok {
+		return nil, fakeMissing("subscription", subId)
+	}
+	subscription.Status = stripe.SubscriptionStatusCanceled
+	subscription.CanceledAt = time.Now().Unix()
+
+	return subscription, nil
+}
+
+func (f *Fake) UpdateSubscriptionCard(subId, pm string) (*stripe.Subscription, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	subscription, ok := f.state.Subscriptions[subId]
+	if !ok {
+		return nil, fakeMissing("subscription", subId)
+	}
+	if code, ok := f.declinePaymentMethods[pm]; ok {
+		return nil, fakeError(code)
+	}
+
+	f.state.Attached[pm] = subscription.Customer.ID
+	subscription.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm}
+
+	return subscription, nil
+}
+
+func (f *Fake) RetrieveSubscription(subId string) (*stripe.Subscription, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	subscription, ok := f.state.Subscriptions[subId]
+	if !ok {
+		return nil, fakeMissing("subscription", subId)
+	}
+	return subscription, nil
+}
+
+func (f *Fake) RetrieveInvoice(id string) (*stripe.Invoice, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	invoice, ok := f.state.Invoices[id]
+	if !ok {
+		return nil, fakeMissing("invoice", id)
+	}
+	return invoice, nil
+}
+
+func (f *Fake) PayInvoice(id string) (*stripe.Invoice, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	invoice, ok := f.state.Invoices[id]
+	if !ok {
+		return nil, fakeMissing("invoice", id)
+	}
+
+	if invoice.Subscription != nil {
+		subscription, ok := f.state.Subscriptions[invoice.Subscription.ID]
+		if ok && subscription.DefaultPaymentMethod != nil {
+			if code, ok := f.declinePaymentMethods[subscription.DefaultPaymentMethod.ID]; ok {
+				return nil, fakeError(code)
+			}
+		}
+	}
+
+	invoice.Paid = true
+	invoice.Status = stripe.InvoiceStatusPaid
+	invoice.AmountPaid = invoice.AmountDue
+
+	return invoice, nil
+}
+
+func (f *Fake) CreatePromotionCode(code string, percentOff, amountOff int, currency string, maxRedemptions int, expiresAt time.Time) (*stripe.PromotionCode, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	coupon := &stripe.Coupon{
+		ID:         f.nextId("coupon"),
+		Name:       code,
+		Duration:   stripe.CouponDurationOnce,
+		PercentOff: float64(percentOff),
+	}
+	if percentOff == 0 {
+		coupon.AmountOff = int64(amountOff)
+		coupon.Currency = stripe.Currency(currency)
+	}
+
+	promotionCode := &stripe.PromotionCode{
+		ID:             f.nextId("promo"),
+		Active:         true,
+		Code:           code,
+		Coupon:         coupon,
+		MaxRedemptions: int64(maxRedemptions),
+	}
+	if !expiresAt.IsZero() {
+		promotionCode.ExpiresAt = expiresAt.Unix()
+	}
+
+	return promotionCode, nil
+}
+
+func (f *Fake) CreateTaxRate(name, country, region string, rate float64, inclusive bool) (*stripe.TaxRate, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	return &stripe.TaxRate{
+		ID:          f.nextId("txr"),
+		Active:      true,
+		Country:     country,
+		State:       region,
+		DisplayName: name,
+		Percentage:  rate,
+		Inclusive:   inclusive,
+	}, nil
+}
+
+func (f *Fake) UploadDisputeFile(name string, r io.Reader) (*stripe.File, error) {
+	size, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	return &stripe.File{
+		ID:       f.nextId("file"),
+		Filename: name,
+		Purpose:  stripe.FilePurposeDisputeEvidence,
+		Size:     size,
+	}, nil
+}
+
+func (f *Fake) SubmitDisputeEvidence(disputeId string, evidence DisputeEvidence) (*stripe.Dispute, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	if _, ok := f.state.Disputes[disputeId]; ok {
+		return nil, &stripe.Error{
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("Evidence for dispute %s has already been submitted", disputeId),
+			Type:           stripe.ErrorTypeInvalidRequest,
+		}
+	}
+
+	dispute := &stripe.Dispute{
+		ID:     disputeId,
+		Status: stripe.DisputeStatusUnderReview,
+		Evidence: &stripe.DisputeEvidence{
+			UncategorizedText: evidence.Text,
+		},
+	}
+	f.state.Disputes[disputeId] = dispute
+
+	return dispute, nil
+}
+
+func (f *Fake) ListProducts() ([]*stripe.Product, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	return append([]*stripe.Product(nil), f.state.Products...), nil
+}
+
+func (f *Fake) ListPrices() ([]*stripe.Price, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	return append([]*stripe.Price(nil), f.state.Prices...), nil
+}
+
+func (f *Fake) CreateProduct(name, description string) (*stripe.Product, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	product := &stripe.Product{
+		ID:          f.nextId("prod"),
+		Name:        name,
+		Description: description,
+		Active:      true,
+	}
+	f.state.Products = append(f.state.Products, product)
+
+	return product, nil
+}
+
+func (f *Fake) CreatePrice(productId, currency string, amount int, interval string) (*stripe.Price, error) {
+	if err := f.lock(); err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	var product *stripe.Product
+	for _, p := range f.state.Products {
+		if p.ID == productId {
+			product = p
+		}
+	}
+	if product == nil {
+		return nil, fakeMissing("product", productId)
+	}
+
+	price := &stripe.Price{
+		ID:         f.nextId("price"),
+		Active:     true,
+		Currency:   stripe.Currency(currency),
+		Product:    &stripe.Product{ID: productId},
+		Type:       stripe.PriceTypeOneTime,
+		UnitAmount: int64(amount),
+	}
+	if interval != "" {
+		price.Type = stripe.PriceTypeRecurring
+		price.Recurring = &stripe.PriceRecurring{Interval: stripe.PriceRecurringInterval(interval)}
+	}
+	f.state.Prices = append(f.state.Prices, price)
+
+	return price, nil
+}
+
+func (f *Fake) SetDefaultPrice(productId, priceId string) error {
+	if err := f.lock(); err != nil {
+		return err
+	}
+	defer f.unlock()
+
+	for _, p := range f.state.Products {
+		if p.ID == productId {
+			p.DefaultPrice = &stripe.Price{ID: priceId}
+			return nil
+		}
+	}
+
+	return fakeMissing("product", productId)
+}
+
+// replay returns the id of what was made with an idempotency key, or "" if nothing was;
+// callers hold the lock
+func (f *Fake) replay(idempotencyKey string) string {
+	if idempotencyKey == "" {
+		return ""
+	}
+	return f.state.Replays[idempotencyKey]
+}
+
+// remember stores the id of what was made with an idempotency key; callers hold the lock
+func (f *Fake) remember(idempotencyKey, id string) {
+	if idempotencyKey != "" {
+		f.state.Replays[idempotencyKey] = id
+	}
+}
+
+func fakeError(code stripe.ErrorCode) error {
+	return &stripe.Error{
+		Code:           code,
+		HTTPStatusCode: http.StatusPaymentRequired,
+		Msg:            cardErrorMessage(code),
+		Type:           stripe.ErrorTypeCard,
+	}
+}
+
+func fakeMissing(resource, id string) error {
+	return &stripe.Error{
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: '%s'", resource, id),
+		Type:           stripe.ErrorTypeInvalidRequest,
+	}
+}
@@ -0,0 +1,159 @@
+package cards
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// TestFakeCheckout drives a checkout the way the api and the front end do, each with its
+// own Fake opened on the same file: the api charges the card, the front end reads the
+// payment intent and card back to record the order, then refunds it when saving fails.
+func TestFakeCheckout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fake.json")
+	api := OpenFake(path)
+	web := OpenFake(path)
+
+	pi, _, err := api.Charge("usd", 1000, "checkout-1")
+	if err != nil {
+		t.Fatalf("charge: %v", err)
+	}
+
+	replayed, _, err := api.Charge("usd", 1000, "checkout-1")
+	if err != nil {
+		t.Fatalf("replayed charge: %v", err)
+	}
+	if replayed.ID != pi.ID {
+		t.Errorf("replayed charge made payment intent %s, want %s", replayed.ID, pi.ID)
+	}
+
+	got, err := web.RetrievePaymentIntent(pi.ID)
+	if err != nil {
+		t.Fatalf("front end retrieving payment intent: %v", err)
+	}
+	if got.Amount != 1000 || got.Currency != "usd" || got.Status != stripe.PaymentIntentStatusSucceeded {
+		t.Errorf("got payment intent %d %s %s, want 1000 usd succeeded", got.Amount, got.Currency, got.Status)
+	}
+	if len(got.Charges.Data) != 1 || got.Charges.Data[0].ID == "" {
+		t.Fatalf("payment intent has no charge to record as the bank return code")
+	}
+
+	pm, err := web.GetPaymentMethod("pm_card_visa")
+	if err != nil {
+		t.Fatalf("front end getting payment method: %v", err)
+	}
+	if pm.Card.Last4 != "4242" || pm.Card.ExpMonth != 12 || pm.Card.ExpYear != 2030 {
+		t.Errorf("got card %s %d/%d, want 4242 12/2030", pm.Card.Last4, pm.Card.ExpMonth, pm.Card.ExpYear)
+	}
+
+	_, err = web.Refund(pi.ID, 1000, pi.ID+"-compensation")
+	if err != nil {
+		t.Fatalf("front end refunding: %v", err)
+	}
+
+	// the api sees the refund the front end made
+	_, err = api.Refund(pi.ID, 1, "")
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) || stripeErr.Code != stripe.ErrorCodeAmountTooLarge {
+		t.Errorf("refunding a refunded payment intent: got %v, want %s", err, stripe.ErrorCodeAmountTooLarge)
+	}
+}
+
+func TestFakeSubscriptionCheckout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fake.json")
+	api := OpenFake(path)
+	api.RequireAuthentication("pm_3ds")
+
+	cust, _, err := api.CreateCustomer("pm_3ds", "jane@example.com", "")
+	if err != nil {
+		t.Fatalf("create customer: %v", err)
+	}
+
+	subscription, err := api.SubscribeToPlan(cust, "pm_3ds", "price_1", "jane@example.com", "4242", "visa", 0, "", nil, "")
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if subscription.Status != stripe.SubscriptionStatusIncomplete {
+		t.Fatalf("got subscription %s, want it waiting for 3-D Secure", subscription.Status)
+	}
+
+	// once the customer has authenticated the invoice is paid, reading it from the file
+	// as a restarted api would
+	invoice, err := OpenFake(path).PayInvoice(subscription.LatestInvoice.ID)
+	if err != nil {
+		t.Fatalf("pay invoice: %v", err)
+	}
+	if !invoice.Paid || invoice.Subscription.ID != subscription.ID {
+		t.Errorf("got invoice paid %t for %s, want paid for %s", invoice.Paid, invoice.Subscription.ID, subscription.ID)
+	}
+}
+
+func TestFakeDeclines(t *testing.T) {
+	f := NewFake()
+	f.DeclineAmount(666, stripe.ErrorCodeCardDeclined)
+
+	_, msg, err := f.Charge("usd", 666, "")
+	if err == nil || msg != "Your card was declined" {
+		t.Errorf("got %q, %v, want the card declined", msg, err)
+	}
+
+	_, _, err = f.Charge("usd", 667, "")
+	if err != nil {
+		t.Errorf("charging another amount: %v", err)
+	}
+
+	f.Decline(stripe.ErrorCodeExpiredCard)
+	_, msg, err = f.CreateCustomer("pm_card_visa", "jane@example.com", "")
+	if err == nil || msg != "Your card is expired" {
+		t.Errorf("got %q, %v, want the card expired", msg, err)
+	}
+}
+
+// TestFakeShared charges from two Fakes on the same file at once, as the api and the front
+// end can, and checks that no payment intent is lost
+func TestFakeShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fake.json")
+	fakes := []*Fake{OpenFake(path), OpenFake(path)}
+
+	var wg sync.WaitGroup
+	ids := make(chan string, 40)
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			f := fakes[i%len(fakes)]
+			if i%3 == 0 {
+				f.SetCard("mastercard", fmt.Sprint(1000+i), 1, 2031)
+			}
+			pi, _, err := f.Charge("usd", 100+i, "")
+			if err != nil {
+				t.Errorf("charge %d: %v", i, err)
+				return
+			}
+			ids <- pi.ID
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("payment intent %s made twice", id)
+		}
+		seen[id] = true
+
+		_, err := fakes[0].RetrievePaymentIntent(id)
+		if err != nil {
+			t.Errorf("payment intent %s was lost: %v", id, err)
+		}
+	}
+	if len(seen) != 40 {
+		t.Errorf("got %d payment intents, want 40", len(seen))
+	}
+}
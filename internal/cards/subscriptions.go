@@ -0,0 +1,112 @@
+package cards
+
+import (
+	"github.com/stripe/stripe-go/v72"
+)
+
+// ChangeSubscriptionPlan moves a subscription to another plan, prorating the
+// time left on the current period
+func (c *Card) ChangeSubscriptionPlan(subId, plan string) (*stripe.Subscription, error) {
+	subscription, err := c.client.Subscriptions.Get(subId, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+		Items: []*stripe.SubscriptionItemsParams{
+			{Plan: stripe.String(plan)},
+		},
+	}
+
+	// replace the current plan instead of adding a second one
+	if subscription.Items != nil && len(subscription.Items.Data) > 0 {
+		params.Items[0].ID = stripe.String(subscription.Items.Data[0].ID)
+	}
+
+	return c.client.Subscriptions.Update(subId, params)
+}
+
+// PauseSubscription stops collecting payments for a subscription; invoices raised
+// while it is paused are voided
+func (c *Card) PauseSubscription(subId string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+		},
+	}
+
+	return c.client.Subscriptions.Update(subId, params)
+}
+
+// ResumeSubscription starts collecting payments for a paused subscription again
+func (c *Card) ResumeSubscription(subId string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	// an empty value clears pause_collection
+	params.AddExtra("pause_collection", "")
+
+	return c.client.Subscriptions.Update(subId, params)
+}
+
+// ReactivateSubscription keeps a subscription that was set to cancel at the end of its period
+func (c *Card) ReactivateSubscription(subId string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+
+	return c.client.Subscriptions.Update(subId, params)
+}
+
+// CancelSubscriptionNow cancels a subscription straight away, without waiting for
+// the end of its period
+func (c *Card) CancelSubscriptionNow(subId string) (*stripe.Subscription, error) {
+	return c.client.Subscriptions.Cancel(subId, nil)
+}
+
+// UpdateSubscriptionCard saves the card pm on the subscription's customer and pays the
+// subscription's future invoices with it
+func (c *Card) UpdateSubscriptionCard(subId, pm string) (*stripe.Subscription, error) {
+	subscription, err := c.client.Subscriptions.Get(subId, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.AttachPaymentMethod(pm, subscription.Customer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		DefaultPaymentMethod: stripe.String(pm),
+	}
+
+	return c.client.Subscriptions.Update(subId, params)
+}
+
+// RetrieveSubscription gets a subscription with the payment intent of its latest invoice
+// and the setup intent saving its card, so callers can see whether either is waiting on
+// the customer to authenticate
+func (c *Card) RetrieveSubscription(subId string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("latest_invoice.payment_intent")
+	params.AddExpand("pending_setup_intent")
+
+	return c.client.Subscriptions.Get(subId, params)
+}
+
+// RetrieveInvoice gets an invoice with the payment intent paying it
+func (c *Card) RetrieveInvoice(id string) (*stripe.Invoice, error) {
+	params := &stripe.InvoiceParams{}
+	params.AddExpand("payment_intent")
+
+	return c.client.Invoices.Get(id, params)
+}
+
+// PayInvoice retries the payment of an open invoice with the subscription's card
+func (c *Card) PayInvoice(id string) (*stripe.Invoice, error) {
+	inv, err := c.client.Invoices.Pay(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
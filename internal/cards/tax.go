@@ -0,0 +1,23 @@
+package cards
+
+import (
+	"github.com/stripe/stripe-go/v72"
+)
+
+// CreateTaxRate creates a Stripe tax rate so that a tax can be charged on subscription invoices
+func (c *Card) CreateTaxRate(name, country, region string, rate float64, inclusive bool) (*stripe.TaxRate, error) {
+	params := &stripe.TaxRateParams{
+		DisplayName: stripe.String(name),
+		Country:     stripe.String(country),
+		Percentage:  stripe.Float64(rate),
+		Inclusive:   stripe.Bool(inclusive),
+	}
+	if region != "" {
+		params.State = stripe.String(region)
+		params.Jurisdiction = stripe.String(country + "-" + region)
+	} else {
+		params.Jurisdiction = stripe.String(country)
+	}
+
+	return c.client.TaxRates.New(params)
+}
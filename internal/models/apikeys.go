@@ -0,0 +1,299 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"net"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every api key, which tells them apart from user tokens
+const APIKeyPrefix = "gsk_"
+
+// Scopes an api key can be given
+const (
+	ScopeSalesRead          = "sales:read"
+	ScopeRefundsWrite       = "refunds:write"
+	ScopeSubscriptionsWrite = "subscriptions:write"
+	ScopeDisputesWrite      = "disputes:write"
+	ScopeTerminalWrite      = "terminal:write"
+	ScopeWidgetsWrite       = "widgets:write"
+)
+
+// APIKeyScope is a scope an api key can be given and the permission it grants
+type APIKeyScope struct {
+	Name        string `json:"name"`
+	Permission  string `json:"permission"`
+	Description string `json:"description"`
+}
+
+// APIKeyScopes are the scopes an api key can be given. Managing users and api keys is
+// left to signed in users, so no key can do either.
+var APIKeyScopes = []APIKeyScope{
+	{ScopeSalesRead, PermissionViewSales, "Read sales, subscriptions, widgets and disputes"},
+	{ScopeRefundsWrite, PermissionRefund, "Refund sales"},
+	{ScopeSubscriptionsWrite, PermissionManageSubscriptions, "Change, pause and cancel subscriptions"},
+	{ScopeDisputesWrite, PermissionManageDisputes, "Submit evidence for disputes"},
+	{ScopeTerminalWrite, PermissionVirtualTerminal, "Charge cards with the virtual terminal"},
+	{ScopeWidgetsWrite, PermissionManageWidgets, "Add, change and delete widgets"},
+}
+
+// APIKey is a long lived credential for server to server integrations
+type APIKey struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	// Prefix is the start of the key, enough to recognise it by
+	Prefix string `json:"prefix"`
+	// PlainText is only set when the key is generated; it is not stored
+	PlainText string   `json:"key,omitempty"`
+	Hash      []byte   `json:"-"`
+	Scopes    []string `json:"scopes"`
+	// AllowedIPs are the addresses and networks the key can be used from; it can be
+	// used from anywhere when there are none
+	AllowedIPs []string `json:"allowed_ips"`
+	CreatedBy  int      `json:"created_by"`
+	// LastUsedAt, Expiry and RevokedAt are zero when unset; a key without an expiry
+	// lasts until it is revoked
+	LastUsedAt time.Time `json:"last_used_at"`
+	LastUsedIP string    `json:"last_used_ip"`
+	Expiry     time.Time `json:"expiry"`
+	RevokedAt  time.Time `json:"revoked_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GenerateAPIKey generates a new api key, and returns it
+func GenerateAPIKey(name string, scopes, allowedIPs []string, expiry time.Time, createdBy int) (*APIKey, error) {
+	key := &APIKey{
+		Name:       name,
+		Scopes:     scopes,
+		AllowedIPs: allowedIPs,
+		Expiry:     expiry,
+		CreatedBy:  createdBy,
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key.PlainText = APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.PlainText[:len(APIKeyPrefix)+6]
+	hash := sha256.Sum256([]byte(key.PlainText))
+	key.Hash = hash[:]
+	return key, nil
+}
+
+// ValidAPIKeyScope reports whether scope is one an api key can be given
+func ValidAPIKeyScope(scope string) bool {
+	return scopePermission(scope) != ""
+}
+
+func scopePermission(scope string) string {
+	for _, s := range APIKeyScopes {
+		if s.Name == scope {
+			return s.Permission
+		}
+	}
+	return ""
+}
+
+// ValidAllowedIP reports whether entry is an ip address or a network in cidr notation
+func ValidAllowedIP(entry string) bool {
+	if net.ParseIP(entry) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(entry)
+	return err == nil
+}
+
+// AllowsIP reports whether the key can be used from ip
+func (k *APIKey) AllowsIP(ip net.IP) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range k.AllowedIPs {
+		if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// User returns the user requests made with the key are authenticated as, with the
+// permissions its scopes grant
+func (k *APIKey) User() *User {
+	u := &User{
+		FirstName:   k.Name,
+		Permissions: []string{},
+		APIKeyId:    k.Id,
+	}
+
+	for _, scope := range k.Scopes {
+		if p := scopePermission(scope); p != "" {
+			u.Permissions = append(u.Permissions, p)
+		}
+	}
+	return u
+}
+
+const apiKeyColumns = `
+	id, name, prefix, key_hash, scopes, coalesce(allowed_ips, ''), coalesce(created_by, 0),
+	last_used_at, last_used_ip, expiry_date, revoked_at, created_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	var scopes, allowedIPs string
+	var lastUsedAt, expiry, revokedAt sql.NullTime
+
+	err := row.Scan(
+		&k.Id,
+		&k.Name,
+		&k.Prefix,
+		&k.Hash,
+		&scopes,
+		&allowedIPs,
+		&k.CreatedBy,
+		&lastUsedAt,
+		&k.LastUsedIP,
+		&expiry,
+		&revokedAt,
+		&k.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	k.Scopes = splitList(scopes)
+	k.AllowedIPs = splitList(allowedIPs)
+	k.LastUsedAt = lastUsedAt.Time
+	k.Expiry = expiry.Time
+	k.RevokedAt = revokedAt.Time
+
+	return &k, nil
+}
+
+// splitList splits a comma separated column into its values
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// InsertAPIKey stores a generated api key, and returns its id
+func (m *DBModel) InsertAPIKey(k *APIKey) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var expiry sql.NullTime
+	if !k.Expiry.IsZero() {
+		expiry = sql.NullTime{Time: k.Expiry, Valid: true}
+	}
+
+	var createdBy sql.NullInt64
+	if k.CreatedBy > 0 {
+		createdBy = sql.NullInt64{Int64: int64(k.CreatedBy), Valid: true}
+	}
+
+	result, err := m.DB.ExecContext(ctx, `
+	insert into api_keys
+		(name, prefix, key_hash, scopes, allowed_ips, created_by, expiry_date, created_at, updated_at)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.Name, k.Prefix, k.Hash, strings.Join(k.Scopes, ","), strings.Join(k.AllowedIPs, ","),
+		createdBy, expiry, time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetAPIKeys gets every api key, revoked and expired ones included, the newest first
+func (m *DBModel) GetAPIKeys() ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var keys []*APIKey
+
+	rows, err := m.DB.QueryContext(ctx, `select `+apiKeyColumns+` from api_keys order by id desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByKey gets the api key key is the plain text of, as long as it has not been
+// revoked and has not expired
+func (m *DBModel) GetAPIKeyByKey(key string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	keyHash := sha256.Sum256([]byte(key))
+
+	row := m.DB.QueryRowContext(ctx, `select `+apiKeyColumns+` from api_keys
+	where key_hash = ? and revoked_at is null and (expiry_date is null or expiry_date > ?)`,
+		keyHash[:], time.Now())
+
+	return scanAPIKey(row)
+}
+
+// TouchAPIKey records that an api key was just used from ip. Keys used over and over
+// from the same address are only written about once a minute.
+func (m *DBModel) TouchAPIKey(id int, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+	update api_keys set last_used_at = ?, last_used_ip = ?
+	where id = ? and (last_used_at is null or last_used_at < ? or last_used_ip <> ?)`,
+		time.Now(), ip, id, time.Now().Add(-time.Minute), ip)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAPIKey stops an api key from being used; it is kept so that it is still listed
+func (m *DBModel) RevokeAPIKey(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+	update api_keys set revoked_at = ?, updated_at = ? where id = ? and revoked_at is null`,
+		time.Now(), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// CartItem is one line of a shopping cart, before it has been priced
+type CartItem struct {
+	WidgetId int `json:"widget_id"`
+	Quantity int `json:"quantity"`
+}
+
+// ErrEmptyCart is returned when checking out a cart with nothing in it
+var ErrEmptyCart = errors.New("your cart is empty")
+
+// PriceCart prices every line of a cart in currency from the widgets table and returns
+// the order items and their total. Lines for the same widget are merged. An empty
+// currency prices each widget in its own, which is only good for checking the cart.
+func (m *DBModel) PriceCart(cart []CartItem, currency string) ([]OrderItem, int, error) {
+	var items []OrderItem
+	lines := make(map[int]int)
+
+	for _, c := range cart {
+		if c.Quantity < 1 {
+			return nil, 0, fmt.Errorf("quantity for product %d must be at least 1", c.WidgetId)
+		}
+
+		if i, ok := lines[c.WidgetId]; ok {
+			items[i].Quantity += c.Quantity
+			continue
+		}
+
+		lines[c.WidgetId] = len(items)
+		items = append(items, OrderItem{WidgetId: c.WidgetId, Quantity: c.Quantity})
+	}
+
+	if len(items) == 0 {
+		return nil, 0, ErrEmptyCart
+	}
+
+	total := 0
+	for i := range items {
+		widget, amount, err := m.WidgetTotal(items[i].WidgetId, items[i].Quantity, currency)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, 0, fmt.Errorf("product %d does not exist", items[i].WidgetId)
+		} else if errors.Is(err, ErrCurrencyNotOffered) {
+			return nil, 0, fmt.Errorf("%s: %w", widget.Name, err)
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		if widget.IsRecurring {
+			return nil, 0, fmt.Errorf("%s is a subscription and cannot be bought from the cart", widget.Name)
+		}
+
+		items[i].Widget = widget
+		items[i].UnitPrice = widget.Price
+		items[i].Amount = amount
+		total += amount
+	}
+
+	return items, total, nil
+}
+
+// CartOrder builds the order for a priced cart. The order keeps the first widget and
+// the total quantity so that order listings still have something to show.
+func CartOrder(items []OrderItem, total int) Order {
+	order := Order{
+		WidgetId: items[0].WidgetId,
+		StatusId: StatusCleared,
+		Amount:   total,
+		Items:    items,
+	}
+
+	for _, item := range items {
+		order.Quantity += item.Quantity
+	}
+
+	return order
+}
@@ -0,0 +1,328 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrCouponInvalid is returned for a code that does not exist or has been switched off
+	ErrCouponInvalid = errors.New("coupon code is not valid")
+	// ErrCouponExpired is returned for a coupon past its expiry
+	ErrCouponExpired = errors.New("coupon code has expired")
+	// ErrCouponExhausted is returned once a coupon has been redeemed as often as it may be
+	ErrCouponExhausted = errors.New("coupon code has been used up")
+	// ErrCouponNotApplicable is returned for a coupon restricted to other widgets
+	ErrCouponNotApplicable = errors.New("coupon code does not apply to this product")
+)
+
+// Coupon is the type for a discount code; it takes either a percentage or a fixed
+// amount off
+type Coupon struct {
+	Id                    int       `json:"id"`
+	Code                  string    `json:"code"`
+	PercentOff            int       `json:"percent_off"`
+	AmountOff             int       `json:"amount_off"`
+	Currency              string    `json:"currency"`
+	ExpiresAt             time.Time `json:"expires_at"`
+	MaxRedemptions        int       `json:"max_redemptions"`
+	TimesRedeemed         int       `json:"times_redeemed"`
+	Active                bool      `json:"active"`
+	StripeCouponId        string    `json:"-"`
+	StripePromotionCodeId string    `json:"-"`
+	// WidgetIds lists the widgets the coupon is restricted to; empty means every widget
+	WidgetIds []int     `json:"widget_ids"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// Check returns why the coupon cannot be used for a widget at time now, or nil if it can
+func (c Coupon) Check(widget Widget, now time.Time) error {
+	if !c.Active {
+		return ErrCouponInvalid
+	}
+
+	if !c.ExpiresAt.IsZero() && now.After(c.ExpiresAt) {
+		return ErrCouponExpired
+	}
+
+	if c.MaxRedemptions > 0 && c.TimesRedeemed >= c.MaxRedemptions {
+		return ErrCouponExhausted
+	}
+
+	// a fixed amount is only meaningful in its own currency
+	if c.PercentOff == 0 && c.Currency != widget.Currency {
+		return ErrCouponNotApplicable
+	}
+
+	if len(c.WidgetIds) == 0 {
+		return nil
+	}
+	for _, id := range c.WidgetIds {
+		if id == widget.Id {
+			return nil
+		}
+	}
+
+	return ErrCouponNotApplicable
+}
+
+// Discount returns how much the coupon takes off amount; it never takes off more than amount
+func (c Coupon) Discount(amount int) int {
+	discount := c.AmountOff
+	if c.PercentOff > 0 {
+		discount = amount * c.PercentOff / 100
+	}
+
+	if discount > amount {
+		return amount
+	}
+	return discount
+}
+
+// GetCouponByCode gets a coupon and the widgets it is restricted to
+func (m *DBModel) GetCouponByCode(code string) (Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c Coupon
+	var expiresAt sql.NullTime
+
+	row := m.DB.QueryRowContext(ctx, `
+	select
+		id, code, percent_off, amount_off, currency, expires_at, max_redemptions, times_redeemed,
+		active, stripe_coupon_id, stripe_promotion_code_id, created_at, updated_at
+	from
+		coupons
+	where code = ?`, code)
+
+	err := row.Scan(
+		&c.Id,
+		&c.Code,
+		&c.PercentOff,
+		&c.AmountOff,
+		&c.Currency,
+		&expiresAt,
+		&c.MaxRedemptions,
+		&c.TimesRedeemed,
+		&c.Active,
+		&c.StripeCouponId,
+		&c.StripePromotionCodeId,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+	c.ExpiresAt = expiresAt.Time
+
+	rows, err := m.DB.QueryContext(ctx, `select widget_id from coupon_widgets where coupon_id = ?`, c.Id)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var widgetId int
+		err = rows.Scan(&widgetId)
+		if err != nil {
+			return c, err
+		}
+		c.WidgetIds = append(c.WidgetIds, widgetId)
+	}
+
+	return c, rows.Err()
+}
+
+// ApplyCoupon checks that a code can be used for a widget and returns the coupon and
+// the discount it gives on amount
+func (m *DBModel) ApplyCoupon(code string, widget Widget, amount int) (Coupon, int, error) {
+	coupon, err := m.GetCouponByCode(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return coupon, 0, ErrCouponInvalid
+	} else if err != nil {
+		return coupon, 0, err
+	}
+
+	err = coupon.Check(widget, time.Now())
+	if err != nil {
+		return coupon, 0, err
+	}
+
+	return coupon, coupon.Discount(amount), nil
+}
+
+// LinkCouponToStripe records the Stripe coupon and promotion code a coupon is redeemed as
+// on subscriptions
+func (m *DBModel) LinkCouponToStripe(id int, couponId, promotionCodeId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update coupons set stripe_coupon_id = ?, stripe_promotion_code_id = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, couponId, promotionCodeId, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CouponReservation is a use of a coupon held while the payment it discounts is made
+type CouponReservation struct {
+	Id            int       `json:"id"`
+	CouponId      int       `json:"coupon_id"`
+	Discount      int       `json:"discount"`
+	PaymentIntent string    `json:"payment_intent"`
+	ExpiryDate    time.Time `json:"expiry_date"`
+}
+
+// ReserveCoupon holds a use of a coupon, worth discount, for ttl and returns the
+// reservation id, or ErrCouponExhausted if the coupon has no use left
+func (m *DBModel) ReserveCoupon(id, discount int, ttl time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// lock the coupon row so that concurrent reservations are counted one at a time
+	var maxRedemptions, timesRedeemed int
+	err = tx.QueryRowContext(ctx, `select max_redemptions, times_redeemed from coupons where id = ? for update`, id).
+		Scan(&maxRedemptions, &timesRedeemed)
+	if err != nil {
+		return 0, err
+	}
+
+	var held int
+	err = tx.QueryRowContext(ctx, `
+	select count(*) from coupon_reservations
+	where coupon_id = ? and expiry_date > ?`, id, time.Now()).Scan(&held)
+	if err != nil {
+		return 0, err
+	}
+
+	if maxRedemptions > 0 && timesRedeemed+held >= maxRedemptions {
+		return 0, ErrCouponExhausted
+	}
+
+	result, err := tx.ExecContext(ctx, `
+	insert into coupon_reservations (coupon_id, discount, expiry_date, created_at, updated_at)
+	values (?, ?, ?, ?, ?)`,
+		id, discount, time.Now().Add(ttl), time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	reservationId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(reservationId), nil
+}
+
+// AttachCouponReservation links a coupon reservation to the payment intent it discounts
+func (m *DBModel) AttachCouponReservation(id int, pi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update coupon_reservations set payment_intent = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, pi, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseCouponReservation deletes a coupon reservation that will not be redeemed
+func (m *DBModel) ReleaseCouponReservation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from coupon_reservations where id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetCouponReservation gets the coupon reservation for a payment intent. It is returned
+// even once expired, since the payment was already made at the discount it holds.
+func (m *DBModel) GetCouponReservation(pi string) (CouponReservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c CouponReservation
+
+	row := m.DB.QueryRowContext(ctx, `
+	select id, coupon_id, discount, payment_intent, expiry_date
+	from coupon_reservations
+	where payment_intent = ?
+	order by id desc
+	limit 1`, pi)
+
+	err := row.Scan(&c.Id, &c.CouponId, &c.Discount, &c.PaymentIntent, &c.ExpiryDate)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// redeemCoupon counts a use of a coupon for the order paid by a transaction. A use held
+// for the payment is turned into the redemption; otherwise it fails once the coupon has
+// been used up, counting the uses held for other payments.
+func redeemCoupon(ctx context.Context, db execer, id, transactionId int) error {
+	held, err := db.ExecContext(ctx, `
+	delete c from coupon_reservations c
+		inner join transactions t on (c.payment_intent = t.payment_intent)
+	where c.coupon_id = ? and t.id = ?`, id, transactionId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := held.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		// the customer has paid at the discount, so the use counts whatever is left now
+		_, err = db.ExecContext(ctx, `update coupons set times_redeemed = times_redeemed + 1, updated_at = ? where id = ?`,
+			time.Now(), id)
+		return err
+	}
+
+	result, err := db.ExecContext(ctx, `
+	update coupons set times_redeemed = times_redeemed + 1, updated_at = ?
+	where id = ? and (max_redemptions = 0 or times_redeemed + (
+		select count(*) from coupon_reservations r
+		where r.coupon_id = coupons.id and r.expiry_date > ?) < max_redemptions)`,
+		time.Now(), id, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rows, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrCouponExhausted
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrEmailTaken is returned when changing a customer's email to one another customer has
+var ErrEmailTaken = errors.New("that email address belongs to another customer")
+
+// GetCustomer gets a customer by id
+func (m *DBModel) GetCustomer(id int) (Customer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c Customer
+
+	row := m.DB.QueryRowContext(ctx, `
+	select
+		id, first_name, last_name, email, stripe_customer_id, created_at, updated_at
+	from
+		customers
+	where id = ?`, id)
+
+	err := row.Scan(
+		&c.Id,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.StripeCustomerId,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// GetCustomerByEmail gets a customer by email address; there is one customer per email
+func (m *DBModel) GetCustomerByEmail(email string) (Customer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	var c Customer
+
+	row := m.DB.QueryRowContext(ctx, `
+	select
+		id, first_name, last_name, email, stripe_customer_id, created_at, updated_at
+	from
+		customers
+	where email = ?`, email)
+
+	err := row.Scan(
+		&c.Id,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.StripeCustomerId,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// SetStripeCustomerId links a customer to the Stripe customer their cards are saved on.
+// A customer already linked keeps their Stripe customer.
+func (m *DBModel) SetStripeCustomerId(id int, stripeCustomerId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update customers set stripe_customer_id = ?, updated_at = ?
+	where id = ? and stripe_customer_id = ''`
+
+	_, err := m.DB.ExecContext(ctx, stmt, stripeCustomerId, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateCustomerEmail changes the email a customer signs in and is billed with
+func (m *DBModel) UpdateCustomerEmail(id int, email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	existing, err := m.GetCustomerByEmail(email)
+	if err == nil && existing.Id != id {
+		return ErrEmailTaken
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update customers set email = ?, updated_at = ? where id = ?`
+
+	_, err = m.DB.ExecContext(ctx, stmt, email, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetOrdersForCustomer gets every order and subscription of a customer, newest first
+func (m *DBModel) GetOrdersForCustomer(customerId int) ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var orders []*Order
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select
+		o.id, o.widget_id, o.transaction_id, o.customer_id,
+		o.status_id, o.quantity, o.amount, o.created_at,
+		o.updated_at, w.id, w.name, w.is_recurring, t.id, t.amount, t.currency,
+		t.last_four, t.expiry_month, t.expiry_year, t.payment_intent
+	from
+		orders o
+		left join widgets w on (o.widget_id = w.id)
+		left join transactions t on (o.transaction_id = t.id)
+	where o.customer_id = ?
+	order by
+		o.created_at desc`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Order
+
+		err = rows.Scan(
+			&o.Id,
+			&o.WidgetId,
+			&o.TransactionId,
+			&o.CustomerId,
+			&o.StatusId,
+			&o.Quantity,
+			&o.Amount,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+			&o.Widget.Id,
+			&o.Widget.Name,
+			&o.Widget.IsRecurring,
+			&o.Transaction.Id,
+			&o.Transaction.Amount,
+			&o.Transaction.Currency,
+			&o.Transaction.LastFour,
+			&o.Transaction.ExpiryMonth,
+			&o.Transaction.ExpiryYear,
+			&o.Transaction.PaymentIntent,
+		)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, &o)
+	}
+
+	return orders, rows.Err()
+}
+
+// GetOrderForCustomer gets an order of a customer; the orders of other customers are
+// not found
+func (m *DBModel) GetOrderForCustomer(id, customerId int) (Order, error) {
+	o, err := m.GetOrderById(id)
+	if err != nil {
+		return o, err
+	}
+
+	if o.CustomerId != customerId {
+		return Order{}, sql.ErrNoRows
+	}
+
+	return o, nil
+}
@@ -0,0 +1,225 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Dispute is a chargeback raised by a cardholder against one of our payments
+type Dispute struct {
+	Id              int    `json:"id"`
+	StripeDisputeId string `json:"stripe_dispute_id"`
+	PaymentIntent   string `json:"payment_intent"`
+	// OrderId is 0 for payments without an order, such as virtual terminal charges
+	OrderId int `json:"order_id"`
+	// OrderStatusId is the status the order had before it was disputed
+	OrderStatusId int    `json:"-"`
+	Amount        int    `json:"amount"`
+	Currency      string `json:"currency"`
+	Reason        string `json:"reason"`
+	Status        string `json:"status"`
+	// EvidenceDueBy and EvidenceSubmittedAt are zero when unset
+	EvidenceDueBy       time.Time `json:"evidence_due_by"`
+	Evidence            string    `json:"evidence"`
+	EvidenceSubmittedAt time.Time `json:"evidence_submitted_at"`
+	Customer            Customer  `json:"customer"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"-"`
+}
+
+// Dispute statuses in which the dispute has not been decided yet
+var openDisputeStatuses = []interface{}{
+	"needs_response", "warning_needs_response", "under_review", "warning_under_review",
+}
+
+const disputeColumns = `
+	d.id, d.stripe_dispute_id, d.payment_intent, coalesce(d.order_id, 0), d.order_status_id,
+	d.amount, d.currency, d.reason, d.status, d.evidence_due_by, coalesce(d.evidence, ''),
+	d.evidence_submitted_at, coalesce(c.first_name, ''), coalesce(c.last_name, ''),
+	coalesce(c.email, ''), d.created_at, d.updated_at`
+
+const disputeJoins = `
+	left join orders o on (d.order_id = o.id)
+	left join customers c on (o.customer_id = c.id)`
+
+func scanDispute(row interface{ Scan(...interface{}) error }) (Dispute, error) {
+	var d Dispute
+	var dueBy, submittedAt sql.NullTime
+
+	err := row.Scan(
+		&d.Id,
+		&d.StripeDisputeId,
+		&d.PaymentIntent,
+		&d.OrderId,
+		&d.OrderStatusId,
+		&d.Amount,
+		&d.Currency,
+		&d.Reason,
+		&d.Status,
+		&dueBy,
+		&d.Evidence,
+		&submittedAt,
+		&d.Customer.FirstName,
+		&d.Customer.LastName,
+		&d.Customer.Email,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+	)
+	if err != nil {
+		return d, err
+	}
+	d.EvidenceDueBy = dueBy.Time
+	d.EvidenceSubmittedAt = submittedAt.Time
+
+	return d, nil
+}
+
+// SaveDispute records a dispute, or the latest state of one already recorded, and returns
+// it as stored. The first time a dispute is seen the order it was paid for by, if any, is
+// marked disputed and the status it had is kept, so it can be restored if the dispute is won.
+func (m *DBModel) SaveDispute(d Dispute) (Dispute, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return d, err
+	}
+	defer tx.Rollback()
+
+	var orderId sql.NullInt64
+	var orderStatusId int
+
+	row := tx.QueryRowContext(ctx, `
+	select o.id, o.status_id
+	from orders o
+		inner join transactions t on (o.transaction_id = t.id)
+	where t.payment_intent = ?`, d.PaymentIntent)
+
+	err = row.Scan(&orderId, &orderStatusId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return d, err
+	}
+
+	var dueBy sql.NullTime
+	if !d.EvidenceDueBy.IsZero() {
+		dueBy = sql.NullTime{Time: d.EvidenceDueBy, Valid: true}
+	}
+
+	// a decided dispute keeps its outcome when an older event arrives late
+	result, err := tx.ExecContext(ctx, `
+	insert into disputes
+		(stripe_dispute_id, payment_intent, order_id, order_status_id, amount, currency, reason,
+		status, evidence_due_by, created_at, updated_at)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	on duplicate key update
+		amount = values(amount), reason = values(reason),
+		status = if(status in (?, ?, ?), status, values(status)),
+		evidence_due_by = values(evidence_due_by), updated_at = values(updated_at)`,
+		d.StripeDisputeId, d.PaymentIntent, orderId, orderStatusId, d.Amount, d.Currency, d.Reason,
+		d.Status, dueBy, time.Now(), time.Now(), "won", "lost", "warning_closed")
+	if err != nil {
+		return d, err
+	}
+
+	// mysql reports 1 row for an insert and 2 for an update
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return d, err
+	}
+
+	if rows == 1 && orderId.Valid {
+		_, err = tx.ExecContext(ctx, `
+		update orders set status_id = ?, updated_at = ? where id = ? and status_id not in (?, ?)`,
+			StatusDisputed, time.Now(), orderId.Int64, StatusRefunded, StatusDisputed)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	row = tx.QueryRowContext(ctx, `select `+disputeColumns+` from disputes d `+disputeJoins+`
+	where d.stripe_dispute_id = ?`, d.StripeDisputeId)
+
+	saved, err := scanDispute(row)
+	if err != nil {
+		return d, err
+	}
+
+	return saved, tx.Commit()
+}
+
+// RestoreDisputedOrder gives the order of a dispute that was won back the status it had
+// before it was disputed
+func (m *DBModel) RestoreDisputedOrder(d Dispute) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if d.OrderId == 0 || d.OrderStatusId == 0 {
+		return nil
+	}
+
+	_, err := m.DB.ExecContext(ctx, `
+	update orders set status_id = ?, updated_at = ? where id = ? and status_id = ?`,
+		d.OrderStatusId, time.Now(), d.OrderId, StatusDisputed)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetDispute gets one dispute by id
+func (m *DBModel) GetDispute(id int) (Dispute, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+disputeColumns+` from disputes d `+disputeJoins+`
+	where d.id = ?`, id)
+
+	return scanDispute(row)
+}
+
+// GetOpenDisputes gets the disputes that have not been decided yet, the ones whose
+// evidence is due soonest first
+func (m *DBModel) GetOpenDisputes() ([]*Dispute, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var disputes []*Dispute
+
+	rows, err := m.DB.QueryContext(ctx, `select `+disputeColumns+` from disputes d `+disputeJoins+`
+	where d.status in (?, ?, ?, ?)
+	order by d.evidence_due_by is null, d.evidence_due_by, d.id`, openDisputeStatuses...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, &d)
+	}
+
+	return disputes, rows.Err()
+}
+
+// SaveDisputeEvidence records the evidence text submitted for a dispute
+func (m *DBModel) SaveDisputeEvidence(id int, evidence, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+	update disputes set evidence = ?, evidence_submitted_at = ?, status = ?, updated_at = ?
+	where id = ?`,
+		evidence, time.Now(), status, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
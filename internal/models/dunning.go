@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Dunning is the retry schedule of a subscription whose renewal payment failed
+type Dunning struct {
+	Id             int       `json:"id"`
+	OrderId        int       `json:"order_id"`
+	SubscriptionId string    `json:"subscription_id"`
+	InvoiceId      string    `json:"invoice_id"`
+	Attempt        int       `json:"attempt"`
+	NextAttemptAt  time.Time `json:"next_attempt_at"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+// StartDunning puts the subscription at risk and schedules the first retry of its unpaid
+// invoice. It returns false when the subscription is already being retried, or has no order.
+func (m *DBModel) StartDunning(subId, invoiceId string, nextAttempt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var orderId int
+	row := tx.QueryRowContext(ctx, `
+	select o.id
+	from orders o
+		inner join transactions t on (o.transaction_id = t.id)
+	where t.payment_intent = ? and o.status_id not in (?, ?, ?)`,
+		subId, StatusCancelled, StatusRefunded, StatusPartiallyRefunded)
+
+	err = row.Scan(&orderId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+	insert ignore into dunning
+		(order_id, subscription_id, invoice_id, attempt, next_attempt_at, created_at, updated_at)
+	values (?, ?, ?, 0, ?, ?, ?)`,
+		orderId, subId, invoiceId, nextAttempt, time.Now(), time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows == 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `update orders set status_id = ?, updated_at = ? where id = ?`,
+		StatusAtRisk, time.Now(), orderId)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetDunningForOrder gets the retry schedule of an order, or nil when it is not being retried
+func (m *DBModel) GetDunningForOrder(orderId int) (*Dunning, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var d Dunning
+
+	row := m.DB.QueryRowContext(ctx, `
+	select id, order_id, subscription_id, invoice_id, attempt, next_attempt_at, created_at, updated_at
+	from dunning
+	where order_id = ?`, orderId)
+
+	err := row.Scan(
+		&d.Id,
+		&d.OrderId,
+		&d.SubscriptionId,
+		&d.InvoiceId,
+		&d.Attempt,
+		&d.NextAttemptAt,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// GetDueDunning gets the subscriptions whose next retry is due
+func (m *DBModel) GetDueDunning() ([]Dunning, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var due []Dunning
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select id, order_id, subscription_id, invoice_id, attempt, next_attempt_at, created_at, updated_at
+	from dunning
+	where next_attempt_at <= ?
+	order by next_attempt_at`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d Dunning
+
+		err = rows.Scan(
+			&d.Id,
+			&d.OrderId,
+			&d.SubscriptionId,
+			&d.InvoiceId,
+			&d.Attempt,
+			&d.NextAttemptAt,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, d)
+	}
+
+	return due, rows.Err()
+}
+
+// ClaimDunning pushes a due retry back by lease so that no other worker makes it at the
+// same time; it returns false when the retry has already been claimed or made
+func (m *DBModel) ClaimDunning(d Dunning, lease time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+	update dunning set next_attempt_at = ?, updated_at = ?
+	where id = ? and attempt = ? and next_attempt_at = ?`,
+		time.Now().Add(lease), time.Now(), d.Id, d.Attempt, d.NextAttemptAt)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+// ScheduleDunningRetry records a failed retry and when the next one is made
+func (m *DBModel) ScheduleDunningRetry(id, attempt int, nextAttempt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+	update dunning set attempt = ?, next_attempt_at = ?, updated_at = ? where id = ?`,
+		attempt, nextAttempt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EndDunning stops retrying a subscription, because its invoice was paid or it was cancelled
+func (m *DBModel) EndDunning(subId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from dunning where subscription_id = ?`, subId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// RecordStripeEvent stores a webhook event id, returning false if it was already recorded
+func (m *DBModel) RecordStripeEvent(eventId, eventType string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	insert ignore into stripe_events (event_id, event_type, created_at, updated_at)
+	values (?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt, eventId, eventType, time.Now(), time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+// ForgetStripeEvent removes a recorded event so that a redelivery is processed again
+func (m *DBModel) ForgetStripeEvent(eventId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from stripe_events where event_id = ?`, eventId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
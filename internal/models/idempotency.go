@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// IdempotencyStore keeps idempotency keys and the responses replayed for them
+type IdempotencyStore interface {
+	ReserveIdempotencyKey(k IdempotencyKey, ttl, lease time.Duration) (bool, error)
+	GetIdempotencyKey(key string) (IdempotencyKey, error)
+	SaveIdempotentResponse(key string, status int, body []byte) error
+	DeleteIdempotencyKey(key string) error
+}
+
+// IdempotencyKey is the type for a stored idempotent request and its response
+type IdempotencyKey struct {
+	Key      string
+	Endpoint string
+	// Caller is who made the request, such as a user, an api key or an address
+	Caller string
+	// RequestHash is the hex sha256 of the request body
+	RequestHash    string
+	ResponseStatus int
+	ResponseBody   []byte
+	Expiry         time.Time
+}
+
+// ReserveIdempotencyKey claims k.Key for the request k describes, for ttl, returning false
+// if the key is already in use. The request has lease to finish: a key whose request never
+// stored a response, because the process stopped, is released once its lease has run out,
+// as are expired keys.
+func (m *DBModel) ReserveIdempotencyKey(k IdempotencyKey, ttl, lease time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+	delete from idempotency_keys
+	where idempotency_key = ? and (expiry_date < ? or (response_status = 0 and locked_until < ?))`,
+		k.Key, time.Now(), time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	stmt := `
+	insert ignore into idempotency_keys
+		(idempotency_key, endpoint, caller, request_hash, response_status, locked_until, expiry_date,
+			created_at, updated_at)
+	values (?, ?, ?, ?, 0, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt, k.Key, k.Endpoint, k.Caller, k.RequestHash,
+		time.Now().Add(lease), time.Now().Add(ttl), time.Now(), time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+// GetIdempotencyKey returns a stored key; a ResponseStatus of 0 means the original
+// request has not finished
+func (m *DBModel) GetIdempotencyKey(key string) (IdempotencyKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var k IdempotencyKey
+
+	row := m.DB.QueryRowContext(ctx, `
+	select idempotency_key, endpoint, caller, request_hash, response_status, coalesce(response_body, ''),
+		expiry_date
+	from idempotency_keys
+	where idempotency_key = ?`, key)
+
+	err := row.Scan(
+		&k.Key,
+		&k.Endpoint,
+		&k.Caller,
+		&k.RequestHash,
+		&k.ResponseStatus,
+		&k.ResponseBody,
+		&k.Expiry,
+	)
+	if err != nil {
+		return k, err
+	}
+
+	return k, nil
+}
+
+// SaveIdempotentResponse stores the response to replay for key
+func (m *DBModel) SaveIdempotentResponse(key string, status int, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update idempotency_keys
+	set response_status = ?, response_body = ?, updated_at = ?
+	where idempotency_key = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, status, body, time.Now(), key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteIdempotencyKey releases key so that it can be retried
+func (m *DBModel) DeleteIdempotencyKey(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from idempotency_keys where idempotency_key = ?`, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes the keys that are no longer replayed, and returns
+// how many were deleted
+func (m *DBModel) DeleteExpiredIdempotencyKeys() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from idempotency_keys where expiry_date < ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
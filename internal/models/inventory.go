@@ -0,0 +1,218 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrOutOfStock is returned when a widget does not have enough inventory left
+var ErrOutOfStock = errors.New("this product is out of stock")
+
+// AvailableInventory returns the stock of a widget less any unexpired reservations
+func (m *DBModel) AvailableInventory(widgetId int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var available int
+
+	row := m.DB.QueryRowContext(ctx, `
+	select
+		w.inventory_level - coalesce((
+			select sum(r.quantity) from inventory_reservations r
+			where r.widget_id = w.id and r.expiry_date > ?), 0)
+	from widgets w
+	where w.id = ?`, time.Now(), widgetId)
+
+	err := row.Scan(&available)
+	if err != nil {
+		return 0, err
+	}
+
+	return available, nil
+}
+
+// ReserveInventory holds quantity of a widget for ttl and returns the reservation id,
+// or ErrOutOfStock if not enough is available
+func (m *DBModel) ReserveInventory(widgetId, quantity int, ttl time.Duration) (int, error) {
+	ids, err := m.ReserveItems([]OrderItem{{WidgetId: widgetId, Quantity: quantity}}, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	return ids[0], nil
+}
+
+// ReserveItems holds the quantity of every item for ttl and returns the reservation ids
+// in the order of items, one per item even when a widget appears on several lines; if
+// any item is short, nothing is reserved and ErrOutOfStock is returned
+func (m *DBModel) ReserveItems(items []OrderItem, ttl time.Duration) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, len(items))
+	for _, i := range lockOrder(items) {
+		id, err := reserveInventory(ctx, tx, items[i].WidgetId, items[i].Quantity, ttl)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// lockOrder returns the positions of items sorted by widget id, the order their widget
+// rows are locked in so that overlapping carts cannot deadlock
+func lockOrder(items []OrderItem) []int {
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return items[order[i]].WidgetId < items[order[j]].WidgetId })
+
+	return order
+}
+
+func reserveInventory(ctx context.Context, tx *sql.Tx, widgetId, quantity int, ttl time.Duration) (int, error) {
+	// lock the widget row so that concurrent reservations are counted one at a time
+	var level int
+	err := tx.QueryRowContext(ctx, `select inventory_level from widgets where id = ? for update`, widgetId).Scan(&level)
+	if err != nil {
+		return 0, err
+	}
+
+	var reserved int
+	err = tx.QueryRowContext(ctx, `
+	select coalesce(sum(quantity), 0) from inventory_reservations
+	where widget_id = ? and expiry_date > ?`, widgetId, time.Now()).Scan(&reserved)
+	if err != nil {
+		return 0, err
+	}
+
+	if level-reserved < quantity {
+		return 0, ErrOutOfStock
+	}
+
+	result, err := tx.ExecContext(ctx, `
+	insert into inventory_reservations (widget_id, quantity, expiry_date, created_at, updated_at)
+	values (?, ?, ?, ?, ?)`,
+		widgetId, quantity, time.Now().Add(ttl), time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// AttachReservation links a reservation to the payment intent (or subscription) paying for it
+func (m *DBModel) AttachReservation(id int, pi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update inventory_reservations set payment_intent = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, pi, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseReservation deletes a reservation that will not be turned into an order
+func (m *DBModel) ReleaseReservation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from inventory_reservations where id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RefundOrder marks an order refunded and puts its items back in stock; refunding
+// an order twice restocks it once
+func (m *DBModel) RefundOrder(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = refundOrder(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func refundOrder(ctx context.Context, tx *sql.Tx, id int) error {
+	result, err := tx.ExecContext(ctx, `
+	update orders set status_id = ?, updated_at = ? where id = ? and status_id <> ?`,
+		StatusRefunded, time.Now(), id, StatusRefunded)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows > 0 {
+		_, err = tx.ExecContext(ctx, `
+		update widgets w
+			inner join order_items i on (i.widget_id = w.id)
+		set w.inventory_level = w.inventory_level + i.quantity, w.updated_at = ?
+		where i.order_id = ?`, time.Now(), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReleasePayment deletes the stock and coupon reservations held for a payment intent that
+// will not be turned into an order
+func (m *DBModel) ReleasePayment(pi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from inventory_reservations where payment_intent = ?`, pi)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `delete from coupon_reservations where payment_intent = ?`, pi)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLockOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []OrderItem
+		want  []int
+	}{
+		{"empty", nil, []int{}},
+		{"one", []OrderItem{{WidgetId: 4}}, []int{0}},
+		{"sorted", []OrderItem{{WidgetId: 1}, {WidgetId: 2}}, []int{0, 1}},
+		{"unsorted", []OrderItem{{WidgetId: 3}, {WidgetId: 1}, {WidgetId: 2}}, []int{1, 2, 0}},
+		// every line of the same widget keeps its own position
+		{"duplicate lines", []OrderItem{{WidgetId: 2, Quantity: 1}, {WidgetId: 1}, {WidgetId: 2, Quantity: 5}}, []int{1, 0, 2}},
+	}
+
+	for _, tt := range tests {
+		got := lockOrder(tt.items)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: lockOrder = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Kinds of thing failed attempts are counted against
+const (
+	// LockoutIP counts failed sign ins, and password reset requests for emails with no
+	// account, from an address
+	LockoutIP = "ip"
+	// LockoutAccount counts failed sign ins to an account, by email, whether or not an
+	// account has that email
+	LockoutAccount = "account"
+	// LockoutPasswordReset counts password reset emails requested for an email
+	LockoutPasswordReset = "password_reset"
+	// LockoutAccountLink counts customer sign in and email confirmation links requested
+	// for an email
+	LockoutAccountLink = "account_link"
+)
+
+// lockoutRule is how many attempts of a kind are let through before each further one
+// makes the next wait, for twice as long each time
+type lockoutRule struct {
+	free    int
+	backoff time.Duration
+}
+
+var lockoutRules = map[string]lockoutRule{
+	LockoutIP:            {free: 20, backoff: time.Second},
+	LockoutAccount:       {free: 3, backoff: time.Second},
+	LockoutPasswordReset: {free: 3, backoff: time.Minute},
+	LockoutAccountLink:   {free: 3, backoff: time.Minute},
+}
+
+const (
+	// maxLockout is the longest anything is locked out for at a time
+	maxLockout = 15 * time.Minute
+	// lockoutWindow is how long after the last failure the count starts again
+	lockoutWindow = time.Hour
+)
+
+// LockoutSubject is something failed attempts are counted against
+type LockoutSubject struct {
+	Kind    string
+	Subject string
+}
+
+// IPSubject is the address attempts were made from
+func IPSubject(ip net.IP) LockoutSubject {
+	return LockoutSubject{Kind: LockoutIP, Subject: ip.String()}
+}
+
+// RemoteIP returns the address in a request's RemoteAddr, or nil if it cannot be read;
+// the api and the web app both read it this way so that they count attempts alike
+func RemoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// AccountSubject is the account, by email, sign ins were attempted for
+func AccountSubject(email string) LockoutSubject {
+	return LockoutSubject{Kind: LockoutAccount, Subject: strings.ToLower(strings.TrimSpace(email))}
+}
+
+// PasswordResetSubject is the email password resets were requested for
+func PasswordResetSubject(email string) LockoutSubject {
+	return LockoutSubject{Kind: LockoutPasswordReset, Subject: strings.ToLower(strings.TrimSpace(email))}
+}
+
+// AccountLinkSubject is the email customer sign in or email confirmation links were
+// requested for
+func AccountLinkSubject(email string) LockoutSubject {
+	return LockoutSubject{Kind: LockoutAccountLink, Subject: strings.ToLower(strings.TrimSpace(email))}
+}
+
+// Lockout is the count of recent failed attempts against a subject
+type Lockout struct {
+	Id       int    `json:"id"`
+	Kind     string `json:"kind"`
+	Subject  string `json:"subject"`
+	Failures int    `json:"failures"`
+	// LockedUntil is when the next attempt will be let through; it is zero, or in the
+	// past, when it can be made now
+	LockedUntil   time.Time `json:"locked_until"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+}
+
+// lockoutDelay is how long the failures-th failure against kind locks it out for
+func lockoutDelay(kind string, failures int) time.Duration {
+	rule := lockoutRules[kind]
+	if failures <= rule.free {
+		return 0
+	}
+
+	delay := rule.backoff
+	for i := rule.free + 1; i < failures && delay < maxLockout; i++ {
+		delay *= 2
+	}
+	if delay > maxLockout {
+		delay = maxLockout
+	}
+
+	return delay
+}
+
+// countFailure adds a failure against kind at now to the failures counted before, the last
+// of them at lastFailureAt, and returns the new count and when the next attempt can be
+// made; it is zero if one can be made straight away. Failures more than lockoutWindow
+// before now are forgotten.
+func countFailure(kind string, failures int, lastFailureAt, now time.Time) (int, time.Time) {
+	if lastFailureAt.IsZero() || now.Sub(lastFailureAt) > lockoutWindow {
+		failures = 0
+	}
+	failures++
+
+	delay := lockoutDelay(kind, failures)
+	if delay == 0 {
+		return failures, time.Time{}
+	}
+	return failures, now.Add(delay)
+}
+
+// CheckLockout returns when the next attempt against subjects can be made; it is zero if
+// one can be made now
+func (m *DBModel) CheckLockout(subjects ...LockoutSubject) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var until time.Time
+
+	for _, s := range subjects {
+		var lockedUntil sql.NullTime
+
+		row := m.DB.QueryRowContext(ctx, `
+		select locked_until from lockouts where kind = ? and subject = ? and locked_until > ?`,
+			s.Kind, s.Subject, time.Now())
+
+		err := row.Scan(&lockedUntil)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return until, err
+		}
+
+		if lockedUntil.Time.After(until) {
+			until = lockedUntil.Time
+		}
+	}
+
+	return until, nil
+}
+
+// RecordFailure counts a failed attempt against each of subjects, and returns when the
+// next attempt can be made; it is zero if one can be made now
+func (m *DBModel) RecordFailure(subjects ...LockoutSubject) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var until time.Time
+	now := time.Now()
+
+	for _, s := range subjects {
+		var failures int
+		var lastFailureAt sql.NullTime
+
+		row := tx.QueryRowContext(ctx, `
+		select failures, last_failure_at from lockouts where kind = ? and subject = ? for update`,
+			s.Kind, s.Subject)
+
+		err = row.Scan(&failures, &lastFailureAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return until, err
+		}
+
+		var lockedUntil sql.NullTime
+		failures, lockedUntil.Time = countFailure(s.Kind, failures, lastFailureAt.Time, now)
+		if !lockedUntil.Time.IsZero() {
+			lockedUntil.Valid = true
+			if lockedUntil.Time.After(until) {
+				until = lockedUntil.Time
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `
+		insert into lockouts
+			(kind, subject, failures, locked_until, last_failure_at, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
+		on duplicate key update
+			failures = values(failures), locked_until = values(locked_until),
+			last_failure_at = values(last_failure_at), updated_at = values(updated_at)`,
+			s.Kind, s.Subject, failures, lockedUntil, now, now, now)
+		if err != nil {
+			return until, err
+		}
+	}
+
+	return until, tx.Commit()
+}
+
+// ClearFailures forgets the failed attempts against subjects, such as an account and the
+// address it was signed in to from
+func (m *DBModel) ClearFailures(subjects ...LockoutSubject) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for _, s := range subjects {
+		_, err := m.DB.ExecContext(ctx, `delete from lockouts where kind = ? and subject = ?`, s.Kind, s.Subject)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetLockouts gets the subjects with failed attempts that have not been forgotten yet,
+// the ones locked out longest first
+func (m *DBModel) GetLockouts() ([]*Lockout, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockouts []*Lockout
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select id, kind, subject, failures, locked_until, last_failure_at
+	from lockouts
+	where last_failure_at > ?
+	order by locked_until is null, locked_until desc, last_failure_at desc`,
+		time.Now().Add(-lockoutWindow))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l Lockout
+		var lockedUntil, lastFailureAt sql.NullTime
+
+		err = rows.Scan(
+			&l.Id,
+			&l.Kind,
+			&l.Subject,
+			&l.Failures,
+			&lockedUntil,
+			&lastFailureAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		l.LockedUntil = lockedUntil.Time
+		l.LastFailureAt = lastFailureAt.Time
+
+		lockouts = append(lockouts, &l)
+	}
+
+	return lockouts, rows.Err()
+}
+
+// ClearLockout forgets the failed attempts counted in one lockout, letting its subject
+// try again straight away
+func (m *DBModel) ClearLockout(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from lockouts where id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteStaleLockouts deletes failed attempts old enough to have been forgotten, and
+// returns how many were deleted
+func (m *DBModel) DeleteStaleLockouts() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+	delete from lockouts where last_failure_at < ? and (locked_until is null or locked_until < ?)`,
+		time.Now().Add(-lockoutWindow), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
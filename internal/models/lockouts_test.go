@@ -0,0 +1,142 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	tests := []struct {
+		kind     string
+		failures int
+		want     time.Duration
+	}{
+		{LockoutAccount, 1, 0},
+		{LockoutAccount, 3, 0},
+		{LockoutAccount, 4, time.Second},
+		{LockoutAccount, 5, 2 * time.Second},
+		{LockoutAccount, 6, 4 * time.Second},
+		{LockoutAccount, 13, 512 * time.Second},
+		{LockoutAccount, 14, maxLockout},
+		{LockoutAccount, 1000, maxLockout},
+
+		{LockoutIP, 20, 0},
+		{LockoutIP, 21, time.Second},
+		{LockoutIP, 22, 2 * time.Second},
+		{LockoutIP, 31, maxLockout},
+
+		{LockoutPasswordReset, 3, 0},
+		{LockoutPasswordReset, 4, time.Minute},
+		{LockoutPasswordReset, 5, 2 * time.Minute},
+		{LockoutPasswordReset, 7, 8 * time.Minute},
+		{LockoutPasswordReset, 8, maxLockout},
+
+		{LockoutAccountLink, 3, 0},
+		{LockoutAccountLink, 4, time.Minute},
+		{LockoutAccountLink, 8, maxLockout},
+	}
+
+	for _, tt := range tests {
+		if got := lockoutDelay(tt.kind, tt.failures); got != tt.want {
+			t.Errorf("lockoutDelay(%q, %d) = %s, want %s", tt.kind, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestCountFailure(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		kind          string
+		failures      int
+		lastFailureAt time.Time
+		wantFailures  int
+		wantDelay     time.Duration
+	}{
+		{"first failure", LockoutAccount, 0, time.Time{}, 1, 0},
+		{"last free failure", LockoutAccount, 2, now.Add(-time.Minute), 3, 0},
+		{"first locked failure", LockoutAccount, 3, now.Add(-time.Minute), 4, time.Second},
+		{"backoff doubles", LockoutAccount, 5, now.Add(-time.Minute), 6, 4 * time.Second},
+		{"inside the window", LockoutPasswordReset, 3, now.Add(-lockoutWindow), 4, time.Minute},
+		{"window expired", LockoutAccount, 10, now.Add(-lockoutWindow - time.Second), 1, 0},
+		{"window expired while locked out", LockoutIP, 40, now.Add(-2 * lockoutWindow), 1, 0},
+		{"count without a last failure", LockoutAccount, 10, time.Time{}, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures, lockedUntil := countFailure(tt.kind, tt.failures, tt.lastFailureAt, now)
+
+			var want time.Time
+			if tt.wantDelay > 0 {
+				want = now.Add(tt.wantDelay)
+			}
+			if failures != tt.wantFailures || !lockedUntil.Equal(want) {
+				t.Errorf("got %d failures locked until %s, want %d locked until %s",
+					failures, lockedUntil, tt.wantFailures, want)
+			}
+		})
+	}
+}
+
+// TestCountFailureSchedule counts sign in failures one after another, a second apart, and
+// checks each is locked out for twice as long as the one before, up to maxLockout
+func TestCountFailureSchedule(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	var failures int
+	var last time.Time
+	want := time.Duration(0)
+
+	for i := 1; i <= 20; i++ {
+		var lockedUntil time.Time
+		failures, lockedUntil = countFailure(LockoutAccount, failures, last, now)
+		last = now
+
+		switch {
+		case i == 4:
+			want = time.Second
+		case i > 4:
+			want *= 2
+			if want > maxLockout {
+				want = maxLockout
+			}
+		}
+
+		got := time.Duration(0)
+		if !lockedUntil.IsZero() {
+			got = lockedUntil.Sub(now)
+		}
+		if failures != i || got != want {
+			t.Fatalf("failure %d: got count %d locked out for %s, want %d for %s", i, failures, got, i, want)
+		}
+
+		now = now.Add(time.Second)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		// the same address is counted once however it was written
+		{"[::ffff:192.0.2.1]:80", "192.0.2.1"},
+		{"[2001:DB8:0::1]:443", "2001:db8::1"},
+		{"not an address", "<nil>"},
+	}
+
+	for _, tt := range tests {
+		got := RemoteIP(tt.remoteAddr).String()
+		if got != tt.want {
+			t.Errorf("RemoteIP(%q) = %s, want %s", tt.remoteAddr, got, tt.want)
+		}
+		if got != "<nil>" && IPSubject(RemoteIP(tt.remoteAddr)).Subject != tt.want {
+			t.Errorf("IPSubject for %q = %s, want %s", tt.remoteAddr, IPSubject(RemoteIP(tt.remoteAddr)).Subject, tt.want)
+		}
+	}
+}
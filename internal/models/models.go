@@ -29,6 +29,27 @@ func NewModels(db *sql.DB) Models {
 	}
 }
 
+// Order statuses, matching the statuses table
+const (
+	StatusCleared           = 1
+	StatusRefunded          = 2
+	StatusCancelled         = 3
+	StatusPartiallyRefunded = 4
+	StatusPaused            = 5
+	StatusCancelling        = 6
+	StatusAtRisk            = 7
+	StatusDisputed          = 8
+)
+
+// Transaction statuses, matching the transaction_statuses table
+const (
+	TransactionPending           = 1
+	TransactionCleared           = 2
+	TransactionDeclined          = 3
+	TransactionRefunded          = 4
+	TransactionPartiallyRefunded = 5
+)
+
 type Widget struct {
 	Id             int       `json:"id"`
 	Name           string    `json:"name"`
@@ -38,8 +59,15 @@ type Widget struct {
 	Image          string    `json:"image"`
 	IsRecurring    bool      `json:"is_recurring"`
 	PlanId         string    `json:"plan_id"`
+	Active         bool      `json:"active"`
+	StripeProduct  string    `json:"stripe_product_id"`
+	Currency       string    `json:"currency"`
+	Interval       string    `json:"interval"`
+	TrialDays      int       `json:"trial_days"`
 	CreatedAt      time.Time `json:"-"`
 	UpdatedAt      time.Time `json:"-"`
+	// Prices lists the other currencies the widget is sold in, when they have been loaded
+	Prices []WidgetPrice `json:"prices,omitempty"`
 }
 
 type Order struct {
@@ -50,11 +78,33 @@ type Order struct {
 	StatusId      int         `json:"status_id"`
 	Quantity      int         `json:"quantity"`
 	Amount        int         `json:"amount"`
+	CouponId      int         `json:"coupon_id"`
+	Discount      int         `json:"discount"`
+	Tax           int         `json:"tax"`
+	Country       string      `json:"country"`
+	Region        string      `json:"region"`
 	CreatedAt     time.Time   `json:"-"`
 	UpdatedAt     time.Time   `json:"-"`
 	Widget        Widget      `json:"widget"`
 	Transaction   Transaction `json:"transaction"`
 	Customer      Customer    `json:"customer"`
+	Items         []OrderItem `json:"items"`
+	Refunds       []Refund    `json:"refunds"`
+	Taxes         []OrderTax  `json:"taxes"`
+	Dunning       *Dunning    `json:"dunning,omitempty"`
+}
+
+// OrderItem is one line of an order
+type OrderItem struct {
+	Id        int       `json:"id"`
+	OrderId   int       `json:"order_id"`
+	WidgetId  int       `json:"widget_id"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice int       `json:"unit_price"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Widget    Widget    `json:"widget"`
 }
 
 type Status struct {
@@ -87,22 +137,60 @@ type Transaction struct {
 }
 
 type User struct {
-	Id        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
+	Id        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	RoleId    int    `json:"role_id"`
+	Role      string `json:"role"`
+	// Permissions are the names of the permissions the user's role gives them
+	Permissions []string `json:"permissions"`
+	// RequireTwoFactor makes the user set up two-factor authentication, whatever their
+	// role; RoleRequiresTwoFactor is set when their role makes them
+	RequireTwoFactor      bool `json:"require_two_factor"`
+	RoleRequiresTwoFactor bool `json:"role_requires_two_factor"`
+	TwoFactorEnabled      bool `json:"two_factor_enabled"`
+	// APIKeyId is set, and Id is 0, when the request was made with an api key rather
+	// than by a signed in user
+	APIKeyId  int       `json:"-"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
 
 type Customer struct {
-	Id        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	Id               int       `json:"id"`
+	FirstName        string    `json:"first_name"`
+	LastName         string    `json:"last_name"`
+	Email            string    `json:"email"`
+	StripeCustomerId string    `json:"stripe_customer_id"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
+}
+
+// ErrPriceMismatch is returned when an amount posted by a client does not match the catalog price
+var ErrPriceMismatch = errors.New("amount does not match the price of the product")
+
+// ErrWidgetUnavailable is returned when buying a widget that has been taken out of the catalog
+var ErrWidgetUnavailable = errors.New("this product is no longer available")
+
+// WidgetTotal gets a widget priced in currency and the amount to charge for quantity of it
+func (m *DBModel) WidgetTotal(id, quantity int, currency string) (Widget, int, error) {
+	if quantity < 1 {
+		return Widget{}, 0, errors.New("quantity must be at least 1")
+	}
+
+	widget, err := m.GetWidget(id)
+	if err != nil {
+		return widget, 0, err
+	}
+
+	widget, err = m.InCurrency(widget, currency)
+	if err != nil {
+		return widget, 0, err
+	}
+
+	return widget, widget.Price * quantity, nil
 }
 
 func (m *DBModel) GetWidget(id int) (Widget, error) {
@@ -113,7 +201,8 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 
 	row := m.DB.QueryRowContext(ctx, `
 	select 
-	id, name, description, inventory_level, price, image, is_recurring, plan_id, created_at, updated_at 
+	id, name, description, inventory_level, price, image, is_recurring, plan_id, active,
+	stripe_product_id, currency, billing_interval, trial_days, created_at, updated_at 
 	from widgets 
 	where id = ?`, id)
 
@@ -126,6 +215,11 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 		&widget.Image,
 		&widget.IsRecurring,
 		&widget.PlanId,
+		&widget.Active,
+		&widget.StripeProduct,
+		&widget.Currency,
+		&widget.Interval,
+		&widget.TrialDays,
 		&widget.CreatedAt,
 		&widget.UpdatedAt,
 	)
@@ -137,18 +231,27 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 	return widget, nil
 }
 
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
 // InsertTransaction inserts a transaction and returns its id
 func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertTransaction(ctx, m.DB, txn)
+}
+
+func insertTransaction(ctx context.Context, db execer, txn Transaction) (int, error) {
 	stmt := `
 	insert into transactions
 		(amount, currency, last_four, bank_return_code, expiry_month, expiry_year, 
 			payment_intent, payment_method, transaction_status_id, created_at, updated_at)
 		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		txn.Amount,
 		txn.Currency,
 		txn.LastFour,
@@ -173,23 +276,102 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	return int(id), nil
 }
 
-// InsertOrder inserts an order and returns its id
+// InsertOrder inserts an order and its items and returns its id. The ordered quantities
+// are taken out of stock, and any reservations held for the order's payment released,
+// in the same transaction. An order without items gets one item for its WidgetId.
 func (m *DBModel) InsertOrder(order Order) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertOrder(ctx, tx, order)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+func insertOrder(ctx context.Context, db execer, order Order) (int, error) {
+	items := order.Items
+	if len(items) == 0 {
+		// the line is for the catalog price, before any discount or added tax
+		amount := order.Amount + order.Discount
+		for _, t := range order.Taxes {
+			if !t.Inclusive {
+				amount -= t.Amount
+			}
+		}
+		unitPrice := amount
+		if order.Quantity > 0 {
+			unitPrice = amount / order.Quantity
+		}
+		items = []OrderItem{{
+			WidgetId:  order.WidgetId,
+			Quantity:  order.Quantity,
+			UnitPrice: unitPrice,
+			Amount:    amount,
+		}}
+	}
+
+	var couponId sql.NullInt64
+	if order.CouponId > 0 {
+		err := redeemCoupon(ctx, db, order.CouponId, order.TransactionId)
+		if err != nil {
+			return 0, err
+		}
+		couponId = sql.NullInt64{Int64: int64(order.CouponId), Valid: true}
+	}
+
+	for _, item := range items {
+		stock, err := db.ExecContext(ctx, `
+		update widgets set inventory_level = inventory_level - ?, updated_at = ?
+		where id = ? and inventory_level >= ?`,
+			item.Quantity, time.Now(), item.WidgetId, item.Quantity)
+		if err != nil {
+			return 0, err
+		}
+
+		rows, err := stock.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if rows == 0 {
+			return 0, ErrOutOfStock
+		}
+	}
+
+	_, err := db.ExecContext(ctx, `
+	delete r from inventory_reservations r
+		inner join transactions t on (r.payment_intent = t.payment_intent)
+	where t.id = ?`, order.TransactionId)
+	if err != nil {
+		return 0, err
+	}
+
 	stmt := `
 	insert into orders
-		(widget_id, transaction_id, status_id, quantity, customer_id, amount, created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?, ?, ?)`
+		(widget_id, transaction_id, status_id, quantity, customer_id, amount, coupon_id, discount,
+			tax, country, region, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		order.WidgetId,
 		order.TransactionId,
 		order.StatusId,
 		order.Quantity,
 		order.CustomerId,
 		order.Amount,
+		couponId,
+		order.Discount,
+		order.Tax,
+		order.Country,
+		order.Region,
 		time.Now(),
 		time.Now(),
 	)
@@ -202,23 +384,53 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 		return 0, err
 	}
 
+	for _, item := range items {
+		_, err = db.ExecContext(ctx, `
+		insert into order_items
+			(order_id, widget_id, quantity, unit_price, amount, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?)`,
+			id, item.WidgetId, item.Quantity, item.UnitPrice, item.Amount, time.Now(), time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = insertOrderTaxes(ctx, db, int(id), order.Taxes)
+	if err != nil {
+		return 0, err
+	}
+
 	return int(id), nil
 }
 
-// InsertCustomer inserts a customer and returns its id
+// InsertCustomer inserts a customer, or updates the customer with the same email, and
+// returns its id
 func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertCustomer(ctx, m.DB, customer)
+}
+
+// insertCustomer saves a customer by email, keeping the existing name when none is given
+// and the Stripe customer they were first linked to
+func insertCustomer(ctx context.Context, db execer, customer Customer) (int, error) {
 	stmt := `
 	insert into customers
-		(first_name, last_name, email, created_at, updated_at)
-		values (?, ?, ?, ?, ?)`
-
-	result, err := m.DB.ExecContext(ctx, stmt,
+		(first_name, last_name, email, stripe_customer_id, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?)
+	on duplicate key update
+		id = last_insert_id(id),
+		first_name = if(values(first_name) = '', first_name, values(first_name)),
+		last_name = if(values(last_name) = '', last_name, values(last_name)),
+		stripe_customer_id = if(stripe_customer_id = '', values(stripe_customer_id), stripe_customer_id),
+		updated_at = values(updated_at)`
+
+	result, err := db.ExecContext(ctx, stmt,
 		customer.FirstName,
 		customer.LastName,
-		customer.Email,
+		strings.ToLower(strings.TrimSpace(customer.Email)),
+		customer.StripeCustomerId,
 		time.Now(),
 		time.Now(),
 	)
@@ -234,6 +446,44 @@ func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
 	return int(id), nil
 }
 
+// CreateOrderWithTransaction writes the customer, the transaction and the order in one
+// SQL transaction, so that either all three rows exist or none do. It returns the order id.
+func (m *DBModel) CreateOrderWithTransaction(customer Customer, txn Transaction, order Order) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	customerId, err := insertCustomer(ctx, tx, customer)
+	if err != nil {
+		return 0, err
+	}
+
+	txnId, err := insertTransaction(ctx, tx, txn)
+	if err != nil {
+		return 0, err
+	}
+
+	order.CustomerId = customerId
+	order.TransactionId = txnId
+
+	orderId, err := insertOrder(ctx, tx, order)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return orderId, nil
+}
+
 // GetUserByEmail gets a user by email address
 func (m *DBModel) GetUserByEmail(email string) (User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -472,6 +722,18 @@ func (m DBModel) GetAllSubscriptionsPaginated(pageSize, page int) ([]*Order, int
 		}
 		orders = append(orders, &o)
 	}
+	rows.Close()
+
+	// subscriptions at risk show how their failed renewal is being retried
+	for _, o := range orders {
+		if o.StatusId != StatusAtRisk {
+			continue
+		}
+		o.Dunning, err = m.GetDunningForOrder(o.Id)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
 
 	query = `select count(o.id)
 			from orders o
@@ -530,8 +792,71 @@ func (m DBModel) GetOrderById(id int) (Order, error) {
 		return o, err
 	}
 
+	o.Items, err = m.GetOrderItems(o.Id)
+	if err != nil {
+		return o, err
+	}
+
+	o.Refunds, err = m.GetRefundsForOrder(o.Id)
+	if err != nil {
+		return o, err
+	}
+
+	o.Taxes, err = m.GetOrderTaxes(o.Id)
+	if err != nil {
+		return o, err
+	}
+
+	o.Dunning, err = m.GetDunningForOrder(o.Id)
+	if err != nil {
+		return o, err
+	}
+
 	return o, nil
+}
+
+// GetOrderItems gets the lines of an order
+func (m *DBModel) GetOrderItems(orderId int) ([]OrderItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var items []OrderItem
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select
+		i.id, i.order_id, i.widget_id, i.quantity, i.unit_price, i.amount,
+		i.created_at, i.updated_at, w.id, w.name
+	from
+		order_items i
+		left join widgets w on (i.widget_id = w.id)
+	where i.order_id = ?
+	order by i.id`, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	for rows.Next() {
+		var i OrderItem
+		err = rows.Scan(
+			&i.Id,
+			&i.OrderId,
+			&i.WidgetId,
+			&i.Quantity,
+			&i.UnitPrice,
+			&i.Amount,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Widget.Id,
+			&i.Widget.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+
+	return items, rows.Err()
 }
 
 func (m *DBModel) UpdateOrderStatus(id, statusId int) error {
@@ -548,6 +873,79 @@ func (m *DBModel) UpdateOrderStatus(id, statusId int) error {
 	return nil
 }
 
+// UpdateOrderStatusByPaymentIntent sets the status of the order paid for by a
+// payment intent or subscription id
+func (m *DBModel) UpdateOrderStatusByPaymentIntent(pi string, statusId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update orders o
+		inner join transactions t on (o.transaction_id = t.id)
+	set o.status_id = ?, o.updated_at = ?
+	where t.payment_intent = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, statusId, time.Now(), pi)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetOrderIdByPaymentIntent returns the id of the order paid for by a payment intent or subscription id
+func (m *DBModel) GetOrderIdByPaymentIntent(pi string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+
+	row := m.DB.QueryRowContext(ctx, `
+	select o.id
+	from orders o
+		inner join transactions t on (o.transaction_id = t.id)
+	where t.payment_intent = ?`, pi)
+
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetTransactionIdByPaymentIntent returns the id of the transaction saved for a payment intent
+func (m *DBModel) GetTransactionIdByPaymentIntent(pi string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+
+	row := m.DB.QueryRowContext(ctx, `select id from transactions where payment_intent = ?`, pi)
+
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// UpdateTransactionStatusByPaymentIntent sets the status of the transactions for a payment intent
+func (m *DBModel) UpdateTransactionStatusByPaymentIntent(pi string, statusId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update transactions set transaction_status_id = ?, updated_at = ? where payment_intent = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, statusId, time.Now(), pi)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (m *DBModel) GetAllUsers() ([]*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -555,11 +953,13 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 	var users []*User
 
 	query := `select 
-					id, last_name, first_name, email, created_at, updated_at
+					u.id, u.last_name, u.first_name, u.email, u.role_id, r.name, u.two_factor_required,
+					r.two_factor_required, u.totp_enabled_at is not null, u.created_at, u.updated_at
 				from
-					users
+					users u
+					inner join roles r on (u.role_id = r.id)
 				order by
-					last_name, first_name`
+					u.last_name, u.first_name`
 	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
@@ -573,6 +973,11 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 			&u.LastName,
 			&u.FirstName,
 			&u.Email,
+			&u.RoleId,
+			&u.Role,
+			&u.RequireTwoFactor,
+			&u.RoleRequiresTwoFactor,
+			&u.TwoFactorEnabled,
 			&u.CreatedAt,
 			&u.UpdatedAt,
 		)
@@ -593,10 +998,12 @@ func (m *DBModel) GetOneUser(id int) (User, error) {
 	var u User
 
 	query := `select 
-					id, last_name, first_name, email, created_at, updated_at
+					u.id, u.last_name, u.first_name, u.email, u.role_id, r.name, u.two_factor_required,
+					r.two_factor_required, u.totp_enabled_at is not null, u.created_at, u.updated_at
 				from
-					users
-				where id = ?`
+					users u
+					inner join roles r on (u.role_id = r.id)
+				where u.id = ?`
 
 	row := m.DB.QueryRowContext(ctx, query, id)
 
@@ -605,6 +1012,11 @@ func (m *DBModel) GetOneUser(id int) (User, error) {
 		&u.LastName,
 		&u.FirstName,
 		&u.Email,
+		&u.RoleId,
+		&u.Role,
+		&u.RequireTwoFactor,
+		&u.RoleRequiresTwoFactor,
+		&u.TwoFactorEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -612,25 +1024,50 @@ func (m *DBModel) GetOneUser(id int) (User, error) {
 		return u, err
 	}
 
+	u.Permissions, err = m.GetUserPermissions(u.Id)
+	if err != nil {
+		return u, err
+	}
+
 	return u, nil
 }
 
+// EditUser saves the details and role of an admin user. It returns ErrLastUserManager
+// rather than take away the permission to manage users from the only user who has it.
 func (m *DBModel) EditUser(u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	canManage, err := m.roleCan(ctx, u.RoleId, PermissionManageUsers)
+	if err != nil {
+		return err
+	}
+	if !canManage {
+		others, err := m.countUserManagers(ctx, u.Id)
+		if err != nil {
+			return err
+		}
+		if others == 0 {
+			return ErrLastUserManager
+		}
+	}
+
 	stmt := `update users 
 			set
 				first_name = ?,
 				last_name = ?,
 				email = ?,
+				role_id = ?,
+				two_factor_required = ?,
 				updated_at = ?
 			where
 				id = ?`
-	_, err := m.DB.ExecContext(ctx, stmt,
+	_, err = m.DB.ExecContext(ctx, stmt,
 		u.FirstName,
 		u.LastName,
 		u.Email,
+		u.RoleId,
+		u.RequireTwoFactor,
 		time.Now(),
 		u.Id,
 	)
@@ -645,14 +1082,21 @@ func (m *DBModel) AddUser(u User, hash string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `insert into users (first_name, last_name, email, password, created_at, updated_at)
-			values (?, ?, ?, ?, ?, ?)`
+	if u.RoleId == 0 {
+		u.RoleId = RoleViewer
+	}
+
+	stmt := `insert into users
+				(first_name, last_name, email, password, role_id, two_factor_required, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`
 
 	_, err := m.DB.ExecContext(ctx, stmt,
 		u.FirstName,
 		u.LastName,
 		u.Email,
 		hash,
+		u.RoleId,
+		u.RequireTwoFactor,
 		time.Now(),
 		time.Now(),
 	)
@@ -663,10 +1107,20 @@ func (m *DBModel) AddUser(u User, hash string) error {
 	return nil
 }
 
+// DeleteUser deletes an admin user and their tokens. It returns ErrLastUserManager rather
+// than delete the only user who can manage users.
 func (m *DBModel) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	others, err := m.countUserManagers(ctx, id)
+	if err != nil {
+		return err
+	}
+	if others == 0 {
+		return ErrLastUserManager
+	}
+
 	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
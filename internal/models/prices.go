@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// WidgetPrice is the price of a widget in a currency other than its own
+type WidgetPrice struct {
+	Id        int       `json:"id"`
+	WidgetId  int       `json:"widget_id"`
+	Currency  string    `json:"currency"`
+	Amount    int       `json:"amount"`
+	PlanId    string    `json:"plan_id"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// ErrCurrencyNotOffered is returned when buying a widget in a currency it has no price in
+var ErrCurrencyNotOffered = errors.New("this product is not sold in that currency")
+
+// GetWidgetPrices gets the prices of a widget in currencies other than its own
+func (m *DBModel) GetWidgetPrices(widgetId int) ([]WidgetPrice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var prices []WidgetPrice
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select id, widget_id, currency, amount, plan_id, created_at, updated_at
+	from widget_prices
+	where widget_id = ?
+	order by currency`, widgetId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p WidgetPrice
+		err = rows.Scan(
+			&p.Id,
+			&p.WidgetId,
+			&p.Currency,
+			&p.Amount,
+			&p.PlanId,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		prices = append(prices, p)
+	}
+
+	return prices, rows.Err()
+}
+
+// SetWidgetPrice adds or changes the price of a widget in a currency. Stripe prices cannot
+// be changed, so a new amount unlinks the old one.
+func (m *DBModel) SetWidgetPrice(p WidgetPrice) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	insert into widget_prices (widget_id, currency, amount, plan_id, created_at, updated_at)
+		values (?, ?, ?, '', ?, ?)
+	on duplicate key update
+		plan_id = if(amount = values(amount), plan_id, ''),
+		amount = values(amount),
+		updated_at = values(updated_at)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		p.WidgetId,
+		strings.ToLower(p.Currency),
+		p.Amount,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteWidgetPrice stops selling a widget in a currency
+func (m *DBModel) DeleteWidgetPrice(widgetId int, currency string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from widget_prices where widget_id = ? and currency = ?`,
+		widgetId, strings.ToLower(currency))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LinkWidgetPriceToStripe records the Stripe price a widget is sold as in a currency
+func (m *DBModel) LinkWidgetPriceToStripe(widgetId int, currency, priceId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update widget_prices set plan_id = ?, updated_at = ? where widget_id = ? and currency = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, priceId, time.Now(), widgetId, strings.ToLower(currency))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InCurrency returns the widget with its price and plan in currency. An empty currency,
+// or the widget's own, returns the widget unchanged.
+func (m *DBModel) InCurrency(widget Widget, currency string) (Widget, error) {
+	if currency == "" || strings.EqualFold(currency, widget.Currency) {
+		return widget, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var amount int
+	var planId string
+
+	row := m.DB.QueryRowContext(ctx, `
+	select amount, plan_id from widget_prices where widget_id = ? and currency = ?`,
+		widget.Id, strings.ToLower(currency))
+
+	err := row.Scan(&amount, &planId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return widget, ErrCurrencyNotOffered
+	} else if err != nil {
+		return widget, err
+	}
+
+	widget.Price = amount
+	widget.Currency = strings.ToLower(currency)
+	widget.PlanId = planId
+
+	return widget, nil
+}
+
+// Currencies returns the currencies a widget is sold in, its own first
+func (w Widget) Currencies() []string {
+	currencies := []string{w.Currency}
+	for _, p := range w.Prices {
+		currencies = append(currencies, p.Currency)
+	}
+	return currencies
+}
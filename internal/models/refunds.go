@@ -0,0 +1,197 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrRefundTooLarge is returned when a refund would take more than was captured for an order
+var ErrRefundTooLarge = errors.New("refund is more than the amount left to refund")
+
+// Refund is the type for one refund against an order
+type Refund struct {
+	Id             int    `json:"id"`
+	OrderId        int    `json:"order_id"`
+	Amount         int    `json:"amount"`
+	Reason         string `json:"reason"`
+	StripeRefundId string `json:"stripe_refund_id"`
+	UserId         int    `json:"user_id"`
+	// APIKeyId is set instead of UserId for refunds made with an api key
+	APIKeyId  int       `json:"api_key_id"`
+	Operator  string    `json:"operator"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// RefundableAmount returns how much of the amount captured for an order has not been refunded
+func (m *DBModel) RefundableAmount(orderId int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var refundable int
+
+	row := m.DB.QueryRowContext(ctx, `
+	select
+		t.amount - coalesce((select sum(r.amount) from refunds r where r.order_id = o.id), 0)
+	from
+		orders o
+		inner join transactions t on (o.transaction_id = t.id)
+	where o.id = ?`, orderId)
+
+	err := row.Scan(&refundable)
+	if err != nil {
+		return 0, err
+	}
+
+	return refundable, nil
+}
+
+// RecordRefund adds a refund to the ledger and moves the order and its transaction to
+// partially refunded, or to refunded (restocking the order) once everything captured has
+// been refunded. A refund that is already recorded is not added again, but is given the
+// user or api key that made it if it was recorded without one.
+func (m *DBModel) RecordRefund(refund Refund) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the order so that concurrent refunds are added up one at a time
+	var captured, transactionId int
+	err = tx.QueryRowContext(ctx, `
+	select t.amount, t.id
+	from
+		orders o
+		inner join transactions t on (o.transaction_id = t.id)
+	where o.id = ?
+	for update`, refund.OrderId).Scan(&captured, &transactionId)
+	if err != nil {
+		return err
+	}
+
+	// refunds made outside the admin area, such as in the Stripe dashboard, have no operator
+	var userId, apiKeyId sql.NullInt64
+	if refund.UserId > 0 {
+		userId = sql.NullInt64{Int64: int64(refund.UserId), Valid: true}
+	}
+	if refund.APIKeyId > 0 {
+		apiKeyId = sql.NullInt64{Int64: int64(refund.APIKeyId), Valid: true}
+	}
+
+	var recorded int
+	err = tx.QueryRowContext(ctx, `select count(id) from refunds where stripe_refund_id = ?`,
+		refund.StripeRefundId).Scan(&recorded)
+	if err != nil {
+		return err
+	}
+	if recorded > 0 {
+		if !userId.Valid && !apiKeyId.Valid {
+			return nil
+		}
+
+		// the webhook for a refund can record it before the request that made it does, so
+		// the operator is filled in on the row it left without one
+		_, err = tx.ExecContext(ctx, `
+		update refunds set user_id = ?, api_key_id = ?, updated_at = ?
+		where stripe_refund_id = ? and user_id is null and api_key_id is null`,
+			userId, apiKeyId, time.Now(), refund.StripeRefundId)
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	var refunded int
+	err = tx.QueryRowContext(ctx, `select coalesce(sum(amount), 0) from refunds where order_id = ?`,
+		refund.OrderId).Scan(&refunded)
+	if err != nil {
+		return err
+	}
+
+	refunded += refund.Amount
+	if refunded > captured {
+		return ErrRefundTooLarge
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	insert into refunds (order_id, amount, reason, stripe_refund_id, user_id, api_key_id, created_at, updated_at)
+	values (?, ?, ?, ?, ?, ?, ?, ?)`,
+		refund.OrderId, refund.Amount, refund.Reason, refund.StripeRefundId, userId, apiKeyId, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	transactionStatus := TransactionPartiallyRefunded
+	if refunded == captured {
+		transactionStatus = TransactionRefunded
+		err = refundOrder(ctx, tx, refund.OrderId)
+	} else {
+		_, err = tx.ExecContext(ctx, `update orders set status_id = ?, updated_at = ? where id = ?`,
+			StatusPartiallyRefunded, time.Now(), refund.OrderId)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update transactions set transaction_status_id = ?, updated_at = ? where id = ?`,
+		transactionStatus, time.Now(), transactionId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetRefundsForOrder gets the refunds made against an order, oldest first
+func (m *DBModel) GetRefundsForOrder(orderId int) ([]Refund, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var refunds []Refund
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select
+		r.id, r.order_id, r.amount, r.reason, r.stripe_refund_id, coalesce(r.user_id, 0),
+		coalesce(r.api_key_id, 0),
+		coalesce(concat(u.first_name, ' ', u.last_name), concat('API key ', k.name), ''),
+		r.created_at, r.updated_at
+	from
+		refunds r
+		left join users u on (r.user_id = u.id)
+		left join api_keys k on (r.api_key_id = k.id)
+	where r.order_id = ?
+	order by r.created_at, r.id`, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Refund
+		err = rows.Scan(
+			&r.Id,
+			&r.OrderId,
+			&r.Amount,
+			&r.Reason,
+			&r.StripeRefundId,
+			&r.UserId,
+			&r.APIKeyId,
+			&r.Operator,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, r)
+	}
+
+	return refunds, rows.Err()
+}
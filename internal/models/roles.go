@@ -0,0 +1,183 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Permissions an admin user can be given through their role, matching the permissions table
+const (
+	PermissionViewSales           = "sales.view"
+	PermissionRefund              = "sales.refund"
+	PermissionManageSubscriptions = "subscriptions.manage"
+	PermissionManageDisputes      = "disputes.manage"
+	PermissionVirtualTerminal     = "terminal.charge"
+	PermissionManageWidgets       = "widgets.manage"
+	PermissionManageUsers         = "users.manage"
+	PermissionManageAPIKeys       = "apikeys.manage"
+)
+
+// RoleViewer is the role new admin users get unless they are given another
+const RoleViewer = 1
+
+// ErrLastUserManager is returned for a change that would leave nobody able to manage users
+var ErrLastUserManager = errors.New("at least one user must be able to manage users")
+
+// Role is a named set of permissions given to admin users
+type Role struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	// RequireTwoFactor makes everyone with the role set up two-factor authentication
+	RequireTwoFactor bool         `json:"require_two_factor"`
+	Permissions      []Permission `json:"permissions"`
+}
+
+// Permission is one thing an admin user can be allowed to do
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Can reports whether the user's role gives them permission
+func (u *User) Can(permission string) bool {
+	for _, p := range u.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// TwoFactorPending reports whether the user has to set up two-factor authentication
+// before they are given their permissions
+func (u *User) TwoFactorPending() bool {
+	return (u.RequireTwoFactor || u.RoleRequiresTwoFactor) && !u.TwoFactorEnabled
+}
+
+// GetRoles gets every role with its permissions
+func (m *DBModel) GetRoles() ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var roles []*Role
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select r.id, r.name, r.two_factor_required, coalesce(p.name, ''), coalesce(p.description, '')
+	from roles r
+		left join role_permissions rp on (rp.role_id = r.id)
+		left join permissions p on (rp.permission_id = p.id)
+	order by r.id, p.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var name string
+		var requireTwoFactor bool
+		var p Permission
+
+		err = rows.Scan(&id, &name, &requireTwoFactor, &p.Name, &p.Description)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].Id != id {
+			roles = append(roles, &Role{Id: id, Name: name, RequireTwoFactor: requireTwoFactor, Permissions: []Permission{}})
+		}
+		if p.Name != "" {
+			role := roles[len(roles)-1]
+			role.Permissions = append(role.Permissions, p)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// GetUserPermissions gets the names of the permissions the role of a user gives them. A
+// user who has to set up two-factor authentication gets none until they have.
+func (m *DBModel) GetUserPermissions(userId int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	permissions := []string{}
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select p.name
+	from users u
+		inner join roles r on (u.role_id = r.id)
+		inner join role_permissions rp on (rp.role_id = u.role_id)
+		inner join permissions p on (rp.permission_id = p.id)
+	where u.id = ?
+		and (u.totp_enabled_at is not null or (u.two_factor_required = 0 and r.two_factor_required = 0))
+	order by p.id`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, name)
+	}
+
+	return permissions, rows.Err()
+}
+
+// countUserManagers counts the users other than excludeId whose role lets them manage users
+func (m *DBModel) countUserManagers(ctx context.Context, excludeId int) (int, error) {
+	var count int
+
+	row := m.DB.QueryRowContext(ctx, `
+	select count(distinct u.id)
+	from users u
+		inner join role_permissions rp on (rp.role_id = u.role_id)
+		inner join permissions p on (rp.permission_id = p.id)
+	where p.name = ? and u.id <> ?`, PermissionManageUsers, excludeId)
+
+	err := row.Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// roleCan reports whether a role gives permission
+func (m *DBModel) roleCan(ctx context.Context, roleId int, permission string) (bool, error) {
+	var count int
+
+	row := m.DB.QueryRowContext(ctx, `
+	select count(*)
+	from role_permissions rp
+		inner join permissions p on (rp.permission_id = p.id)
+	where rp.role_id = ? and p.name = ?`, roleId, permission)
+
+	err := row.Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// SetRoleTwoFactor sets whether everyone with a role has to use two-factor authentication
+func (m *DBModel) SetRoleTwoFactor(roleId int, required bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+	update roles set two_factor_required = ?, updated_at = ? where id = ?`,
+		required, time.Now(), roleId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
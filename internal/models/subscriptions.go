@@ -0,0 +1,235 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// PendingSubscription is a subscription whose first payment is waiting for the customer
+// to authenticate it; its order is only saved once the payment has succeeded
+type PendingSubscription struct {
+	SubscriptionId string      `json:"subscription_id"`
+	Customer       Customer    `json:"customer"`
+	Transaction    Transaction `json:"transaction"`
+	Order          Order       `json:"order"`
+}
+
+// ChangeSubscriptionWidget moves a subscription order, and its line item, to another plan
+func (m *DBModel) ChangeSubscriptionWidget(orderId int, widget Widget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+	update orders set widget_id = ?, amount = ? * quantity, updated_at = ? where id = ?`,
+		widget.Id, widget.Price, time.Now(), orderId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	update order_items set widget_id = ?, unit_price = ?, amount = ? * quantity, updated_at = ?
+	where order_id = ?`,
+		widget.Id, widget.Price, widget.Price, time.Now(), orderId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetWidgetByPlan gets the widget sold as a Stripe plan, priced in the plan's currency
+func (m *DBModel) GetWidgetByPlan(planId string) (Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	var currency string
+
+	row := m.DB.QueryRowContext(ctx, `
+	select id, '' from widgets where plan_id = ? and is_recurring = 1
+	union all
+	select p.widget_id, p.currency
+	from widget_prices p left join widgets w on (p.widget_id = w.id)
+	where p.plan_id = ? and w.is_recurring = 1
+	limit 1`, planId, planId)
+
+	err := row.Scan(&id, &currency)
+	if err != nil {
+		return Widget{}, err
+	}
+
+	widget, err := m.GetWidget(id)
+	if err != nil {
+		return widget, err
+	}
+
+	return m.InCurrency(widget, currency)
+}
+
+// UpdateSubscriptionStatus sets the status of the order for a subscription; orders that
+// have been refunded keep their status
+func (m *DBModel) UpdateSubscriptionStatus(subId string, statusId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update orders o
+		inner join transactions t on (o.transaction_id = t.id)
+	set o.status_id = ?, o.updated_at = ?
+	where t.payment_intent = ? and o.status_id not in (?, ?)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, statusId, time.Now(), subId, StatusRefunded, StatusPartiallyRefunded)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RecordRenewal records the payment of a subscription renewal once per payment intent: a
+// redelivered invoice, or one paid after failing, updates the transaction already recorded
+// for its payment instead of adding another. A paid renewal also ends the subscription's
+// dunning and clears its order in the same SQL transaction. It returns false, recording
+// nothing, for a failure that arrives after the payment was already recorded as paid.
+func (m *DBModel) RecordRenewal(subId string, txn Transaction) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id, statusId int
+	err = tx.QueryRowContext(ctx, `
+	select id, transaction_status_id from transactions where payment_intent = ? for update`,
+		txn.PaymentIntent).Scan(&id, &statusId)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = insertTransaction(ctx, tx, txn)
+	} else if err == nil {
+		if statusId == TransactionCleared && txn.TransactionStatusId != TransactionCleared {
+			return false, nil
+		}
+		_, err = tx.ExecContext(ctx, `
+		update transactions set amount = ?, bank_return_code = ?, transaction_status_id = ?, updated_at = ?
+		where id = ?`,
+			txn.Amount, txn.BankReturnCode, txn.TransactionStatusId, time.Now(), id)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if txn.TransactionStatusId == TransactionCleared {
+		_, err = tx.ExecContext(ctx, `delete from dunning where subscription_id = ?`, subId)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+		update orders o
+			inner join transactions t on (o.transaction_id = t.id)
+		set o.status_id = ?, o.updated_at = ?
+		where t.payment_intent = ?`,
+			StatusCleared, time.Now(), subId)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// UpdateSubscriptionCard records the card a subscription is now paid with
+func (m *DBModel) UpdateSubscriptionCard(transactionId int, pm, lastFour string, expiryMonth, expiryYear int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update transactions
+	set payment_method = ?, last_four = ?, expiry_month = ?, expiry_year = ?, updated_at = ?
+	where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, pm, lastFour, expiryMonth, expiryYear, time.Now(), transactionId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertPendingSubscription keeps the order of a subscription until its first payment
+// has been authenticated
+func (m *DBModel) InsertPendingSubscription(p PendingSubscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	stmt := `
+	insert into pending_subscriptions (subscription_id, order_data, created_at, updated_at)
+	values (?, ?, ?, ?)`
+
+	_, err = m.DB.ExecContext(ctx, stmt, p.SubscriptionId, data, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetPendingSubscription gets the order kept for a subscription waiting on authentication
+func (m *DBModel) GetPendingSubscription(subId string) (PendingSubscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var p PendingSubscription
+	var data []byte
+
+	row := m.DB.QueryRowContext(ctx,
+		`select order_data from pending_subscriptions where subscription_id = ?`, subId)
+
+	err := row.Scan(&data)
+	if err != nil {
+		return p, err
+	}
+
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// DeletePendingSubscription removes the order kept for a subscription and returns false
+// if it had already been removed, so that only one caller goes on to save the order
+func (m *DBModel) DeletePendingSubscription(subId string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx,
+		`delete from pending_subscriptions where subscription_id = ?`, subId)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
@@ -0,0 +1,215 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/sindrishtepani/go-stripe/internal/tax"
+)
+
+// OrderTax is the type for one tax charged on an order
+type OrderTax struct {
+	Id        int       `json:"id"`
+	OrderId   int       `json:"order_id"`
+	TaxRateId int       `json:"tax_rate_id"`
+	Name      string    `json:"name"`
+	Rate      float64   `json:"rate"`
+	Inclusive bool      `json:"inclusive"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// OrderTaxes returns the tax lines to store on an order for a tax calculation
+func OrderTaxes(result tax.Result) []OrderTax {
+	var taxes []OrderTax
+	for _, line := range result.Lines {
+		taxes = append(taxes, OrderTax{
+			TaxRateId: line.RuleId,
+			Name:      line.Name,
+			Rate:      line.Rate,
+			Inclusive: line.Inclusive,
+			Amount:    line.Amount,
+		})
+	}
+	return taxes
+}
+
+// GetTaxRules gets every tax rate as a rule for the tax calculator
+func (m *DBModel) GetTaxRules() ([]tax.Rule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rules []tax.Rule
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select
+		id, stripe_tax_rate_id, country, region, name, rate, inclusive
+	from
+		tax_rates
+	order by country, region, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r tax.Rule
+		err = rows.Scan(
+			&r.Id,
+			&r.StripeId,
+			&r.Country,
+			&r.Region,
+			&r.Name,
+			&r.Rate,
+			&r.Inclusive,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, rows.Err()
+}
+
+// GetTaxExemptions gets the email addresses of the customers who pay no tax
+func (m *DBModel) GetTaxExemptions() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var emails []string
+
+	rows, err := m.DB.QueryContext(ctx, `select email from tax_exemptions order by email`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+
+	return emails, rows.Err()
+}
+
+// LinkTaxRateToStripe records the Stripe tax rate a tax rate is charged as on subscriptions
+func (m *DBModel) LinkTaxRateToStripe(id int, stripeId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update tax_rates set stripe_tax_rate_id = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, stripeId, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetOrderTaxes gets the taxes charged on an order
+func (m *DBModel) GetOrderTaxes(orderId int) ([]OrderTax, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var taxes []OrderTax
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select
+		id, order_id, coalesce(tax_rate_id, 0), name, rate, inclusive, amount, created_at, updated_at
+	from
+		order_taxes
+	where order_id = ?
+	order by id`, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t OrderTax
+		err = rows.Scan(
+			&t.Id,
+			&t.OrderId,
+			&t.TaxRateId,
+			&t.Name,
+			&t.Rate,
+			&t.Inclusive,
+			&t.Amount,
+			&t.CreatedAt,
+			&t.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		taxes = append(taxes, t)
+	}
+
+	return taxes, rows.Err()
+}
+
+// insertOrderTaxes stores the taxes charged on an order
+func insertOrderTaxes(ctx context.Context, db execer, orderId int, taxes []OrderTax) error {
+	for _, t := range taxes {
+		var taxRateId sql.NullInt64
+		if t.TaxRateId > 0 {
+			taxRateId = sql.NullInt64{Int64: int64(t.TaxRateId), Valid: true}
+		}
+
+		_, err := db.ExecContext(ctx, `
+		insert into order_taxes
+			(order_id, tax_rate_id, name, rate, inclusive, amount, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`,
+			orderId, taxRateId, t.Name, t.Rate, t.Inclusive, t.Amount, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewTaxCalculator returns the tax calculator named by kind, reading the rates and
+// exemptions a rule table needs from the database. Changes to either are picked up
+// when the calculator is next created.
+func (m *DBModel) NewTaxCalculator(kind string) (tax.Calculator, error) {
+	if kind != "rules" {
+		return tax.New(kind, nil, nil)
+	}
+
+	rules, err := m.GetTaxRules()
+	if err != nil {
+		return nil, err
+	}
+
+	exempt, err := m.GetTaxExemptions()
+	if err != nil {
+		return nil, err
+	}
+
+	return tax.New(kind, rules, exempt)
+}
+
+// GetTaxRateStripeId gets the Stripe tax rate a tax rate has been linked to, if any
+func (m *DBModel) GetTaxRateStripeId(id int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stripeId string
+
+	row := m.DB.QueryRowContext(ctx, `select stripe_tax_rate_id from tax_rates where id = ?`, id)
+
+	err := row.Scan(&stripeId)
+	if err != nil {
+		return "", err
+	}
+
+	return stripeId, nil
+}
@@ -4,12 +4,19 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base32"
 	"time"
 )
 
 const (
 	ScopeAuthentication = "authentication"
+	// ScopeRefresh tokens are traded for a new authentication token once the old one
+	// expires; each can be used once
+	ScopeRefresh = "refresh"
+	// ScopeCustomer tokens sign a customer in to their own account; their UserId is
+	// the id of the customer
+	ScopeCustomer = "customer"
 )
 
 // Token is the type for auth tokens
@@ -19,6 +26,20 @@ type Token struct {
 	Hash      []byte    `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// Refresh is the refresh token issued with an authentication token
+	Refresh *Token `json:"refresh_token,omitempty"`
+	// UserAgent is the browser or client the token was issued to
+	UserAgent string `json:"-"`
+}
+
+// ActiveToken describes a signed in session of an admin user, without its secrets
+type ActiveToken struct {
+	Id            int       `json:"id"`
+	UserAgent     string    `json:"user_agent"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastUsedAt    time.Time `json:"last_used_at"`
+	Expiry        time.Time `json:"expiry"`
+	RefreshExpiry time.Time `json:"refresh_expiry"`
 }
 
 // GenerateToken generates a token that lasts for ttl, and returns it
@@ -41,29 +62,120 @@ func GenerateToken(userId int, ttl time.Duration, scope string) (*Token, error)
 	return token, nil
 }
 
+// InsertToken stores an authentication token, and its refresh token, as a new session of
+// the user; the user's other sessions stay signed in
 func (m *DBModel) InsertToken(t *Token, u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `delete from tokens where user_id = ?`
-	_, err := m.DB.ExecContext(ctx, stmt, u.Id)
-	if err != nil {
-		return err
+	var refreshHash []byte
+	var refreshExpiry sql.NullTime
+	if t.Refresh != nil {
+		refreshHash = t.Refresh.Hash
+		refreshExpiry = sql.NullTime{Time: t.Refresh.Expiry, Valid: true}
 	}
 
-	stmt = `
-	insert into tokens (user_id, name, email, token_hash, created_at, updated_at, expiry_date)
-	values (?, ?, ?, ?, ?, ?, ?)`
+	stmt := `
+	insert into tokens
+		(user_id, name, email, token_hash, refresh_token_hash, user_agent, created_at, updated_at,
+		expiry_date, refresh_expiry_date)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	_, err = m.DB.ExecContext(ctx, stmt,
+	_, err := m.DB.ExecContext(ctx, stmt,
 		u.Id,
 		u.LastName,
 		u.Email,
 		t.Hash,
+		refreshHash,
+		t.UserAgent,
 		time.Now(),
 		time.Now(),
 		t.Expiry,
+		refreshExpiry,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetUserByRefreshToken gets the admin user a refresh token that has not expired was issued to
+func (m *DBModel) GetUserByRefreshToken(refreshToken string) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	refreshHash := sha256.Sum256([]byte(refreshToken))
+	var user User
+
+	query := `
+	select users.id, users.first_name, users.last_name, users.email, users.role_id
+	from users
+	inner join tokens
+	on users.id = tokens.user_id
+	where tokens.refresh_token_hash = ? and tokens.refresh_expiry_date > ?`
+
+	err := m.DB.QueryRowContext(ctx, query, refreshHash[:], time.Now()).Scan(
+		&user.Id,
+		&user.FirstName,
+		&user.LastName,
+		&user.Email,
+		&user.RoleId,
 	)
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// RotateToken replaces the tokens of the session refreshToken belongs to with next and its
+// refresh token. It returns false when refreshToken has expired or has already been used.
+func (m *DBModel) RotateToken(refreshToken string, next *Token) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	refreshHash := sha256.Sum256([]byte(refreshToken))
+
+	result, err := m.DB.ExecContext(ctx, `
+	update tokens
+	set token_hash = ?, expiry_date = ?, refresh_token_hash = ?, refresh_expiry_date = ?, updated_at = ?
+	where refresh_token_hash = ? and refresh_expiry_date > ?`,
+		next.Hash, next.Expiry, next.Refresh.Hash, next.Refresh.Expiry, time.Now(),
+		refreshHash[:], time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+// DeleteToken signs out the session a token belongs to
+func (m *DBModel) DeleteToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+
+	_, err := m.DB.ExecContext(ctx, `delete from tokens where token_hash = ?`, tokenHash[:])
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteTokensForUser signs an admin user out everywhere
+func (m *DBModel) DeleteTokensForUser(userId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from tokens where user_id = ? and user_id <> 0`, userId)
 	if err != nil {
 		return err
 	}
@@ -71,6 +183,77 @@ func (m *DBModel) InsertToken(t *Token, u User) error {
 	return nil
 }
 
+// GetActiveTokens gets the sessions of an admin user that can still be used or refreshed
+func (m *DBModel) GetActiveTokens(userId int) ([]*ActiveToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tokens []*ActiveToken
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select id, user_agent, created_at, updated_at, expiry_date, refresh_expiry_date
+	from tokens
+	where user_id = ? and user_id <> 0 and (expiry_date > ? or refresh_expiry_date > ?)
+	order by updated_at desc`, userId, time.Now(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t ActiveToken
+		var refreshExpiry sql.NullTime
+
+		err = rows.Scan(
+			&t.Id,
+			&t.UserAgent,
+			&t.CreatedAt,
+			&t.LastUsedAt,
+			&t.Expiry,
+			&refreshExpiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+		t.RefreshExpiry = refreshExpiry.Time
+
+		tokens = append(tokens, &t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// RevokeToken signs out one session of an admin user
+func (m *DBModel) RevokeToken(userId, tokenId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from tokens where id = ? and user_id = ? and user_id <> 0`,
+		tokenId, userId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteExpiredTokens deletes the tokens that can neither be used nor refreshed any more,
+// and returns how many there were
+func (m *DBModel) DeleteExpiredTokens() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+	delete from tokens
+	where expiry_date < ? and (refresh_expiry_date is null or refresh_expiry_date < ?)`,
+		time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
 func (m *DBModel) GetUserByToken(token string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -79,10 +262,14 @@ func (m *DBModel) GetUserByToken(token string) (*User, error) {
 	var user User
 
 	query := `
-	select users.id, users.first_name, users.last_name, users.email 
+	select
+		users.id, users.first_name, users.last_name, users.email, users.role_id,
+		users.two_factor_required, roles.two_factor_required, users.totp_enabled_at is not null
 	from users
 	inner join tokens
 	on users.id = tokens.user_id
+	inner join roles
+	on users.role_id = roles.id
 	where tokens.token_hash = ? and tokens.expiry_date > ?`
 
 	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
@@ -90,10 +277,78 @@ func (m *DBModel) GetUserByToken(token string) (*User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&user.RoleId,
+		&user.RequireTwoFactor,
+		&user.RoleRequiresTwoFactor,
+		&user.TwoFactorEnabled,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	user.Permissions, err = m.GetUserPermissions(user.Id)
+	if err != nil {
+		return nil, err
+	}
+
 	return &user, nil
 }
+
+// InsertCustomerToken stores a token that signs a customer in, replacing any they had
+func (m *DBModel) InsertCustomerToken(t *Token, c Customer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `delete from tokens where customer_id = ?`
+	_, err := m.DB.ExecContext(ctx, stmt, c.Id)
+	if err != nil {
+		return err
+	}
+
+	stmt = `
+	insert into tokens (user_id, customer_id, name, email, token_hash, created_at, updated_at, expiry_date)
+	values (0, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = m.DB.ExecContext(ctx, stmt,
+		c.Id,
+		c.LastName,
+		c.Email,
+		t.Hash,
+		time.Now(),
+		time.Now(),
+		t.Expiry,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetCustomerByToken gets the customer a customer token was issued to
+func (m *DBModel) GetCustomerByToken(token string) (*Customer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+	var customer Customer
+
+	query := `
+	select customers.id, customers.first_name, customers.last_name, customers.email
+	from customers
+	inner join tokens
+	on customers.id = tokens.customer_id
+	where tokens.token_hash = ? and tokens.expiry_date > ?`
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
+		&customer.Id,
+		&customer.FirstName,
+		&customer.LastName,
+		&customer.Email,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &customer, nil
+}
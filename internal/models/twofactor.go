@@ -0,0 +1,264 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrTwoFactorEnabled is returned when two-factor authentication is turned on for a user
+// who already has it
+var ErrTwoFactorEnabled = errors.New("two-factor authentication is already turned on")
+
+// recoveryCodeCount is how many recovery codes a user is given at a time
+const recoveryCodeCount = 10
+
+// TwoFactor is the two-factor authentication of an admin user
+type TwoFactor struct {
+	UserId int
+	// Secret is the user's totp secret, encrypted; it is set while they are setting up
+	// two-factor authentication as well as once they have
+	Secret string
+	// EnabledAt is zero until the user has confirmed a code from their authenticator app
+	EnabledAt time.Time
+	// LastStep is the period of the last code the user signed in with
+	LastStep int64
+}
+
+// Enabled reports whether the user signs in with a second factor
+func (t TwoFactor) Enabled() bool {
+	return !t.EnabledAt.IsZero()
+}
+
+// GenerateRecoveryCodes generates a set of recovery codes, each of which can be used once
+// in place of a code from an authenticator app, and returns them with their hashes
+func GenerateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 8)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, however it was typed
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// GetTwoFactor gets the two-factor authentication of an admin user
+func (m *DBModel) GetTwoFactor(userId int) (TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	t := TwoFactor{UserId: userId}
+	var enabledAt sql.NullTime
+
+	row := m.DB.QueryRowContext(ctx, `
+	select coalesce(totp_secret, ''), totp_enabled_at, totp_last_step from users where id = ?`, userId)
+
+	err := row.Scan(&t.Secret, &enabledAt, &t.LastStep)
+	if err != nil {
+		return t, err
+	}
+	t.EnabledAt = enabledAt.Time
+
+	return t, nil
+}
+
+// SetTwoFactorSecret stores the encrypted secret of a user setting up two-factor
+// authentication; it is not used to sign in until EnableTwoFactor is called
+func (m *DBModel) SetTwoFactorSecret(userId int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+	update users set totp_secret = ?, totp_last_step = 0, updated_at = ?
+	where id = ? and totp_enabled_at is null`,
+		secret, time.Now(), userId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user, once they have confirmed
+// the code for step, and gives them a new set of recovery codes
+func (m *DBModel) EnableTwoFactor(userId int, step int64, recoveryCodes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+	update users set totp_enabled_at = ?, totp_last_step = ?, updated_at = ?
+	where id = ? and totp_enabled_at is null`,
+		time.Now(), step, time.Now(), userId)
+	if err != nil {
+		return err
+	}
+
+	// a concurrent request may have turned it on already, with its own recovery codes
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, userId, recoveryCodes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and deletes their
+// secret and recovery codes
+func (m *DBModel) DisableTwoFactor(userId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+	update users set totp_secret = null, totp_enabled_at = null, totp_last_step = 0, updated_at = ?
+	where id = ?`,
+		time.Now(), userId)
+	if err != nil {
+		return err
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, userId, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTwoFactorStep records that a user signed in with the code for step. It returns false
+// if they have already signed in with that code, or a later one.
+func (m *DBModel) UseTwoFactorStep(userId int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+	update users set totp_last_step = ? where id = ? and totp_last_step < ?`,
+		step, userId, step)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// ReplaceRecoveryCodes gives a user a new set of recovery codes; their old ones stop working
+func (m *DBModel) ReplaceRecoveryCodes(userId int, recoveryCodes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(ctx, tx, userId, recoveryCodes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userId int, recoveryCodes [][]byte) error {
+	_, err := tx.ExecContext(ctx, `delete from recovery_codes where user_id = ?`, userId)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `
+		insert into recovery_codes (user_id, code_hash, created_at, updated_at) values (?, ?, ?, ?)`,
+			userId, hash, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode uses up one of a user's recovery codes, and reports whether it was one
+// they had not used yet
+func (m *DBModel) UseRecoveryCode(userId int, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+	update recovery_codes set used_at = ?, updated_at = ?
+	where user_id = ? and code_hash = ? and used_at is null`,
+		time.Now(), time.Now(), userId, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// CountRecoveryCodes counts the recovery codes a user has left
+func (m *DBModel) CountRecoveryCodes(userId int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+
+	row := m.DB.QueryRowContext(ctx, `
+	select count(id) from recovery_codes where user_id = ? and used_at is null`, userId)
+
+	err := row.Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// GetAllWidgets gets every widget, or only the ones in the catalog when activeOnly is set
+func (m *DBModel) GetAllWidgets(activeOnly bool) ([]*Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var widgets []*Widget
+
+	query := `
+	select
+		id, name, description, inventory_level, price, image, is_recurring, plan_id, active,
+		stripe_product_id, currency, billing_interval, trial_days, created_at, updated_at
+	from
+		widgets`
+
+	if activeOnly {
+		query += ` where active = 1`
+	}
+	query += ` order by name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var w Widget
+		err = rows.Scan(
+			&w.Id,
+			&w.Name,
+			&w.Description,
+			&w.Inventorylevel,
+			&w.Price,
+			&w.Image,
+			&w.IsRecurring,
+			&w.PlanId,
+			&w.Active,
+			&w.StripeProduct,
+			&w.Currency,
+			&w.Interval,
+			&w.TrialDays,
+			&w.CreatedAt,
+			&w.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		widgets = append(widgets, &w)
+	}
+
+	return widgets, nil
+}
+
+// InsertWidget inserts a widget and returns its id
+func (m *DBModel) InsertWidget(w Widget) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	insert into widgets
+		(name, description, inventory_level, price, image, is_recurring, plan_id, active,
+			stripe_product_id, currency, billing_interval, trial_days, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		w.Name,
+		w.Description,
+		w.Inventorylevel,
+		w.Price,
+		w.Image,
+		w.IsRecurring,
+		w.PlanId,
+		w.Active,
+		w.StripeProduct,
+		w.Currency,
+		w.Interval,
+		w.TrialDays,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// ErrNegativeInventory is returned when a stock change would take more of a widget out of
+// stock than there is
+var ErrNegativeInventory = errors.New("cannot take more out of stock than there is")
+
+// UpdateWidget saves the details of a widget; its image is changed with UpdateWidgetImage
+// and its Stripe product with LinkWidgetToStripe. Its stock is not overwritten, so that
+// sales made while it was being edited are kept; inventoryChange is added to it instead.
+// Changing the price, currency or billing of a widget clears its plan id, since the Stripe
+// price no longer matches, unless a new plan id is set along with it.
+func (m *DBModel) UpdateWidget(w Widget, inventoryChange int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var inventory int
+	row := tx.QueryRowContext(ctx, `select inventory_level from widgets where id = ? for update`, w.Id)
+	err = row.Scan(&inventory)
+	if err != nil {
+		return err
+	}
+	if inventory+inventoryChange < 0 {
+		return ErrNegativeInventory
+	}
+
+	// plan_id is set first, since later assignments see the new price
+	stmt := `
+	update widgets set
+		plan_id = if(plan_id <> ? or (price = ? and currency = ? and is_recurring = ? and billing_interval = ?), ?, ''),
+		name = ?, description = ?, inventory_level = inventory_level + ?, price = ?,
+		is_recurring = ?, active = ?, currency = ?, billing_interval = ?, trial_days = ?,
+		updated_at = ?
+	where id = ?`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		w.PlanId,
+		w.Price,
+		w.Currency,
+		w.IsRecurring,
+		w.Interval,
+		w.PlanId,
+		w.Name,
+		w.Description,
+		inventoryChange,
+		w.Price,
+		w.IsRecurring,
+		w.Active,
+		w.Currency,
+		w.Interval,
+		w.TrialDays,
+		time.Now(),
+		w.Id,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateWidgetImage sets the image of a widget
+func (m *DBModel) UpdateWidgetImage(id int, image string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update widgets set image = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, image, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeactivateWidget takes a widget out of the catalog. Widgets are never deleted,
+// since past orders refer to them.
+func (m *DBModel) DeactivateWidget(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update widgets set active = 0, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LinkWidgetToStripe records the Stripe product and price a widget is sold as
+func (m *DBModel) LinkWidgetToStripe(id int, productId, priceId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update widgets set stripe_product_id = ?, plan_id = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, productId, priceId, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+// Package money formats and parses amounts of money. Amounts are always held as integers
+// in the smallest unit Stripe uses for the currency: cents for CAD, but whole yen for JPY.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Default is the currency used when none is given
+const Default = "cad"
+
+// Currency describes how amounts in a currency are written and charged
+type Currency struct {
+	// Code is the lower case ISO 4217 code, as Stripe uses it
+	Code string
+	// Symbol is written before the amount
+	Symbol string
+	// Decimals is the number of digits after the decimal point; zero-decimal
+	// currencies are charged in whole units
+	Decimals int
+	// Minimum is the smallest amount Stripe will charge a card, in the smallest unit
+	Minimum int
+}
+
+// currencies are the currencies widgets can be priced in. Symbols follow the en-CA
+// locale the storefront is written for.
+var currencies = map[string]Currency{
+	"cad": {Code: "cad", Symbol: "$", Decimals: 2, Minimum: 50},
+	"usd": {Code: "usd", Symbol: "US$", Decimals: 2, Minimum: 50},
+	"eur": {Code: "eur", Symbol: "€", Decimals: 2, Minimum: 50},
+	"gbp": {Code: "gbp", Symbol: "£", Decimals: 2, Minimum: 30},
+	"aud": {Code: "aud", Symbol: "A$", Decimals: 2, Minimum: 50},
+	"jpy": {Code: "jpy", Symbol: "JP¥", Decimals: 0, Minimum: 50},
+}
+
+// ErrUnsupportedCurrency is returned for a currency that widgets cannot be priced in
+var ErrUnsupportedCurrency = errors.New("unsupported currency")
+
+// ErrInvalidAmount is returned when an amount cannot be parsed
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Normalize returns code in the lower case form Stripe uses, or Default when it is empty
+func Normalize(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		return Default
+	}
+	return code
+}
+
+// Supported reports whether widgets can be priced in the currency
+func Supported(code string) bool {
+	_, ok := currencies[Normalize(code)]
+	return ok
+}
+
+// Codes returns the supported currency codes, with Default first
+func Codes() []string {
+	return []string{"cad", "usd", "eur", "gbp", "aud", "jpy"}
+}
+
+// Lookup returns the currency for code. Unknown currencies are written with their
+// code and two decimals, so that an amount Stripe reports is never lost.
+func Lookup(code string) Currency {
+	code = Normalize(code)
+	if c, ok := currencies[code]; ok {
+		return c
+	}
+	return Currency{Code: code, Symbol: strings.ToUpper(code) + " ", Decimals: 2, Minimum: 50}
+}
+
+// Decimals returns the number of digits after the decimal point in the currency
+func Decimals(code string) int {
+	return Lookup(code).Decimals
+}
+
+// Minimum returns the smallest amount Stripe will charge in the currency
+func Minimum(code string) int {
+	return Lookup(code).Minimum
+}
+
+// Major converts an amount to whole units of the currency, e.g. 1050 cents to 10.5
+func Major(amount int, code string) float64 {
+	return float64(amount) / math.Pow10(Decimals(code))
+}
+
+// Format writes an amount with the currency symbol, grouping thousands, e.g. $1,050.00 or JP¥1,050
+func Format(amount int, code string) string {
+	c := Lookup(code)
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	unit := int(math.Pow10(c.Decimals))
+	whole := group(strconv.Itoa(amount / unit))
+	if c.Decimals == 0 {
+		return sign + c.Symbol + whole
+	}
+
+	return fmt.Sprintf("%s%s%s.%0*d", sign, c.Symbol, whole, c.Decimals, amount%unit)
+}
+
+// group puts a comma between every three digits
+func group(digits string) string {
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return b.String()
+}
+
+// Parse reads an amount written in whole units, such as "10.50", into the smallest unit
+// of the currency. Only digits and a decimal point are accepted: signs, symbols and
+// thousands separators are not, so a negative amount is never returned.
+func Parse(s, code string) (int, error) {
+	decimals := Decimals(code)
+
+	s = strings.TrimSpace(s)
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" && !hasFrac {
+		return 0, ErrInvalidAmount
+	}
+	if len(frac) > decimals || (hasFrac && (decimals == 0 || frac == "")) {
+		return 0, ErrInvalidAmount
+	}
+	if !digits(whole) || !digits(frac) {
+		return 0, ErrInvalidAmount
+	}
+
+	unit := int(math.Pow10(decimals))
+
+	units := 0
+	if whole != "" {
+		n, err := strconv.Atoi(whole)
+		if err != nil || n > math.MaxInt/unit-1 {
+			return 0, ErrInvalidAmount
+		}
+		units = n
+	}
+
+	cents := 0
+	if frac != "" {
+		n, err := strconv.Atoi(frac + strings.Repeat("0", decimals-len(frac)))
+		if err != nil {
+			return 0, ErrInvalidAmount
+		}
+		cents = n
+	}
+
+	return units*unit + cents, nil
+}
+
+// digits reports whether s is made of ASCII digits only
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
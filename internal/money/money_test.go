@@ -0,0 +1,95 @@
+package money
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     int
+		err      error
+	}{
+		{"10.50", "cad", 1050, nil},
+		{"10.5", "cad", 1050, nil},
+		{"10", "cad", 1000, nil},
+		{".5", "cad", 50, nil},
+		{" 0.01 ", "usd", 1, nil},
+		{"0", "cad", 0, nil},
+		{"1050", "jpy", 1050, nil},
+		{"1050", "JPY", 1050, nil},
+		{"10.50", "xyz", 1050, nil},
+
+		{"-0.50", "cad", 0, ErrInvalidAmount},
+		{"-10", "cad", 0, ErrInvalidAmount},
+		{"-1050", "jpy", 0, ErrInvalidAmount},
+		{"+10", "cad", 0, ErrInvalidAmount},
+		{"1.+5", "cad", 0, ErrInvalidAmount},
+		{"1.-5", "cad", 0, ErrInvalidAmount},
+		{"", "cad", 0, ErrInvalidAmount},
+		{".", "cad", 0, ErrInvalidAmount},
+		{"10.", "cad", 0, ErrInvalidAmount},
+		{"10.505", "cad", 0, ErrInvalidAmount},
+		{"1.5", "jpy", 0, ErrInvalidAmount},
+		{"1050.", "jpy", 0, ErrInvalidAmount},
+		{"$10", "cad", 0, ErrInvalidAmount},
+		{"1,050.00", "cad", 0, ErrInvalidAmount},
+		{"1 050", "cad", 0, ErrInvalidAmount},
+		{"10.5.0", "cad", 0, ErrInvalidAmount},
+		{"1e3", "cad", 0, ErrInvalidAmount},
+		{"abc", "cad", 0, ErrInvalidAmount},
+		{"99999999999999999999", "cad", 0, ErrInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in, tt.currency)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Parse(%q, %q) = %d, %v, want %d, %v", tt.in, tt.currency, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		amount   int
+		currency string
+		want     string
+	}{
+		{1050, "cad", "$10.50"},
+		{5, "cad", "$0.05"},
+		{0, "cad", "$0.00"},
+		{105000, "usd", "US$1,050.00"},
+		{123456789, "eur", "€1,234,567.89"},
+		{-1050, "gbp", "-£10.50"},
+		{1050, "jpy", "JP¥1,050"},
+		{0, "jpy", "JP¥0"},
+		{999, "jpy", "JP¥999"},
+		{-1000000, "jpy", "-JP¥1,000,000"},
+		{1050, "", "$10.50"},
+		{1050, "xyz", "XYZ 10.50"},
+	}
+
+	for _, tt := range tests {
+		if got := Format(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("Format(%d, %q) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+// TestParseFormat checks that what Format writes without its symbol is read back by Parse
+func TestParseFormat(t *testing.T) {
+	for _, currency := range Codes() {
+		for _, amount := range []int{0, 1, 50, 999, 1050, 123456} {
+			c := Lookup(currency)
+			s := Format(amount, currency)[len(c.Symbol):]
+
+			got, err := Parse(strings.ReplaceAll(s, ",", ""), currency)
+			if err != nil || got != amount {
+				t.Errorf("%s: Parse(Format(%d)) = %d, %v", currency, amount, got, err)
+			}
+		}
+	}
+}
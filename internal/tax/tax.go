@@ -0,0 +1,201 @@
+// Package tax works out the sales tax owed on an amount
+package tax
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Calculator works out the tax on a sale
+type Calculator interface {
+	Calculate(r Request) (Result, error)
+}
+
+// Request describes a sale to be taxed. Amount is in cents and is the price as listed,
+// which already includes any inclusive tax.
+type Request struct {
+	// Customer is the email address of the buyer, used to look up exemptions
+	Customer string
+	// Country is an ISO 3166-1 alpha-2 code and Region a province or state code
+	Country string
+	Region  string
+	Amount  int
+}
+
+// Line is one tax charged on a sale
+type Line struct {
+	RuleId    int
+	StripeId  string
+	Country   string
+	Region    string
+	Name      string
+	Rate      float64
+	Inclusive bool
+	Amount    int
+}
+
+// Result is the tax owed on a sale. Subtotal is the amount without any tax and Total
+// is what the customer pays.
+type Result struct {
+	Subtotal int
+	Tax      int
+	Total    int
+	Exempt   bool
+	Lines    []Line
+}
+
+// ExclusiveTax is the part of the tax added on top of the listed price
+func (r Result) ExclusiveTax() int {
+	var amount int
+	for _, line := range r.Lines {
+		if !line.Inclusive {
+			amount += line.Amount
+		}
+	}
+	return amount
+}
+
+// New returns the calculator named by kind; "rules" taxes sales from a table of rates
+// and "none" charges no tax
+func New(kind string, rules []Rule, exempt []string) (Calculator, error) {
+	switch kind {
+	case "rules":
+		return NewRuleTable(rules, exempt), nil
+	case "none":
+		return NoTax{}, nil
+	default:
+		return nil, fmt.Errorf("unknown tax calculator %q", kind)
+	}
+}
+
+// NoTax is a Calculator that never charges tax
+type NoTax struct{}
+
+func (NoTax) Calculate(r Request) (Result, error) {
+	return untaxed(r.Amount, false), nil
+}
+
+func untaxed(amount int, exempt bool) Result {
+	return Result{
+		Subtotal: amount,
+		Total:    amount,
+		Exempt:   exempt,
+	}
+}
+
+// Rule is a tax rate charged in a country, or in one region of it. Rate is a percentage.
+type Rule struct {
+	Id        int
+	StripeId  string
+	Country   string
+	Region    string
+	Name      string
+	Rate      float64
+	Inclusive bool
+}
+
+// RuleTable is a Calculator driven by a table of rates. The rules for a region replace
+// the rules for its whole country, so a region lists every tax charged in it.
+type RuleTable struct {
+	rules  []Rule
+	exempt map[string]bool
+}
+
+// NewRuleTable returns a RuleTable for rules that does not tax the customers in exempt
+func NewRuleTable(rules []Rule, exempt []string) *RuleTable {
+	t := &RuleTable{
+		rules:  rules,
+		exempt: make(map[string]bool),
+	}
+
+	for _, customer := range exempt {
+		t.exempt[strings.ToLower(customer)] = true
+	}
+
+	return t
+}
+
+// Rules returns the rules that apply in a country and region
+func (t *RuleTable) Rules(country, region string) []Rule {
+	var countryRules, regionRules []Rule
+
+	for _, rule := range t.rules {
+		if !strings.EqualFold(rule.Country, country) {
+			continue
+		}
+
+		if rule.Region == "" {
+			countryRules = append(countryRules, rule)
+		} else if strings.EqualFold(rule.Region, region) {
+			regionRules = append(regionRules, rule)
+		}
+	}
+
+	if len(regionRules) > 0 {
+		return regionRules
+	}
+	return countryRules
+}
+
+// Calculate taxes a sale. Inclusive taxes are taken out of the listed price first, and
+// exclusive taxes are then charged on what is left.
+func (t *RuleTable) Calculate(r Request) (Result, error) {
+	if r.Amount < 0 {
+		return Result{}, fmt.Errorf("cannot tax a negative amount")
+	}
+
+	if t.exempt[strings.ToLower(r.Customer)] {
+		return untaxed(r.Amount, true), nil
+	}
+
+	rules := t.Rules(r.Country, r.Region)
+
+	var inclusiveRate float64
+	for _, rule := range rules {
+		if rule.Inclusive {
+			inclusiveRate += rule.Rate
+		}
+	}
+
+	// the price without inclusive tax, and the inclusive tax left to share out
+	subtotal := int(math.Round(float64(r.Amount) * 100 / (100 + inclusiveRate)))
+	inclusiveLeft := r.Amount - subtotal
+
+	result := Result{
+		Subtotal: subtotal,
+		Total:    r.Amount,
+	}
+
+	lastInclusive := -1
+	for _, rule := range rules {
+		line := Line{
+			RuleId:    rule.Id,
+			StripeId:  rule.StripeId,
+			Country:   rule.Country,
+			Region:    rule.Region,
+			Name:      rule.Name,
+			Rate:      rule.Rate,
+			Inclusive: rule.Inclusive,
+			Amount:    int(math.Round(float64(subtotal) * rule.Rate / 100)),
+		}
+
+		if rule.Inclusive {
+			inclusiveLeft -= line.Amount
+			lastInclusive = len(result.Lines)
+		} else {
+			result.Total += line.Amount
+		}
+
+		result.Tax += line.Amount
+		result.Lines = append(result.Lines, line)
+	}
+
+	// rounding each line can leave a cent over or under what was taken out of the price
+	if lastInclusive >= 0 {
+		result.Lines[lastInclusive].Amount += inclusiveLeft
+		result.Tax += inclusiveLeft
+	}
+
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package tax
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testRules = []Rule{
+	{Id: 1, Country: "CA", Name: "GST", Rate: 5},
+	{Id: 2, Country: "CA", Region: "ON", Name: "HST", Rate: 13},
+	{Id: 3, Country: "CA", Region: "QC", Name: "GST", Rate: 5},
+	{Id: 4, Country: "CA", Region: "QC", Name: "QST", Rate: 9.975},
+	{Id: 5, Country: "GB", Name: "VAT", Rate: 20, Inclusive: true},
+	{Id: 6, Country: "XX", Name: "Federal", Rate: 5, Inclusive: true},
+	{Id: 7, Country: "XX", Name: "State", Rate: 9.975, Inclusive: true},
+	{Id: 8, Country: "YY", Name: "VAT", Rate: 10, Inclusive: true},
+	{Id: 9, Country: "YY", Name: "Levy", Rate: 2.5},
+}
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  Request
+		subtotal int
+		total    int
+		lines    []int
+	}{
+		// exclusive taxes are added on top of the listed price
+		{"exclusive", Request{Country: "CA", Region: "ON", Amount: 1000}, 1000, 1130, []int{130}},
+		{"exclusive country rate", Request{Country: "CA", Region: "AB", Amount: 1000}, 1000, 1050, []int{50}},
+		{"exclusive lines rounded apart", Request{Country: "CA", Region: "QC", Amount: 1000}, 1000, 1150, []int{50, 100}},
+
+		// inclusive taxes are taken out of the listed price, which stays the total
+		{"inclusive", Request{Country: "GB", Amount: 1200}, 1000, 1200, []int{200}},
+		{"inclusive rounded", Request{Country: "GB", Amount: 1000}, 833, 1000, []int{167}},
+
+		// each line rounds half a cent up, and the last inclusive line takes the cent the
+		// rounded lines come to over the tax taken out of the price
+		{"half cent exclusive", Request{Country: "CA", Region: "AB", Amount: 1010}, 1010, 1061, []int{51}},
+		{"half cent of a small amount", Request{Country: "CA", Region: "AB", Amount: 10}, 10, 11, []int{1}},
+		{"half cent inclusive lines", Request{Country: "XX", Amount: 1000}, 870, 1000, []int{44, 86}},
+
+		// exclusive taxes are charged on the price less inclusive tax
+		{"inclusive and exclusive", Request{Country: "YY", Amount: 1100}, 1000, 1125, []int{100, 25}},
+
+		{"no rules", Request{Country: "US", Amount: 1000}, 1000, 1000, nil},
+		{"exempt", Request{Customer: "Exempt@Example.com", Country: "CA", Region: "ON", Amount: 1000}, 1000, 1000, nil},
+	}
+
+	table := NewRuleTable(testRules, []string{"exempt@example.com"})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := table.Calculate(tt.request)
+			if err != nil {
+				t.Fatalf("calculate: %v", err)
+			}
+
+			var lines []int
+			sum := 0
+			for _, line := range result.Lines {
+				lines = append(lines, line.Amount)
+				sum += line.Amount
+			}
+
+			if result.Subtotal != tt.subtotal || result.Total != tt.total || !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("got subtotal %d total %d lines %v, want %d %d %v",
+					result.Subtotal, result.Total, lines, tt.subtotal, tt.total, tt.lines)
+			}
+
+			// the lines always add up to the order's tax and total
+			if sum != result.Tax {
+				t.Errorf("lines add up to %d, but the tax is %d", sum, result.Tax)
+			}
+			if result.Subtotal+result.Tax != result.Total {
+				t.Errorf("subtotal %d + tax %d != total %d", result.Subtotal, result.Tax, result.Total)
+			}
+			if result.Total-result.ExclusiveTax() != tt.request.Amount {
+				t.Errorf("total %d less exclusive tax %d is not the listed price %d",
+					result.Total, result.ExclusiveTax(), tt.request.Amount)
+			}
+		})
+	}
+}
+
+// TestCalculateLinesAddUp checks that the rounded lines add up to the order's tax for
+// every price, not just the ones above
+func TestCalculateLinesAddUp(t *testing.T) {
+	table := NewRuleTable(testRules, nil)
+
+	for _, country := range []string{"CA", "GB", "XX", "YY"} {
+		for amount := 0; amount <= 5000; amount++ {
+			result, err := table.Calculate(Request{Country: country, Region: "QC", Amount: amount})
+			if err != nil {
+				t.Fatalf("%s %d: %v", country, amount, err)
+			}
+
+			sum := 0
+			for _, line := range result.Lines {
+				sum += line.Amount
+			}
+			if sum != result.Tax || result.Subtotal+result.Tax != result.Total ||
+				result.Total-result.ExclusiveTax() != amount {
+				t.Fatalf("%s %d: got subtotal %d tax %d total %d from lines adding up to %d",
+					country, amount, result.Subtotal, result.Tax, result.Total, sum)
+			}
+		}
+	}
+}
+
+func TestCalculateNegative(t *testing.T) {
+	_, err := NewRuleTable(testRules, nil).Calculate(Request{Country: "CA", Amount: -1})
+	if err == nil {
+		t.Error("taxing a negative amount did not fail")
+	}
+}
+
+func TestNoTax(t *testing.T) {
+	result, err := NoTax{}.Calculate(Request{Country: "CA", Region: "ON", Amount: 1000})
+	if err != nil || result.Total != 1000 || result.Tax != 0 || len(result.Lines) != 0 {
+		t.Errorf("got %+v, %v, want no tax", result, err)
+	}
+}
@@ -0,0 +1,83 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of RFC 6238 Appendix B, "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the RFC 6238 Appendix B SHA-1 vectors; the RFC's codes have eight digits, of which
+	// ours are the last six
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	// secrets are typed into authenticator apps, so either case is accepted
+	lower, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	if err != nil || lower != "287082" {
+		t.Errorf("Code with a lower case secret = %s, %v, want 287082", lower, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	code := func(s int64) string {
+		c, err := Code(rfcSecret, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		after    int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current", code(step), 0, step, true},
+		{"spaced", code(step)[:3] + " " + code(step)[3:], 0, step, true},
+		{"one step behind", code(step - 1), 0, step - 1, true},
+		{"one step ahead", code(step + 1), 0, step + 1, true},
+		{"two steps behind", code(step - 2), 0, 0, false},
+		{"two steps ahead", code(step + 2), 0, 0, false},
+		{"too short", code(step)[:5], 0, 0, false},
+		{"wrong", "000000", 0, 0, false},
+
+		// a code is refused once it, or a later one, has been used
+		{"already used", code(step), step, 0, false},
+		{"older than the last used", code(step - 1), step, 0, false},
+		{"newer than the last used", code(step + 1), step, step + 1, true},
+	}
+
+	for _, tt := range tests {
+		gotStep, gotOK := Validate(rfcSecret, tt.code, now, tt.after)
+		if gotStep != tt.wantStep || gotOK != tt.wantOK {
+			t.Errorf("%s: Validate = %d, %t, want %d, %t", tt.name, gotStep, gotOK, tt.wantStep, tt.wantOK)
+		}
+	}
+}
@@ -46,3 +46,18 @@ func (s *Signer) Expired(token string, minsUntilExpire int) bool {
 
 	return time.Since(ts.Timestamp) > time.Duration(minsUntilExpire)*time.Minute
 }
+
+// Data returns the string a token was generated from, and false if the token is not valid
+func (s *Signer) Data(token string) (string, bool) {
+	crypt := goalone.New(s.Secret, goalone.Timestamp)
+	data, err := crypt.Unsign([]byte(token))
+	if err != nil {
+		return "", false
+	}
+
+	signed := string(data)
+	signed = strings.TrimSuffix(signed, "&hash=")
+	signed = strings.TrimSuffix(signed, "?hash=")
+
+	return signed, true
+}